@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var coldStartDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "function_cold_start_duration_seconds",
+		Help:    "Time spent waiting for a function to scale up from zero",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60},
+	},
+	[]string{"function", "revision"},
+)
+
+func init() {
+	prometheus.MustRegister(coldStartDuration)
+}
+
+// errActivationTimeout is returned when a function does not get a ready
+// endpoint before the activation deadline.
+var errActivationTimeout = errors.New("function did not become ready in time")
+
+// Activator wakes functions that have been scaled to zero. Invocations for
+// a function without ready pods are held until the function is ready or the
+// activationTimeout from the platform config passes; concurrent callers
+// share a single scale-up.
+type Activator struct {
+	k8sClient    *KubernetesClient
+	config       *ConfigStore
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*activation
+}
+
+type activation struct {
+	done chan struct{}
+	err  error
+}
+
+func NewActivator(k8sClient *KubernetesClient, config *ConfigStore) *Activator {
+	return &Activator{
+		k8sClient:    k8sClient,
+		config:       config,
+		pollInterval: 250 * time.Millisecond,
+		pending:      make(map[string]*activation),
+	}
+}
+
+// Activate returns once the target workload of a function has at least one
+// ready endpoint. It reports whether the caller had to wait for a cold
+// start.
+func (a *Activator) Activate(ctx context.Context, function string, target invocationTarget) (bool, error) {
+	ready, err := a.k8sClient.ReadyEndpoints(ctx, target.backend)
+	if err != nil {
+		return false, err
+	}
+	if ready > 0 {
+		return false, nil
+	}
+
+	act := a.activation(function, target)
+	select {
+	case <-act.done:
+		return true, act.err
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// activation returns the in-flight activation for a workload, starting one
+// if none is running.
+func (a *Activator) activation(function string, target invocationTarget) *activation {
+	name := target.backend
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if act, ok := a.pending[name]; ok {
+		return act
+	}
+
+	act := &activation{done: make(chan struct{})}
+	a.pending[name] = act
+
+	go func() {
+		act.err = a.activate(function, target)
+
+		a.mu.Lock()
+		delete(a.pending, name)
+		a.mu.Unlock()
+
+		close(act.done)
+	}()
+
+	return act
+}
+
+// activate scales a workload up and waits for it to be ready. Cold starts
+// are counted per function and revision, not per workload, and only if
+// this activation scaled the workload from zero.
+func (a *Activator) activate(function string, target invocationTarget) error {
+	name := target.backend
+	cfg := a.config.Get()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ActivationTimeout)
+	defer cancel()
+
+	start := time.Now()
+	scaled, err := a.k8sClient.ScaleFromZero(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to scale up function %s: %w", name, err)
+	}
+	if scaled {
+		coldStarts.WithLabelValues(function, target.revision).Inc()
+	}
+
+	ticker := time.NewTicker(a.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		ready, err := a.k8sClient.ReadyEndpoints(ctx, name)
+		if err == nil && ready > 0 {
+			elapsed := time.Since(start)
+			if !scaled {
+				return nil
+			}
+			coldStartDuration.WithLabelValues(function, target.revision).Observe(elapsed.Seconds())
+			if elapsed > cfg.ColdStartThreshold {
+				log.Printf("Slow cold start: function %s took %s to activate (threshold %s)", name, elapsed, cfg.ColdStartThreshold)
+			} else {
+				log.Printf("Function %s activated in %s", name, elapsed)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s not ready after %s", errActivationTimeout, name, cfg.ActivationTimeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newActivatorTestClient returns a client whose function "hello" has a
+// Deployment with replicas and no ready endpoints. Its endpoints become
+// ready once the Deployment has replicas.
+func newActivatorTestClient(t *testing.T, replicas int32) *KubernetesClient {
+	t.Helper()
+
+	k, _ := newInvokeTestClient(t, http.NotFoundHandler())
+	ctx := context.Background()
+	endpoints := k.clientset.CoreV1().Endpoints(testNamespace)
+	ready, err := endpoints.Get(ctx, "hello", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := endpoints.Update(ctx, &corev1.Endpoints{ObjectMeta: ready.ObjectMeta}, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deployments := k.clientset.AppsV1().Deployments(testNamespace)
+	if _, err := deployments.Create(ctx, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "hello", Namespace: testNamespace},
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(replicas)},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			deployment, err := deployments.Get(ctx, "hello", metav1.GetOptions{})
+			if err == nil && *deployment.Spec.Replicas > 0 {
+				endpoints.Update(ctx, ready, metav1.UpdateOptions{})
+				return
+			}
+		}
+	}()
+	return k
+}
+
+func TestActivateScalesFromZero(t *testing.T) {
+	k := newActivatorTestClient(t, 0)
+	a := NewActivator(k, k.config)
+	a.pollInterval = 10 * time.Millisecond
+	cold := coldStarts.WithLabelValues("hello", "from-zero")
+	before := testutil.ToFloat64(cold)
+
+	coldStart, err := a.Activate(context.Background(), "hello", invocationTarget{backend: "hello", revision: "from-zero"})
+	if err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	if !coldStart {
+		t.Error("Activate did not report a cold start")
+	}
+	if got := testutil.ToFloat64(cold) - before; got != 1 {
+		t.Errorf("%v cold starts counted, want 1", got)
+	}
+
+	deployment, err := k.clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "hello", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 1 || deployment.Annotations[lastInvocationAnnotation] == "" {
+		t.Errorf("deployment has %d replicas and annotations %v, want 1 replica and a last invocation",
+			*deployment.Spec.Replicas, deployment.Annotations)
+	}
+}
+
+func TestActivateWaitsForScaledUpFunction(t *testing.T) {
+	// Another API server replica scaled the function up; its pods are not
+	// ready yet.
+	k := newActivatorTestClient(t, 1)
+	a := NewActivator(k, k.config)
+	a.pollInterval = 10 * time.Millisecond
+	cold := coldStarts.WithLabelValues("hello", "scaled-up")
+	before := testutil.ToFloat64(cold)
+
+	if _, err := a.Activate(context.Background(), "hello", invocationTarget{backend: "hello", revision: "scaled-up"}); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	if got := testutil.ToFloat64(cold) - before; got != 0 {
+		t.Errorf("%v cold starts counted, want 0", got)
+	}
+}
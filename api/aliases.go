@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Alias is a stable name, such as prod or staging, for one revision of a
+// function. Moving an alias promotes a revision without redeploying the
+// function.
+type Alias struct {
+	Name     string `json:"name"`
+	Revision int64  `json:"revision"`
+}
+
+// ListAliases returns the aliases of a function sorted by name.
+func (k *KubernetesClient) ListAliases(ctx context.Context, name string) ([]Alias, error) {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make([]Alias, 0, len(fn.Aliases))
+	for _, alias := range sortedAliases(fn.Aliases) {
+		aliases = append(aliases, Alias{Name: alias, Revision: fn.Aliases[alias]})
+	}
+	return aliases, nil
+}
+
+// GetAlias returns a single alias of a function.
+func (k *KubernetesClient) GetAlias(ctx context.Context, name, alias string) (*Alias, error) {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	revision, ok := fn.Aliases[alias]
+	if !ok {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no alias %s", name, alias))
+	}
+	return &Alias{Name: alias, Revision: revision}, nil
+}
+
+// SetAlias points an alias at a revision, creating the alias if needed.
+// Only the alias's workload changes; the function's code is untouched.
+func (k *KubernetesClient) SetAlias(ctx context.Context, name, alias string, revision int64) (*Alias, error) {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[string]int64, len(fn.Aliases)+1)
+	for a, r := range fn.Aliases {
+		aliases[a] = r
+	}
+	aliases[alias] = revision
+	fn.Aliases = aliases
+
+	if err := k.UpdateFunction(ctx, fn); err != nil {
+		return nil, err
+	}
+	return &Alias{Name: alias, Revision: revision}, nil
+}
+
+// DeleteAlias removes an alias. The workload of its revision is deleted
+// unless something else still pins it.
+func (k *KubernetesClient) DeleteAlias(ctx context.Context, name, alias string) error {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fn.Aliases[alias]; !ok {
+		return NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no alias %s", name, alias))
+	}
+
+	aliases := make(map[string]int64, len(fn.Aliases))
+	for a, r := range fn.Aliases {
+		if a != alias {
+			aliases[a] = r
+		}
+	}
+	fn.Aliases = aliases
+
+	return k.UpdateFunction(ctx, fn)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var asyncQueueLength = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "async_invocation_queue_length",
+		Help: "Asynchronous invocations waiting for a worker",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(asyncQueueLength)
+}
+
+// errAsyncQueueFull is returned when an asynchronous invocation cannot be
+// queued because the queue is at capacity.
+var errAsyncQueueFull = errors.New("asynchronous invocation queue is full")
+
+const (
+	// apiPodLabel selects the API server pods, see k8s/api-deployment.yaml.
+	apiPodLabel = "kube-serverless-api"
+	// forwardedHeader marks an invocation lookup forwarded by another
+	// replica, so it is never forwarded again.
+	forwardedHeader = "X-Kube-Serverless-Forwarded"
+)
+
+// Invocation states reported in Invocation.State.
+const (
+	InvocationQueued    = "queued"
+	InvocationRunning   = "running"
+	InvocationSucceeded = "succeeded"
+	InvocationFailed    = "failed"
+	InvocationCancelled = "cancelled"
+)
+
+// Invocation is the record of an asynchronous invocation. An attempt fails
+// if the function could not be reached or answered with a 5xx status or a
+// status its retry policy retries; an invocation fails if its last attempt
+// did, and is then stored as a dead letter.
+type Invocation struct {
+	ID          string     `json:"id"`
+	Function    string     `json:"function"`
+	Revision    string     `json:"revision,omitempty"`
+	Source      string     `json:"source"`
+	State       string     `json:"state"`
+	Attempts    int32      `json:"attempts"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	Result      string     `json:"result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	DeadLetter  string     `json:"deadLetter,omitempty"`
+	EnqueuedAt  time.Time  `json:"enqueuedAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// Duration is the time the invocation ran for, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+type asyncJob struct {
+	id       string
+	function string
+	source   string
+	target   invocationTarget
+	policy   RetryPolicy
+	limits   invocationLimits
+	request  *InvocationRequest
+	// done, if set, is called with the final record of the invocation.
+	done func(Invocation)
+}
+
+// Sources of asynchronous invocations, reported in Invocation.Source and
+// DeadLetter.Source.
+const (
+	SourceAsync    = "async"
+	SourceRedrive  = "redrive"
+	SourceCron     = "cron"
+	SourceK8sEvent = "k8s-event"
+	SourceKafka    = "kafka"
+)
+
+// invokeFunc runs one invocation of a function on the given target.
+type invokeFunc func(ctx context.Context, function string, target invocationTarget, limits invocationLimits, inv *InvocationRequest) (*InvocationResponse, error)
+
+// AsyncInvoker runs asynchronous invocations on a bounded pool of workers,
+// retrying failed attempts according to the function's retry policy and
+// storing invocations that still fail as dead letters. A worker waits out
+// the backoff between attempts itself. Invocation records are held in
+// memory by the replica that accepted them; their IDs start with the
+// replica's identity so other replicas can forward lookups to it.
+type AsyncInvoker struct {
+	k8sClient *KubernetesClient
+	invoke    invokeFunc
+	config    *ConfigStore
+	identity  string
+	workers   int
+	queue     chan *asyncJob
+
+	mu          sync.Mutex
+	invocations map[string]*Invocation
+	cancels     map[string]context.CancelFunc
+}
+
+func NewAsyncInvoker(k8sClient *KubernetesClient, invoke invokeFunc, config *ConfigStore, identity string) *AsyncInvoker {
+	cfg := config.Get()
+	return &AsyncInvoker{
+		k8sClient:   k8sClient,
+		invoke:      invoke,
+		config:      config,
+		identity:    identity,
+		workers:     cfg.AsyncWorkers,
+		queue:       make(chan *asyncJob, cfg.AsyncQueueSize),
+		invocations: make(map[string]*Invocation),
+		cancels:     make(map[string]context.CancelFunc),
+	}
+}
+
+// Run starts the workers and expires finished invocations until ctx is
+// cancelled.
+func (a *AsyncInvoker) Run(ctx context.Context) {
+	for i := 0; i < a.workers; i++ {
+		go a.runWorker(ctx)
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.expire(time.Now())
+		}
+	}
+}
+
+// Enqueue queues an invocation of fn from the given source and returns its
+// record.
+func (a *AsyncInvoker) Enqueue(fn *Function, source string, target invocationTarget, inv *InvocationRequest) (*Invocation, error) {
+	return a.enqueue(fn, source, target, inv, nil)
+}
+
+// enqueue is Enqueue with a callback for the final record of the
+// invocation.
+func (a *AsyncInvoker) enqueue(fn *Function, source string, target invocationTarget, inv *InvocationRequest, done func(Invocation)) (*Invocation, error) {
+	id, err := a.newID()
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Invocation{
+		ID:         id,
+		Function:   fn.Name,
+		Revision:   target.revision,
+		Source:     source,
+		State:      InvocationQueued,
+		EnqueuedAt: time.Now().UTC(),
+	}
+
+	job := &asyncJob{
+		id:       id,
+		function: fn.Name,
+		source:   source,
+		target:   target,
+		policy:   effectiveRetryPolicy(fn),
+		limits:   invocationLimitsOf(fn),
+		request:  inv,
+		done:     done,
+	}
+
+	a.mu.Lock()
+	a.invocations[id] = record
+	a.mu.Unlock()
+
+	select {
+	case a.queue <- job:
+		asyncQueueLength.Set(float64(len(a.queue)))
+	default:
+		a.mu.Lock()
+		delete(a.invocations, id)
+		a.mu.Unlock()
+		return nil, errAsyncQueueFull
+	}
+
+	snapshot := *record
+	return &snapshot, nil
+}
+
+// Get returns a copy of the record of an invocation accepted by this
+// replica.
+func (a *AsyncInvoker) Get(id string) (*Invocation, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record, ok := a.invocations[id]
+	if !ok {
+		return nil, false
+	}
+	snapshot := *record
+	return &snapshot, true
+}
+
+// Cancel stops an invocation accepted by this replica. A queued invocation
+// is not run; a running one has its current attempt aborted and is not
+// retried. Cancelled invocations are not stored as dead letters.
+func (a *AsyncInvoker) Cancel(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record, ok := a.invocations[id]
+	if !ok || record.CompletedAt != nil {
+		return
+	}
+	if cancel, ok := a.cancels[id]; ok {
+		cancel()
+		return
+	}
+	now := time.Now().UTC()
+	record.State = InvocationCancelled
+	record.CompletedAt = &now
+}
+
+// owner returns the identity of the replica that accepted an invocation.
+func (a *AsyncInvoker) owner(id string) string {
+	i := strings.LastIndex(id, ".")
+	if i < 0 {
+		return ""
+	}
+	return id[:i]
+}
+
+func (a *AsyncInvoker) newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return a.identity + "." + hex.EncodeToString(b), nil
+}
+
+func (a *AsyncInvoker) runWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-a.queue:
+			asyncQueueLength.Set(float64(len(a.queue)))
+			a.run(ctx, job)
+		}
+	}
+}
+
+func (a *AsyncInvoker) run(ctx context.Context, job *asyncJob) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now().UTC()
+	a.mu.Lock()
+	record, ok := a.invocations[job.id]
+	if !ok || record.State == InvocationCancelled {
+		// Cancelled while queued; the record may already have expired.
+		snapshot := Invocation{ID: job.id, Function: job.function, Source: job.source, State: InvocationCancelled}
+		if ok {
+			snapshot = *record
+		}
+		a.mu.Unlock()
+		if job.done != nil {
+			job.done(snapshot)
+		}
+		return
+	}
+	record.State = InvocationRunning
+	record.StartedAt = &start
+	a.cancels[job.id] = cancel
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		delete(a.cancels, job.id)
+		a.mu.Unlock()
+	}()
+
+	var (
+		resp      *InvocationResponse
+		err       error
+		attempt   int32
+		cancelled bool
+	)
+	for {
+		attempt++
+		resp, err = a.invoke(jobCtx, job.function, job.target, job.limits, job.request)
+		a.update(job.id, func(record *Invocation) {
+			record.Attempts = attempt
+		})
+
+		if jobCtx.Err() != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			cancelled = true
+			break
+		}
+		if !job.policy.failed(resp, err) || !job.policy.shouldRetry(attempt, resp, err) {
+			break
+		}
+
+		backoff := job.policy.backoff(attempt)
+		log.Printf("Asynchronous invocation %s of %s failed on attempt %d, retrying in %s: %s", job.id, job.function, attempt, backoff, attemptError(resp, err))
+		select {
+		case <-jobCtx.Done():
+			if ctx.Err() != nil {
+				return
+			}
+			cancelled = true
+		case <-time.After(backoff):
+		}
+		if cancelled {
+			break
+		}
+	}
+
+	failed := !cancelled && job.policy.failed(resp, err)
+	var deadLetter string
+	if failed {
+		log.Printf("Asynchronous invocation %s of %s failed after %d attempts: %s", job.id, job.function, attempt, attemptError(resp, err))
+		deadLetter = a.storeDeadLetter(ctx, job, attempt, resp, err)
+	}
+
+	end := time.Now().UTC()
+	var final Invocation
+	a.update(job.id, func(record *Invocation) {
+		defer func() { final = *record }()
+
+		record.CompletedAt = &end
+		record.Duration = end.Sub(start).Seconds()
+		record.DeadLetter = deadLetter
+
+		switch {
+		case cancelled:
+			record.State = InvocationCancelled
+			return
+		case failed:
+			record.State = InvocationFailed
+		default:
+			record.State = InvocationSucceeded
+		}
+		if err != nil {
+			record.Error = err.Error()
+			return
+		}
+		record.StatusCode = resp.StatusCode
+		record.Result = string(resp.Body)
+	})
+
+	if job.done != nil {
+		job.done(final)
+	}
+}
+
+// storeDeadLetter records a failed invocation and returns the dead letter's
+// ID, or an empty string if it could not be stored.
+func (a *AsyncInvoker) storeDeadLetter(ctx context.Context, job *asyncJob, attempts int32, resp *InvocationResponse, err error) string {
+	dl := newDeadLetter(job.function, job.source, attempts, resp, err)
+	dl.InvocationID = job.id
+
+	if err := a.k8sClient.CreateDeadLetter(ctx, dl, job.request); err != nil {
+		log.Printf("Failed to store dead letter for invocation %s of %s: %v", job.id, job.function, err)
+		return ""
+	}
+	return dl.ID
+}
+
+// attemptError describes a failed attempt for logging.
+func attemptError(resp *InvocationResponse, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("HTTP %d", resp.StatusCode)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func (a *AsyncInvoker) update(id string, mutate func(*Invocation)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if record, ok := a.invocations[id]; ok {
+		mutate(record)
+	}
+}
+
+// expire drops finished invocations older than the configured TTL.
+func (a *AsyncInvoker) expire(now time.Time) {
+	ttl := a.config.Get().AsyncResultTTL
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, record := range a.invocations {
+		if record.CompletedAt != nil && now.Sub(*record.CompletedAt) > ttl {
+			delete(a.invocations, id)
+		}
+	}
+}
+
+// isAsyncInvocation reports whether the caller asked for an asynchronous
+// invocation, with ?mode=async or an X-Invocation-Type: Event header.
+func isAsyncInvocation(r *http.Request) bool {
+	return r.URL.Query().Get("mode") == "async" || r.Header.Get("X-Invocation-Type") == "Event"
+}
+
+// invokeAsync queues an invocation and answers 202 with its record.
+func (s *Server) invokeAsync(w http.ResponseWriter, r *http.Request, fn *Function, target invocationTarget) {
+	inv, err := NewInvocationRequest(r)
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	inv.Query.Del("mode")
+
+	record, err := s.async.Enqueue(fn, SourceAsync, target, inv)
+	if err != nil {
+		if errors.Is(err, errAsyncQueueFull) {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/invocations/"+record.ID)
+	writeJSON(w, http.StatusAccepted, record)
+}
+
+// getInvocationHandler returns the record of an asynchronous invocation,
+// asking the replica that accepted it if it is not held here.
+func (s *Server) getInvocationHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if record, ok := s.async.Get(id); ok {
+		writeJSON(w, http.StatusOK, record)
+		return
+	}
+
+	owner := s.async.owner(id)
+	if owner == "" || owner == s.async.identity || r.Header.Get(forwardedHeader) != "" {
+		writeError(w, NewAPIError(http.StatusNotFound, fmt.Sprintf("invocation %s not found", id)))
+		return
+	}
+
+	resp, err := s.forwardInvocationLookup(r.Context(), owner, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// forwardInvocationLookup asks the API server pod named owner for an
+// invocation record. Only pods of the API server Deployment are asked.
+func (s *Server) forwardInvocationLookup(ctx context.Context, owner, id string) (*http.Response, error) {
+	k := s.k8sClient
+	pod, err := k.clientset.CoreV1().Pods(k.namespace).Get(ctx, owner, metav1.GetOptions{})
+	if err != nil || pod.Labels["app"] != apiPodLabel || pod.Status.PodIP == "" {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("invocation %s not found, the API server replica that accepted it is gone", id))
+	}
+
+	target := fmt.Sprintf("http://%s/api/v1/invocations/%s", net.JoinHostPort(pod.Status.PodIP, s.port), id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(forwardedHeader, s.async.identity)
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, NewAPIError(http.StatusBadGateway, fmt.Sprintf("API server replica %s unreachable: %v", owner, err))
+	}
+	return resp, nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+)
+
+// Scaling metrics of a ScalingPolicy.
+const (
+	ScalingMetricCPU         = "cpu"
+	ScalingMetricConcurrency = "concurrency"
+	ScalingMetricRPS         = "rps"
+)
+
+// Scaling defaults used for fields a function's ScalingPolicy leaves unset.
+// The stabilization windows match the HPA's.
+const (
+	defaultCPUTarget                     = 80
+	defaultScaleUpStabilizationSeconds   = 0
+	defaultScaleDownStabilizationSeconds = 300
+	maxStabilizationSeconds              = 3600
+)
+
+const (
+	maxReplicasAnnotation            = "serverless.kube.io/max-replicas"
+	scalingMetricAnnotation          = "serverless.kube.io/scaling-metric"
+	scalingTargetAnnotation          = "serverless.kube.io/scaling-target"
+	scaleUpStabilizationAnnotation   = "serverless.kube.io/scale-up-stabilization"
+	scaleDownStabilizationAnnotation = "serverless.kube.io/scale-down-stabilization"
+)
+
+var (
+	autoscalerDesiredReplicas = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "autoscaler_desired_replicas",
+			Help: "Replicas the autoscaler recommends for a function workload",
+		},
+		[]string{"function"},
+	)
+	autoscalerObservedLoad = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "autoscaler_observed_load",
+			Help: "In-flight invocations or invocations per second of a function workload, across API server replicas",
+		},
+		[]string{"function", "metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(autoscalerDesiredReplicas)
+	prometheus.MustRegister(autoscalerObservedLoad)
+}
+
+// ScalingPolicy chooses what a function is scaled on. With the cpu metric
+// an HPA scales the function on CPU utilization; with concurrency or rps
+// the API server's autoscaler scales it on the invocations it proxies.
+type ScalingPolicy struct {
+	// Metric is cpu, concurrency or rps.
+	Metric string `json:"metric,omitempty"`
+	// Target is the value per replica to scale to: CPU utilization in
+	// percent of the request, in-flight invocations, or invocations per
+	// second.
+	Target int32 `json:"target,omitempty"`
+	// ScaleUpStabilizationSeconds and ScaleDownStabilizationSeconds are how
+	// far back recommendations are considered before scaling up or down:
+	// the function scales up to the lowest and down to the highest
+	// recommendation in the window.
+	ScaleUpStabilizationSeconds   *int32 `json:"scaleUpStabilizationSeconds,omitempty"`
+	ScaleDownStabilizationSeconds *int32 `json:"scaleDownStabilizationSeconds,omitempty"`
+}
+
+// effectiveScalingPolicy returns the function's scaling policy with
+// defaults filled in.
+func effectiveScalingPolicy(fn *Function) ScalingPolicy {
+	var p ScalingPolicy
+	if fn.Scaling != nil {
+		p = *fn.Scaling
+	}
+	if p.Metric == "" {
+		p.Metric = ScalingMetricCPU
+	}
+	if p.Target == 0 && p.Metric == ScalingMetricCPU {
+		p.Target = defaultCPUTarget
+	}
+	if p.ScaleUpStabilizationSeconds == nil {
+		p.ScaleUpStabilizationSeconds = int32Ptr(defaultScaleUpStabilizationSeconds)
+	}
+	if p.ScaleDownStabilizationSeconds == nil {
+		p.ScaleDownStabilizationSeconds = int32Ptr(defaultScaleDownStabilizationSeconds)
+	}
+	return p
+}
+
+// autoscaled reports whether the policy is served by the API server's
+// autoscaler rather than an HPA.
+func (p ScalingPolicy) autoscaled() bool {
+	return p.Metric == ScalingMetricConcurrency || p.Metric == ScalingMetricRPS
+}
+
+// annotations records the policy and replica bounds on a function's
+// Deployment, where the autoscaler reads them.
+func (p ScalingPolicy) annotations(fn *Function) map[string]string {
+	return map[string]string{
+		maxReplicasAnnotation:            strconv.Itoa(int(fn.MaxReplicas)),
+		scalingMetricAnnotation:          p.Metric,
+		scalingTargetAnnotation:          strconv.Itoa(int(p.Target)),
+		scaleUpStabilizationAnnotation:   strconv.Itoa(int(*p.ScaleUpStabilizationSeconds)),
+		scaleDownStabilizationAnnotation: strconv.Itoa(int(*p.ScaleDownStabilizationSeconds)),
+	}
+}
+
+// hpaBehavior returns the HPA behavior for the policy's stabilization
+// windows.
+func (p ScalingPolicy) hpaBehavior() *autoscalingv2.HorizontalPodAutoscalerBehavior {
+	return &autoscalingv2.HorizontalPodAutoscalerBehavior{
+		ScaleUp: &autoscalingv2.HPAScalingRules{
+			StabilizationWindowSeconds: int32Ptr(*p.ScaleUpStabilizationSeconds),
+		},
+		ScaleDown: &autoscalingv2.HPAScalingRules{
+			StabilizationWindowSeconds: int32Ptr(*p.ScaleDownStabilizationSeconds),
+		},
+	}
+}
+
+// deploymentScaling reads the policy of an autoscaled workload from its
+// Deployment. It reports false for workloads scaled by an HPA and for
+// Deployments written before policies were recorded.
+func deploymentScaling(dep *appsv1.Deployment) (ScalingPolicy, int32, bool) {
+	p := ScalingPolicy{
+		Metric:                        dep.Annotations[scalingMetricAnnotation],
+		ScaleUpStabilizationSeconds:   new(int32),
+		ScaleDownStabilizationSeconds: new(int32),
+	}
+	if !p.autoscaled() {
+		return p, 0, false
+	}
+
+	var maxReplicas int32
+	values := map[string]*int32{
+		scalingTargetAnnotation:          &p.Target,
+		scaleUpStabilizationAnnotation:   p.ScaleUpStabilizationSeconds,
+		scaleDownStabilizationAnnotation: p.ScaleDownStabilizationSeconds,
+		maxReplicasAnnotation:            &maxReplicas,
+	}
+	for key, dst := range values {
+		n, err := strconv.ParseInt(dep.Annotations[key], 10, 32)
+		if err != nil {
+			return p, 0, false
+		}
+		*dst = int32(n)
+	}
+	if p.Target < 1 {
+		return p, 0, false
+	}
+	return p, maxReplicas, true
+}
+
+// WorkloadLoad is the invocation load one API server replica has seen for a
+// function workload: invocations in flight and started since the replica
+// started.
+type WorkloadLoad struct {
+	InFlight    int   `json:"inFlight"`
+	Invocations int64 `json:"invocations"`
+}
+
+// loadCollector returns the load of every API server replica, by replica
+// and workload.
+type loadCollector func(ctx context.Context) (map[string]map[string]WorkloadLoad, error)
+
+// loadTick is the load of all workloads at one autoscaler tick, summed
+// over the API server replicas.
+type loadTick struct {
+	at       time.Time
+	inFlight map[string]int
+	// invocations counts the invocations started since the previous tick.
+	invocations map[string]int64
+}
+
+type recommendation struct {
+	at       time.Time
+	replicas int32
+}
+
+// Autoscaler scales functions whose scaling policy uses the concurrency or
+// rps metric. It runs on the replica holding the controller lease, collects
+// the invocation counters of every API server replica, averages them over
+// a short window, and sets the Deployment's replicas to reach the policy's
+// target per replica, stabilized like the HPA. Functions scaled to zero are
+// left to the activator, and scaling to zero to the idle scaler.
+type Autoscaler struct {
+	k8sClient *KubernetesClient
+	config    *ConfigStore
+	collect   loadCollector
+	interval  time.Duration
+	window    time.Duration
+
+	// State of the current term of leadership, only touched by Run.
+	started         time.Time
+	counters        map[string]map[string]int64
+	ticks           []loadTick
+	recommendations map[string][]recommendation
+}
+
+func NewAutoscaler(k8sClient *KubernetesClient, config *ConfigStore, collect loadCollector) *Autoscaler {
+	return &Autoscaler{
+		k8sClient: k8sClient,
+		config:    config,
+		collect:   collect,
+		interval:  2 * time.Second,
+		window:    10 * time.Second,
+	}
+}
+
+// Run scales the autoscaled workloads among deployments until ctx is
+// cancelled.
+func (a *Autoscaler) Run(ctx context.Context, deployments appslisters.DeploymentLister) {
+	a.started = time.Now()
+	a.counters = make(map[string]map[string]int64)
+	a.ticks = nil
+	a.recommendations = make(map[string][]recommendation)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.scale(ctx, deployments, now)
+		}
+	}
+}
+
+func (a *Autoscaler) scale(ctx context.Context, deployments appslisters.DeploymentLister, now time.Time) {
+	load, err := a.collect(ctx)
+	if err != nil {
+		log.Printf("Autoscaler: failed to collect load: %v", err)
+		return
+	}
+	a.record(now, load)
+
+	list, err := deployments.Deployments(a.k8sClient.namespace).List(labels.Everything())
+	if err != nil {
+		log.Printf("Autoscaler: failed to list deployments: %v", err)
+		return
+	}
+
+	cfg := a.config.Get()
+	seen := make(map[string]bool, len(list))
+	for _, dep := range list {
+		policy, maxReplicas, ok := deploymentScaling(dep)
+		if !ok || dep.Spec.Replicas == nil || *dep.Spec.Replicas == 0 {
+			continue
+		}
+		name := dep.Name
+		seen[name] = true
+
+		observed := a.observe(name, policy.Metric, now)
+		desired := int32(math.Ceil(observed / float64(policy.Target)))
+		if lower := max(minReplicas(dep, cfg), 1); desired < lower {
+			desired = lower
+		}
+		if desired > maxReplicas {
+			desired = maxReplicas
+		}
+
+		current := *dep.Spec.Replicas
+		replicas := a.stabilize(name, policy, current, desired, now)
+
+		autoscalerObservedLoad.WithLabelValues(name, policy.Metric).Set(observed)
+		autoscalerDesiredReplicas.WithLabelValues(name).Set(float64(replicas))
+
+		if replicas == current {
+			continue
+		}
+		log.Printf("Autoscaler: scaling %s from %d to %d replicas (%s %.2f, target %d per replica)",
+			name, current, replicas, policy.Metric, observed, policy.Target)
+		if err := a.k8sClient.ScaleFunction(ctx, name, replicas); err != nil {
+			log.Printf("Autoscaler: failed to scale %s: %v", name, err)
+		}
+	}
+
+	for name := range a.recommendations {
+		if !seen[name] {
+			delete(a.recommendations, name)
+			autoscalerDesiredReplicas.DeleteLabelValues(name)
+			autoscalerObservedLoad.DeleteLabelValues(name, ScalingMetricConcurrency)
+			autoscalerObservedLoad.DeleteLabelValues(name, ScalingMetricRPS)
+		}
+	}
+}
+
+// record adds a tick with the load collected from the replicas. Invocation
+// counters are per replica, so the invocations since the previous tick are
+// their differences; a replica seen for the first time contributes none, a
+// restarted one all it has counted.
+func (a *Autoscaler) record(now time.Time, load map[string]map[string]WorkloadLoad) {
+	tick := loadTick{
+		at:          now,
+		inFlight:    make(map[string]int),
+		invocations: make(map[string]int64),
+	}
+
+	counters := make(map[string]map[string]int64, len(load))
+	for replica, workloads := range load {
+		previous, known := a.counters[replica]
+		counters[replica] = make(map[string]int64, len(workloads))
+		for name, l := range workloads {
+			counters[replica][name] = l.Invocations
+			tick.inFlight[name] += l.InFlight
+			if !known {
+				continue
+			}
+			if delta := l.Invocations - previous[name]; delta >= 0 {
+				tick.invocations[name] += delta
+			} else {
+				tick.invocations[name] += l.Invocations
+			}
+		}
+	}
+	a.counters = counters
+
+	a.ticks = append(a.ticks, tick)
+	for len(a.ticks) > 0 && now.Sub(a.ticks[0].at) > a.window {
+		a.ticks = a.ticks[1:]
+	}
+}
+
+// observe returns a workload's load over the window: the average number of
+// invocations in flight, or the invocations per second.
+func (a *Autoscaler) observe(name, metric string, now time.Time) float64 {
+	if len(a.ticks) == 0 {
+		return 0
+	}
+
+	if metric == ScalingMetricConcurrency {
+		total := 0
+		for _, tick := range a.ticks {
+			total += tick.inFlight[name]
+		}
+		return float64(total) / float64(len(a.ticks))
+	}
+
+	var total int64
+	for _, tick := range a.ticks {
+		total += tick.invocations[name]
+	}
+	span := a.window
+	if elapsed := now.Sub(a.started); elapsed < span {
+		span = elapsed
+	}
+	if span <= 0 {
+		return 0
+	}
+	return float64(total) / span.Seconds()
+}
+
+// stabilize records a recommendation and returns the replicas to scale to:
+// up to the lowest recommendation within the scale-up window, or down to
+// the highest within the scale-down window, as the HPA does.
+func (a *Autoscaler) stabilize(name string, policy ScalingPolicy, current, desired int32, now time.Time) int32 {
+	upWindow := time.Duration(*policy.ScaleUpStabilizationSeconds) * time.Second
+	downWindow := time.Duration(*policy.ScaleDownStabilizationSeconds) * time.Second
+
+	recs := append(a.recommendations[name], recommendation{at: now, replicas: desired})
+	keep := max(upWindow, downWindow)
+	for len(recs) > 1 && now.Sub(recs[0].at) > keep {
+		recs = recs[1:]
+	}
+	a.recommendations[name] = recs
+
+	upLimit, downLimit := desired, desired
+	for _, rec := range recs {
+		age := now.Sub(rec.at)
+		if age <= upWindow && rec.replicas < upLimit {
+			upLimit = rec.replicas
+		}
+		if age <= downWindow && rec.replicas > downLimit {
+			downLimit = rec.replicas
+		}
+	}
+
+	replicas := current
+	if replicas < upLimit {
+		replicas = upLimit
+	}
+	if replicas > downLimit {
+		replicas = downLimit
+	}
+	return replicas
+}
+
+// collectLoad gathers the load every API server replica has seen: this
+// replica's directly, the others' from their load endpoint. Replicas that
+// cannot be reached are skipped.
+func (s *Server) collectLoad(ctx context.Context) (map[string]map[string]WorkloadLoad, error) {
+	identity := s.async.identity
+	load := map[string]map[string]WorkloadLoad{identity: s.scaler.Load()}
+
+	k := s.k8sClient
+	pods, err := k.clientset.CoreV1().Pods(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{"app": apiPodLabel}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Name == identity || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		replicaLoad, err := s.fetchLoad(ctx, pod.Status.PodIP)
+		if err != nil {
+			log.Printf("Autoscaler: failed to get load of API server replica %s: %v", pod.Name, err)
+			continue
+		}
+		load[pod.Name] = replicaLoad
+	}
+	return load, nil
+}
+
+func (s *Server) fetchLoad(ctx context.Context, ip string) (map[string]WorkloadLoad, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	target := fmt.Sprintf("http://%s/internal/load", net.JoinHostPort(ip, s.internalPort))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.k8sClient.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var load map[string]WorkloadLoad
+	if err := json.NewDecoder(resp.Body).Decode(&load); err != nil {
+		return nil, err
+	}
+	return load, nil
+}
+
+// loadHandler reports the load this replica has seen to the autoscaler.
+func (s *Server) loadHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.scaler.Load())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultNamespace        = "kube-serverless"
+	serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// ClientOptions selects the cluster the API server talks to.
+type ClientOptions struct {
+	// Kubeconfig is an explicit kubeconfig path. When empty, KUBECONFIG and
+	// then ~/.kube/config are used, and the in-cluster service account if
+	// none of them exist.
+	Kubeconfig string
+	// Context overrides the kubeconfig's current context.
+	Context string
+}
+
+// loadClientConfig returns the REST config for the cluster and the
+// namespace the platform runs in.
+func loadClientConfig(opts ClientOptions) (*rest.Config, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.Kubeconfig
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.Context}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		if clientcmd.IsEmptyConfig(err) {
+			return nil, "", fmt.Errorf("not running in a cluster and no kubeconfig found, set --kubeconfig or KUBECONFIG")
+		}
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	return config, resolveNamespace(clientConfig, opts.Context), nil
+}
+
+// resolveNamespace picks the platform namespace from, in order, the
+// NAMESPACE environment variable (set through the downward API in
+// k8s/api-deployment.yaml), the kubeconfig context, and the service
+// account's namespace when running in a cluster.
+func resolveNamespace(clientConfig clientcmd.ClientConfig, contextName string) string {
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns
+	}
+
+	if raw, err := clientConfig.RawConfig(); err == nil {
+		if contextName == "" {
+			contextName = raw.CurrentContext
+		}
+		if context, ok := raw.Contexts[contextName]; ok && context.Namespace != "" {
+			return context.Namespace
+		}
+	}
+
+	if data, err := os.ReadFile(serviceAccountNamespace); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+
+	return defaultNamespace
+}
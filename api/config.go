@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const platformConfigName = "kube-serverless-config"
+
+// PlatformConfig holds the platform-wide settings from the
+// kube-serverless-config ConfigMap.
+type PlatformConfig struct {
+	ScaleToZeroTimeout   time.Duration
+	DefaultMinReplicas   int32
+	DefaultMaxReplicas   int32
+	MetricsRetentionDays int
+	ColdStartThreshold   time.Duration
+	ActivationTimeout    time.Duration
+	// ConcurrencyQueueTimeout is how long an invocation waits for a
+	// function's concurrency limit before it is rejected.
+	ConcurrencyQueueTimeout time.Duration
+	// AsyncWorkers and AsyncQueueSize size the asynchronous invocation
+	// queue. They are read once at startup.
+	AsyncWorkers   int
+	AsyncQueueSize int
+	// AsyncResultTTL is how long finished asynchronous invocations can
+	// be looked up.
+	AsyncResultTTL time.Duration
+	// CPU, Memory and EphemeralStorage bound the resources of function
+	// containers.
+	CPU              ResourceBounds
+	Memory           ResourceBounds
+	EphemeralStorage ResourceBounds
+}
+
+// ResourceBounds are the defaults and the allowed range of one resource of
+// function containers, as Kubernetes quantities. Empty values are unset.
+type ResourceBounds struct {
+	DefaultRequest string
+	DefaultLimit   string
+	Min            string
+	Max            string
+}
+
+func DefaultPlatformConfig() PlatformConfig {
+	return PlatformConfig{
+		ScaleToZeroTimeout:      300 * time.Second,
+		DefaultMinReplicas:      0,
+		DefaultMaxReplicas:      10,
+		MetricsRetentionDays:    30,
+		ColdStartThreshold:      5000 * time.Millisecond,
+		ActivationTimeout:       30 * time.Second,
+		ConcurrencyQueueTimeout: 10 * time.Second,
+		AsyncWorkers:            10,
+		AsyncQueueSize:          100,
+		AsyncResultTTL:          3600 * time.Second,
+		CPU: ResourceBounds{
+			DefaultRequest: "100m",
+			DefaultLimit:   "500m",
+			Min:            "10m",
+			Max:            "4",
+		},
+		Memory: ResourceBounds{
+			DefaultRequest: "128Mi",
+			DefaultLimit:   "512Mi",
+			Min:            "32Mi",
+			Max:            "8Gi",
+		},
+		EphemeralStorage: ResourceBounds{
+			Max: "10Gi",
+		},
+	}
+}
+
+// ParsePlatformConfig builds a PlatformConfig from ConfigMap data. Missing
+// keys keep their defaults; malformed values are an error.
+func ParsePlatformConfig(data map[string]string) (PlatformConfig, error) {
+	cfg := DefaultPlatformConfig()
+
+	seconds := func(key string, dst *time.Duration) error {
+		return parseDuration(data, key, time.Second, dst)
+	}
+	millis := func(key string, dst *time.Duration) error {
+		return parseDuration(data, key, time.Millisecond, dst)
+	}
+
+	if err := seconds("scaleToZeroTimeout", &cfg.ScaleToZeroTimeout); err != nil {
+		return cfg, err
+	}
+	if err := millis("coldStartThreshold", &cfg.ColdStartThreshold); err != nil {
+		return cfg, err
+	}
+	if err := seconds("activationTimeout", &cfg.ActivationTimeout); err != nil {
+		return cfg, err
+	}
+	if err := seconds("concurrencyQueueTimeout", &cfg.ConcurrencyQueueTimeout); err != nil {
+		return cfg, err
+	}
+	if err := seconds("asyncResultTTL", &cfg.AsyncResultTTL); err != nil {
+		return cfg, err
+	}
+	if err := parseInt(data, "asyncWorkers", &cfg.AsyncWorkers); err != nil {
+		return cfg, err
+	}
+	if err := parseInt(data, "asyncQueueSize", &cfg.AsyncQueueSize); err != nil {
+		return cfg, err
+	}
+	if err := parseInt32(data, "defaultMinReplicas", &cfg.DefaultMinReplicas); err != nil {
+		return cfg, err
+	}
+	if err := parseInt32(data, "defaultMaxReplicas", &cfg.DefaultMaxReplicas); err != nil {
+		return cfg, err
+	}
+	if err := parseInt(data, "metricsRetentionDays", &cfg.MetricsRetentionDays); err != nil {
+		return cfg, err
+	}
+
+	if err := parseResourceBounds(data, "CPU", &cfg.CPU); err != nil {
+		return cfg, err
+	}
+	if err := parseResourceBounds(data, "Memory", &cfg.Memory); err != nil {
+		return cfg, err
+	}
+	if err := parseResourceBounds(data, "EphemeralStorage", &cfg.EphemeralStorage); err != nil {
+		return cfg, err
+	}
+
+	if cfg.DefaultMaxReplicas < 1 || cfg.DefaultMinReplicas > cfg.DefaultMaxReplicas {
+		return cfg, fmt.Errorf("invalid default replica range %d-%d", cfg.DefaultMinReplicas, cfg.DefaultMaxReplicas)
+	}
+	if cfg.AsyncWorkers < 1 {
+		return cfg, fmt.Errorf("invalid asyncWorkers %d", cfg.AsyncWorkers)
+	}
+
+	return cfg, nil
+}
+
+func parseDuration(data map[string]string, key string, unit time.Duration, dst *time.Duration) error {
+	v, ok := data[key]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid %s %q", key, v)
+	}
+	*dst = time.Duration(n) * unit
+	return nil
+}
+
+func parseInt(data map[string]string, key string, dst *int) error {
+	v, ok := data[key]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid %s %q", key, v)
+	}
+	*dst = n
+	return nil
+}
+
+func parseInt32(data map[string]string, key string, dst *int32) error {
+	v, ok := data[key]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid %s %q", key, v)
+	}
+	*dst = int32(n)
+	return nil
+}
+
+// parseResourceBounds reads the default<Name>Request, default<Name>Limit,
+// min<Name> and max<Name> keys. An empty value unsets a bound.
+func parseResourceBounds(data map[string]string, name string, dst *ResourceBounds) error {
+	keys := []struct {
+		key string
+		dst *string
+	}{
+		{"default" + name + "Request", &dst.DefaultRequest},
+		{"default" + name + "Limit", &dst.DefaultLimit},
+		{"min" + name, &dst.Min},
+		{"max" + name, &dst.Max},
+	}
+	for _, k := range keys {
+		v, ok := data[k.key]
+		if !ok {
+			continue
+		}
+		if v != "" {
+			q, err := resource.ParseQuantity(v)
+			if err != nil || q.Sign() <= 0 {
+				return fmt.Errorf("invalid %s %q", k.key, v)
+			}
+		}
+		*k.dst = v
+	}
+
+	if quantityGreater(dst.Min, dst.Max) {
+		return fmt.Errorf("invalid %s range %s-%s", name, dst.Min, dst.Max)
+	}
+	if quantityGreater(dst.DefaultRequest, dst.DefaultLimit) {
+		return fmt.Errorf("default%sRequest %s is greater than default%sLimit %s", name, dst.DefaultRequest, name, dst.DefaultLimit)
+	}
+	for _, v := range []string{dst.DefaultRequest, dst.DefaultLimit} {
+		if quantityGreater(dst.Min, v) || quantityGreater(v, dst.Max) {
+			return fmt.Errorf("default %s %s is outside the range %s-%s", name, v, dst.Min, dst.Max)
+		}
+	}
+	return nil
+}
+
+// ConfigStore holds the current PlatformConfig and is safe for concurrent
+// use. A nil store returns the defaults.
+type ConfigStore struct {
+	mu  sync.RWMutex
+	cfg PlatformConfig
+}
+
+func NewConfigStore() *ConfigStore {
+	return &ConfigStore{cfg: DefaultPlatformConfig()}
+}
+
+func (s *ConfigStore) Get() PlatformConfig {
+	if s == nil {
+		return DefaultPlatformConfig()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+func (s *ConfigStore) Set(cfg PlatformConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+func (s *ConfigStore) update(cm *corev1.ConfigMap) {
+	cfg, err := ParsePlatformConfig(cm.Data)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %v", platformConfigName, err)
+		return
+	}
+	s.Set(cfg)
+	log.Printf("Loaded platform config: %+v", cfg)
+}
+
+// WatchPlatformConfig keeps the store in sync with the
+// kube-serverless-config ConfigMap until ctx is cancelled.
+func (k *KubernetesClient) WatchPlatformConfig(ctx context.Context, store *ConfigStore) {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.clientset, 10*time.Minute,
+		informers.WithNamespace(k.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", platformConfigName).String()
+		}),
+	)
+
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			store.update(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			store.update(obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(interface{}) {
+			log.Printf("%s deleted, reverting to defaults", platformConfigName)
+			store.Set(DefaultPlatformConfig())
+		},
+	})
+
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	controllerResync   = 10 * time.Minute
+	controllerLeaseKey = "kube-serverless-controller"
+)
+
+// Controller reconciles serverless.kube.io Function resources into the
+// ConfigMap, Deployment, Service and HPA that run them, and reports their
+// state back in the Function status. Owned objects carry a controller
+// reference, so changes to them requeue the Function (drift) and deleting
+// the Function garbage collects them. While it leads, the trigger manager
+// runs the leader-only event sources and the autoscaler scales functions.
+type Controller struct {
+	k8sClient  *KubernetesClient
+	triggers   *TriggerManager
+	autoscaler *Autoscaler
+	queue      workqueue.RateLimitingInterface
+
+	dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+	kubeFactory    informers.SharedInformerFactory
+
+	functions   cache.SharedIndexInformer
+	deployments appslisters.DeploymentLister
+	synced      []cache.InformerSynced
+}
+
+func NewController(k8sClient *KubernetesClient, triggers *TriggerManager, autoscaler *Autoscaler) *Controller {
+	c := &Controller{
+		k8sClient:  k8sClient,
+		triggers:   triggers,
+		autoscaler: autoscaler,
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		dynamicFactory: dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+			k8sClient.dynamic, controllerResync, k8sClient.namespace, nil),
+		kubeFactory: informers.NewSharedInformerFactoryWithOptions(
+			k8sClient.clientset, controllerResync,
+			informers.WithNamespace(k8sClient.namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = "app.kubernetes.io/managed-by=kube-serverless"
+			}),
+		),
+	}
+
+	c.functions = c.dynamicFactory.ForResource(functionGVR).Informer()
+	c.functions.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+		DeleteFunc: c.enqueue,
+	})
+
+	owned := cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handleOwnedObject,
+		UpdateFunc: func(_, obj interface{}) { c.handleOwnedObject(obj) },
+		DeleteFunc: c.handleOwnedObject,
+	}
+
+	deployments := c.kubeFactory.Apps().V1().Deployments()
+	deployments.Informer().AddEventHandler(owned)
+	c.deployments = deployments.Lister()
+
+	services := c.kubeFactory.Core().V1().Services().Informer()
+	services.AddEventHandler(owned)
+	configMaps := c.kubeFactory.Core().V1().ConfigMaps().Informer()
+	configMaps.AddEventHandler(owned)
+	hpas := c.kubeFactory.Autoscaling().V2().HorizontalPodAutoscalers().Informer()
+	hpas.AddEventHandler(owned)
+
+	c.synced = []cache.InformerSynced{
+		c.functions.HasSynced,
+		deployments.Informer().HasSynced,
+		services.HasSynced,
+		configMaps.HasSynced,
+		hpas.HasSynced,
+	}
+
+	return c
+}
+
+// RunControllerWithLeaderElection runs a controller while this replica
+// holds the controller lease, so that only one API server replica
+// reconciles at a time. A replica that loses the lease campaigns again
+// until ctx is cancelled. Informers and workqueues cannot be restarted once
+// stopped, so every term runs a fresh Controller from newController.
+func RunControllerWithLeaderElection(ctx context.Context, k8sClient *KubernetesClient, newController func() *Controller, workers int) error {
+	identity, err := replicaIdentity()
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      controllerLeaseKey,
+			Namespace: k8sClient.namespace,
+		},
+		Client:     k8sClient.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	// term is held while a controller runs, so a new term waits for the
+	// previous one to shut down.
+	var term sync.Mutex
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					term.Lock()
+					defer term.Unlock()
+
+					log.Printf("Controller: %s acquired leadership", identity)
+					newController().Run(ctx, workers)
+				},
+				OnStoppedLeading: func() {
+					log.Printf("Controller: %s lost leadership", identity)
+				},
+			},
+		})
+	}
+
+	return nil
+}
+
+// replicaIdentity names this API server replica: its pod name when running
+// in the cluster, its hostname otherwise.
+func replicaIdentity() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// Run starts the informers, workers and autoscaler and blocks until ctx is
+// cancelled.
+func (c *Controller) Run(ctx context.Context, workers int) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	c.triggers.StartLeading(ctx)
+	defer c.triggers.StopLeading()
+
+	c.dynamicFactory.Start(ctx.Done())
+	c.kubeFactory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		log.Printf("Controller: failed to sync informer caches")
+		return
+	}
+
+	log.Printf("Controller: starting %d workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+	c.autoscaler.Run(ctx, c.deployments)
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	if err := c.reconcile(ctx, key); err != nil {
+		log.Printf("Controller: failed to reconcile %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// handleOwnedObject requeues the Function that controls obj, if any.
+func (c *Controller) handleOwnedObject(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+
+	// Records written while serving the function are not drift.
+	if labels := object.GetLabels(); labels[deadLetterLabel] != "" || labels[triggerLabel] != "" {
+		return
+	}
+
+	owner := metav1.GetControllerOf(object)
+	if owner == nil || owner.Kind != functionGVK.Kind || owner.APIVersion != functionGVK.GroupVersion().String() {
+		return
+	}
+
+	c.queue.Add(object.GetNamespace() + "/" + owner.Name)
+}
+
+func (c *Controller) reconcile(ctx context.Context, key string) error {
+	obj, exists, err := c.functions.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// Owned objects are garbage collected through their owner references.
+		return nil
+	}
+
+	res, err := functionResourceFromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		return err
+	}
+	if res.DeletionTimestamp != nil {
+		return nil
+	}
+
+	fn := res.Function()
+	c.k8sClient.applyDefaults(fn)
+
+	// Resources created with kubectl bypass the API's checks. Report them
+	// as failed without retrying; an update requeues them. Other errors,
+	// such as failing to read a referenced Secret, are retried.
+	status := res.Status
+	if err := c.k8sClient.checkFunction(ctx, fn); err != nil {
+		if !rejected(err) {
+			return err
+		}
+		status.State = FunctionStateFailed
+		status.Message = err.Error()
+		status.ObservedGeneration = res.Generation
+		if !reflect.DeepEqual(status, res.Status) {
+			return c.k8sClient.UpdateFunctionStatus(ctx, res, status)
+		}
+		return nil
+	}
+
+	revision, applyErr := c.k8sClient.ensureRevision(ctx, fn, res.Generation, res.ownerReference())
+	if applyErr == nil {
+		applyErr = c.k8sClient.ApplyFunction(ctx, fn, res.ownerReference())
+	}
+	if applyErr != nil {
+		status.State = FunctionStateFailed
+		status.Message = applyErr.Error()
+	} else {
+		if status.ObservedGeneration != res.Generation {
+			status.ObservedGeneration = res.Generation
+			now := metav1.NewTime(time.Now().Truncate(time.Second))
+			status.LastDeployment = &now
+		}
+		deployment, err := c.deployments.Deployments(res.Namespace).Get(res.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		status.State, status.Replicas = deploymentState(deployment)
+		status.Message = ""
+		status.Revision = revision
+		status.Endpoint = fmt.Sprintf("%s.%s.svc.cluster.local", res.Name, res.Namespace)
+	}
+
+	if !reflect.DeepEqual(status, res.Status) {
+		if err := c.k8sClient.UpdateFunctionStatus(ctx, res, status); err != nil {
+			return err
+		}
+	}
+
+	return applyErr
+}
+
+// rejected reports whether err rejects a function, as opposed to failing
+// to check it.
+func rejected(err error) bool {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return true
+	}
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code < http.StatusInternalServerError
+}
+
+// deploymentState derives a function's state and ready replica count from
+// its Deployment, which may be nil if it has not been observed yet.
+func deploymentState(deployment *appsv1.Deployment) (string, int32) {
+	switch {
+	case deployment == nil:
+		return FunctionStateDeploying, 0
+	case deployment.Status.ReadyReplicas > 0:
+		return FunctionStateRunning, deployment.Status.ReadyReplicas
+	case deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == 0:
+		return FunctionStateIdle, 0
+	default:
+		return FunctionStateDeploying, 0
+	}
+}
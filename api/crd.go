@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// functionGVR identifies the Function custom resource defined in
+// k8s/crd.yaml.
+var functionGVR = schema.GroupVersionResource{
+	Group:    "serverless.kube.io",
+	Version:  "v1",
+	Resource: "functions",
+}
+
+var functionGVK = functionGVR.GroupVersion().WithKind("Function")
+
+// FunctionResource is the serverless.kube.io/v1 Function custom resource.
+type FunctionResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   FunctionSpec   `json:"spec"`
+	Status FunctionStatus `json:"status,omitempty"`
+}
+
+func functionResourceFromUnstructured(u *unstructured.Unstructured) (*FunctionResource, error) {
+	data, err := u.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var res FunctionResource
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *FunctionResource) toUnstructured() (*unstructured.Unstructured, error) {
+	r.TypeMeta = metav1.TypeMeta{
+		APIVersion: functionGVK.GroupVersion().String(),
+		Kind:       functionGVK.Kind,
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Function returns the REST API representation of the resource. A
+// resource the controller has not reconciled yet is reported as deploying.
+func (r *FunctionResource) Function() *Function {
+	fn := &Function{
+		Name:         r.Name,
+		FunctionSpec: r.Spec,
+		Status:       r.Status,
+	}
+	if fn.Status.State == "" {
+		fn.Status.State = FunctionStateDeploying
+	}
+	return fn
+}
+
+// ownerReference returns a controller reference to the resource, used so
+// that the objects built for a Function are garbage collected with it.
+func (r *FunctionResource) ownerReference() *metav1.OwnerReference {
+	return metav1.NewControllerRef(r, functionGVK)
+}
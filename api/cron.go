@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Concurrency policies of cron triggers. They have the meaning they have
+// for Kubernetes CronJobs: Allow starts runs regardless of earlier ones,
+// Forbid skips a run while the previous one is queued or running, and
+// Replace cancels the previous run before starting the next.
+const (
+	ConcurrencyAllow   = "Allow"
+	ConcurrencyForbid  = "Forbid"
+	ConcurrencyReplace = "Replace"
+)
+
+// defaultCronPayload is sent when a cron trigger does not set a payload.
+const defaultCronPayload = `{"trigger":"cron","name":"{{.Trigger}}","schedule":"{{.Schedule}}","scheduledTime":"{{.ScheduledTime}}"}`
+
+func validConcurrencyPolicy(policy string) bool {
+	switch policy {
+	case ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace:
+		return true
+	}
+	return false
+}
+
+// cronTrigger is a validated cron trigger with defaults filled in.
+type cronTrigger struct {
+	name              string
+	schedule          string
+	timezone          string
+	concurrencyPolicy string
+	contentType       string
+	payload           string
+}
+
+// cronTriggers returns the cron triggers of a function.
+func cronTriggers(fn *Function) []cronTrigger {
+	var triggers []cronTrigger
+	for _, trigger := range triggersOfType(fn, "cron") {
+		t := cronTrigger{
+			name:              trigger.name,
+			schedule:          trigger.config["schedule"],
+			timezone:          trigger.config["timezone"],
+			concurrencyPolicy: trigger.config["concurrencyPolicy"],
+			contentType:       trigger.config["contentType"],
+			payload:           trigger.config["payload"],
+		}
+		if t.timezone == "" {
+			t.timezone = "UTC"
+		}
+		if t.concurrencyPolicy == "" {
+			t.concurrencyPolicy = ConcurrencyAllow
+		}
+		if t.contentType == "" {
+			t.contentType = "application/json"
+		}
+		if t.payload == "" {
+			t.payload = defaultCronPayload
+		}
+		triggers = append(triggers, t)
+	}
+	return triggers
+}
+
+// spec returns the schedule in the form understood by the cron scheduler.
+func (t cronTrigger) spec() string {
+	return fmt.Sprintf("CRON_TZ=%s %s", t.timezone, t.schedule)
+}
+
+// request renders the payload of a run scheduled at the given time.
+func (t cronTrigger) request(function string, scheduled time.Time) (*InvocationRequest, error) {
+	tmpl, err := template.New("payload").Parse(t.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	err = tmpl.Execute(&body, struct {
+		Function      string
+		Trigger       string
+		Schedule      string
+		ScheduledTime string
+	}{
+		Function:      function,
+		Trigger:       t.name,
+		Schedule:      t.schedule,
+		ScheduledTime: scheduled.Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render payload: %w", err)
+	}
+
+	return &InvocationRequest{
+		Method: http.MethodPost,
+		Header: http.Header{"Content-Type": []string{t.contentType}},
+		Query:  url.Values{},
+		Body:   body.Bytes(),
+	}, nil
+}
+
+func init() {
+	RegisterEventSource(NewCronScheduler())
+}
+
+// CronScheduler is the event source of cron triggers. It runs them as
+// asynchronous invocations, so that they are retried and dead-lettered like
+// any other. It only runs on the replica holding the controller lease; runs
+// missed while no replica held the lease are not made up.
+type CronScheduler struct {
+	mu       sync.Mutex
+	delivery *Delivery
+	cron     *cron.Cron
+	entries  map[string]*cronEntry
+
+	// historyMu serializes writes to the run history.
+	historyMu sync.Mutex
+}
+
+type cronEntry struct {
+	id       cron.EntryID
+	function *Function
+	trigger  cronTrigger
+	// running is the ID of the invocation of the last run until it
+	// finishes.
+	running string
+}
+
+func NewCronScheduler() *CronScheduler {
+	return &CronScheduler{
+		entries: make(map[string]*cronEntry),
+	}
+}
+
+func (s *CronScheduler) Type() string { return "cron" }
+
+func (s *CronScheduler) LeaderOnly() bool { return true }
+
+func (s *CronScheduler) Validate(errs *ValidationErrors, field string, config map[string]string) {
+	if schedule := config["schedule"]; schedule == "" {
+		errs.add(field+".schedule", "required")
+	} else if _, err := cron.ParseStandard(schedule); err != nil {
+		errs.add(field+".schedule", "invalid cron: %v", err)
+	}
+	if timezone := config["timezone"]; timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			errs.add(field+".timezone", "unknown time zone %q", timezone)
+		}
+	}
+	if policy := config["concurrencyPolicy"]; policy != "" && !validConcurrencyPolicy(policy) {
+		errs.add(field+".concurrencyPolicy", "must be one of %s, %s, %s", ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace)
+	}
+	if payload := config["payload"]; payload != "" {
+		if _, err := template.New("payload").Parse(payload); err != nil {
+			errs.add(field+".payload", "invalid template: %v", err)
+		}
+	}
+}
+
+func cronEntryKey(function, trigger string) string {
+	return function + "/" + trigger
+}
+
+// Start starts scheduling. Triggers are added by Sync.
+func (s *CronScheduler) Start(ctx context.Context, delivery *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delivery = delivery
+	s.cron = cron.New(cron.WithLocation(time.UTC))
+	s.cron.Start()
+	return nil
+}
+
+// Stop stops scheduling and forgets all triggers. Runs already queued are
+// not cancelled.
+func (s *CronScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cron != nil {
+		s.cron.Stop()
+		s.cron = nil
+	}
+	s.entries = make(map[string]*cronEntry)
+}
+
+// Sync schedules the cron triggers of fn, rescheduling those whose config
+// changed and removing those no longer in its spec.
+func (s *CronScheduler) Sync(fn *Function) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cron == nil {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, trigger := range cronTriggers(fn) {
+		key := cronEntryKey(fn.Name, trigger.name)
+		current[key] = true
+
+		entry, ok := s.entries[key]
+		if ok && entry.trigger == trigger {
+			entry.function = fn
+			continue
+		}
+
+		var running string
+		if ok {
+			s.cron.Remove(entry.id)
+			running = entry.running
+		}
+
+		id, err := s.cron.AddFunc(trigger.spec(), func() { s.fire(key) })
+		if err != nil {
+			// Validation rejects such schedules before they get here.
+			log.Printf("Cron: failed to schedule trigger %s of %s: %v", trigger.name, fn.Name, err)
+			delete(s.entries, key)
+			continue
+		}
+		s.entries[key] = &cronEntry{id: id, function: fn, trigger: trigger, running: running}
+	}
+
+	for key, entry := range s.entries {
+		if entry.function.Name == fn.Name && !current[key] {
+			s.cron.Remove(entry.id)
+			delete(s.entries, key)
+		}
+	}
+}
+
+// Remove unschedules all cron triggers of a function.
+func (s *CronScheduler) Remove(function string) {
+	s.Sync(&Function{Name: function})
+}
+
+// fire queues a run of a cron trigger, applying its concurrency policy.
+func (s *CronScheduler) fire(key string) {
+	scheduled := time.Now().UTC().Truncate(time.Minute)
+
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	fn, trigger := entry.function, entry.trigger
+
+	run := TriggerRun{ScheduledAt: scheduled}
+	if running := entry.running; running != "" {
+		switch trigger.concurrencyPolicy {
+		case ConcurrencyForbid:
+			s.mu.Unlock()
+			run.State = TriggerRunSkipped
+			run.Error = fmt.Sprintf("previous run %s has not finished", running)
+			s.record(fn.Name, trigger.name, run)
+			return
+		case ConcurrencyReplace:
+			s.delivery.Cancel(running)
+		}
+	}
+
+	inv, err := trigger.request(fn.Name, scheduled)
+	var record *Invocation
+	if err == nil {
+		// The callback takes s.mu, so it cannot clear entry.running before
+		// it is set below.
+		record, err = s.delivery.Enqueue(fn, SourceCron, inv, func(final Invocation) {
+			s.finish(key, fn.Name, trigger.name, scheduled, final)
+		})
+	}
+	if err != nil {
+		s.mu.Unlock()
+		log.Printf("Cron: failed to run trigger %s of %s: %v", trigger.name, fn.Name, err)
+		run.State = TriggerRunSkipped
+		run.Error = err.Error()
+		s.record(fn.Name, trigger.name, run)
+		return
+	}
+	entry.running = record.ID
+	s.mu.Unlock()
+
+	run.InvocationID = record.ID
+	run.State = record.State
+	s.record(fn.Name, trigger.name, run)
+}
+
+// finish records the outcome of a run.
+func (s *CronScheduler) finish(key, function, trigger string, scheduled time.Time, inv Invocation) {
+	s.mu.Lock()
+	if entry, ok := s.entries[key]; ok && entry.running == inv.ID {
+		entry.running = ""
+	}
+	s.mu.Unlock()
+
+	s.record(function, trigger, TriggerRun{
+		InvocationID: inv.ID,
+		ScheduledAt:  scheduled,
+		State:        inv.State,
+		Attempts:     inv.Attempts,
+		StatusCode:   inv.StatusCode,
+		Error:        inv.Error,
+		DeadLetter:   inv.DeadLetter,
+		CompletedAt:  inv.CompletedAt,
+	})
+}
+
+func (s *CronScheduler) record(function, trigger string, run TriggerRun) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	s.mu.Lock()
+	delivery := s.delivery
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := delivery.k8sClient.RecordTriggerRun(ctx, function, trigger, run); err != nil {
+		log.Printf("Cron: failed to record run of trigger %s of %s: %v", trigger, function, err)
+	}
+}
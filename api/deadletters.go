@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	deadLetterLabel = "serverless.kube.io/dead-letter"
+	// maxDeadLetterBody keeps a dead letter's ConfigMap under the 1MiB
+	// object size limit. Larger bodies are truncated and cannot be
+	// re-driven.
+	maxDeadLetterBody = 900 * 1024
+	// deadLetterHistorySize is the number of dead letters kept per
+	// function. Storing another deletes the oldest.
+	deadLetterHistorySize = 100
+)
+
+// credentialHeaders are dropped from the requests kept with dead letters,
+// which anyone who can read the function's ConfigMaps can see.
+var credentialHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+}
+
+// DeadLetter is an asynchronous or trigger-driven invocation that still
+// failed after its last retry. Dead letters are stored as ConfigMaps owned
+// by the Function, so they survive API server restarts and are deleted with
+// the function.
+type DeadLetter struct {
+	ID           string             `json:"id"`
+	Function     string             `json:"function"`
+	Source       string             `json:"source"`
+	InvocationID string             `json:"invocationId,omitempty"`
+	Attempts     int32              `json:"attempts"`
+	StatusCode   int                `json:"statusCode,omitempty"`
+	Error        string             `json:"error,omitempty"`
+	FailedAt     time.Time          `json:"failedAt"`
+	Request      *DeadLetterRequest `json:"request,omitempty"`
+}
+
+// DeadLetterRequest is the invocation request kept with a dead letter so it
+// can be re-driven.
+type DeadLetterRequest struct {
+	Method    string      `json:"method"`
+	Header    http.Header `json:"header,omitempty"`
+	Query     url.Values  `json:"query,omitempty"`
+	Body      string      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+func deadLetterConfigMapName(function, id string) string {
+	return fmt.Sprintf("%s-dl-%s", function, id)
+}
+
+// newDeadLetter records the last failed attempt of an invocation.
+func newDeadLetter(function, source string, attempts int32, resp *InvocationResponse, err error) *DeadLetter {
+	dl := &DeadLetter{
+		Function: function,
+		Source:   source,
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	} else {
+		dl.StatusCode = resp.StatusCode
+		dl.Error = truncate(string(resp.Body), 1024)
+	}
+	return dl
+}
+
+// CreateDeadLetter stores a failed invocation. The request body is kept in
+// the ConfigMap's binary data, the rest of the record as JSON. Credential
+// headers are not stored, so re-driven requests arrive without them. Only
+// the newest deadLetterHistorySize dead letters of a function are kept.
+func (k *KubernetesClient) CreateDeadLetter(ctx context.Context, dl *DeadLetter, inv *InvocationRequest) error {
+	res, err := k.getFunctionResource(ctx, dl.Function)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	dl.ID = hex.EncodeToString(b)
+
+	body := inv.Body
+	header := inv.Header.Clone()
+	for _, h := range credentialHeaders {
+		header.Del(h)
+	}
+	dl.Request = &DeadLetterRequest{Method: inv.Method, Header: header, Query: inv.Query}
+	if len(body) > maxDeadLetterBody {
+		body = body[:maxDeadLetterBody]
+		dl.Request.Truncated = true
+	}
+
+	record, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deadLetterConfigMapName(dl.Function, dl.ID),
+			Namespace: k.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       dl.Function,
+				"app.kubernetes.io/managed-by": "kube-serverless",
+				functionLabel:                  dl.Function,
+				deadLetterLabel:                "true",
+			},
+		},
+		Data:       map[string]string{"record": string(record)},
+		BinaryData: map[string][]byte{"body": body},
+	}
+	setOwner(&cm.ObjectMeta, res.ownerReference())
+
+	if _, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	k.pruneDeadLetters(ctx, dl.Function)
+	return nil
+}
+
+// pruneDeadLetters deletes the oldest dead letters of a function beyond
+// deadLetterHistorySize. Failures are only logged; the next dead letter
+// retries them.
+func (k *KubernetesClient) pruneDeadLetters(ctx context.Context, name string) {
+	deadLetters, err := k.deadLetters(ctx, name)
+	if err != nil {
+		log.Printf("Failed to prune dead letters of function %s: %v", name, err)
+		return
+	}
+
+	excess := len(deadLetters) - deadLetterHistorySize
+	for i := 0; i < excess; i++ {
+		err := k.clientset.CoreV1().ConfigMaps(k.namespace).Delete(ctx, deadLetterConfigMapName(name, deadLetters[i].ID), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Failed to prune dead letter %s of function %s: %v", deadLetters[i].ID, name, err)
+		}
+	}
+}
+
+func deadLetterFromConfigMap(cm *corev1.ConfigMap, withBody bool) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := json.Unmarshal([]byte(cm.Data["record"]), &dl); err != nil {
+		return nil, fmt.Errorf("configmap %s has an invalid dead letter record: %w", cm.Name, err)
+	}
+	if dl.Request != nil {
+		if withBody {
+			dl.Request.Body = string(cm.BinaryData["body"])
+		} else {
+			dl.Request = nil
+		}
+	}
+	return &dl, nil
+}
+
+// ListDeadLetters returns a function's dead letters, oldest first, without
+// their requests.
+func (k *KubernetesClient) ListDeadLetters(ctx context.Context, name string) ([]DeadLetter, error) {
+	if _, err := k.getFunctionResource(ctx, name); err != nil {
+		return nil, err
+	}
+	return k.deadLetters(ctx, name)
+}
+
+// deadLetters returns a function's dead letters, oldest first, without
+// their requests.
+func (k *KubernetesClient) deadLetters(ctx context.Context, name string) ([]DeadLetter, error) {
+	list, err := k.clientset.CoreV1().ConfigMaps(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			"app.kubernetes.io/managed-by": "kube-serverless",
+			functionLabel:                  name,
+			deadLetterLabel:                "true",
+		}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]DeadLetter, 0, len(list.Items))
+	for i := range list.Items {
+		dl, err := deadLetterFromConfigMap(&list.Items[i], false)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, *dl)
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].FailedAt.Before(deadLetters[j].FailedAt)
+	})
+	return deadLetters, nil
+}
+
+// GetDeadLetter returns a dead letter with its request.
+func (k *KubernetesClient) GetDeadLetter(ctx context.Context, name, id string) (*DeadLetter, error) {
+	cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, deadLetterConfigMapName(name, id), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && (cm.Labels[deadLetterLabel] != "true" || cm.Labels[functionLabel] != name)) {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no dead letter %s", name, id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deadLetterFromConfigMap(cm, true)
+}
+
+// DeleteDeadLetter discards a dead letter.
+func (k *KubernetesClient) DeleteDeadLetter(ctx context.Context, name, id string) error {
+	if _, err := k.GetDeadLetter(ctx, name, id); err != nil {
+		return err
+	}
+	err := k.clientset.CoreV1().ConfigMaps(k.namespace).Delete(ctx, deadLetterConfigMapName(name, id), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// invocationRequest rebuilds the request of a dead letter for re-driving.
+func (dl *DeadLetter) invocationRequest() (*InvocationRequest, error) {
+	if dl.Request == nil {
+		return nil, fmt.Errorf("dead letter %s has no request", dl.ID)
+	}
+	if dl.Request.Truncated {
+		return nil, NewAPIError(http.StatusConflict, fmt.Sprintf("dead letter %s has a truncated body and cannot be re-driven", dl.ID))
+	}
+
+	header := dl.Request.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	query := dl.Request.Query
+	if query == nil {
+		query = url.Values{}
+	}
+	return &InvocationRequest{
+		Method: dl.Request.Method,
+		Header: header,
+		Query:  query,
+		Body:   []byte(dl.Request.Body),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCreateDeadLetterDropsCredentials(t *testing.T) {
+	k, _, _ := newFakeClient()
+	ctx := context.Background()
+	if _, _, err := k.createOrAdoptFunctionResource(ctx, testFunction()); err != nil {
+		t.Fatal(err)
+	}
+
+	inv := &InvocationRequest{
+		Method: http.MethodPost,
+		Header: http.Header{
+			"Authorization": {"Bearer eyJhbGciOi"},
+			"Cookie":        {"session=1"},
+			"Content-Type":  {"application/json"},
+		},
+		Query: url.Values{},
+		Body:  []byte(`{"order":1}`),
+	}
+	dl := newDeadLetter("hello", SourceAsync, 3, nil, errInjected)
+	if err := k.CreateDeadLetter(ctx, dl, inv); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := k.GetDeadLetter(ctx, "hello", dl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := got.Request.Header; h.Get("Authorization") != "" || h.Get("Cookie") != "" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("stored header = %v, want only Content-Type", h)
+	}
+	if inv.Header.Get("Authorization") == "" {
+		t.Error("the invocation's own header was modified")
+	}
+}
+
+func TestCreateDeadLetterPrunesOldest(t *testing.T) {
+	k, _, _ := newFakeClient()
+	ctx := context.Background()
+	if _, _, err := k.createOrAdoptFunctionResource(ctx, testFunction()); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC()
+	var first string
+	for i := 0; i < deadLetterHistorySize+1; i++ {
+		dl := newDeadLetter("hello", SourceAsync, 3, nil, errInjected)
+		dl.FailedAt = start.Add(time.Duration(i) * time.Second)
+		inv := &InvocationRequest{Method: http.MethodPost, Header: http.Header{}, Query: url.Values{}}
+		if err := k.CreateDeadLetter(ctx, dl, inv); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = dl.ID
+		}
+	}
+
+	letters, err := k.ListDeadLetters(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != deadLetterHistorySize {
+		t.Fatalf("%d dead letters kept, want %d", len(letters), deadLetterHistorySize)
+	}
+	for _, dl := range letters {
+		if dl.ID == first {
+			t.Errorf("oldest dead letter %s was kept", first)
+		}
+	}
+}
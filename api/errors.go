@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// errFunctionUnreachable is returned when a function's runtime could not be
+// reached or did not answer.
+var errFunctionUnreachable = errors.New("function unreachable")
+
+// APIError is the JSON error envelope returned by every handler.
+type APIError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// RetryAfter, if set, is sent as the Retry-After header.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// FieldDetail describes a problem with a single field of a request.
+type FieldDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func NewAPIError(code int, message string) *APIError {
+	return &APIError{Code: code, Message: message}
+}
+
+func badRequest(err error) *APIError {
+	return NewAPIError(http.StatusBadRequest, err.Error())
+}
+
+// toAPIError translates an error into the status code and envelope the API
+// reports for it.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var validationErrs ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return &APIError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "function spec is invalid",
+			Details: []FieldDetail(validationErrs),
+		}
+	}
+
+	code := http.StatusInternalServerError
+	switch {
+	case apierrors.IsNotFound(err):
+		code = http.StatusNotFound
+	case apierrors.IsAlreadyExists(err), apierrors.IsConflict(err):
+		code = http.StatusConflict
+	case apierrors.IsInvalid(err):
+		code = http.StatusUnprocessableEntity
+	case apierrors.IsForbidden(err):
+		code = http.StatusForbidden
+	case errors.Is(err, errActivationTimeout), errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+	case errors.Is(err, errFunctionUnreachable):
+		code = http.StatusBadGateway
+	case errors.Is(err, errAsyncQueueFull):
+		code = http.StatusServiceUnavailable
+	}
+
+	apiErr = NewAPIError(code, err.Error())
+
+	var statusErr apierrors.APIStatus
+	if errors.As(err, &statusErr) {
+		if details := statusErr.Status().Details; details != nil && len(details.Causes) > 0 {
+			fields := make([]FieldDetail, 0, len(details.Causes))
+			for _, cause := range details.Causes {
+				fields = append(fields, FieldDetail{Field: cause.Field, Message: cause.Message})
+			}
+			apiErr.Details = fields
+		}
+	}
+
+	return apiErr
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+	}
+	writeJSON(w, apiErr.Code, apiErr)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
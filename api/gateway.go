@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Headers the gateway sets on requests it forwards, read by the runtimes to
+// fill in the event's path and params.
+const (
+	functionPathHeader   = "X-Function-Path"
+	functionParamsHeader = "X-Function-Params"
+)
+
+// routeParamPattern matches the names of path params of http triggers.
+var routeParamPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// httpMethods are the methods an http trigger can list.
+var httpMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// httpRoute maps requests matching an http trigger to its function. The
+// path is a prefix of whole segments; segments of the form {name} match any
+// single segment and are passed to the function as params.
+type httpRoute struct {
+	function string
+	trigger  string
+	host     string
+	segments []string
+	// methods is empty if the route accepts every method.
+	methods []string
+}
+
+// httpRoutes returns the routes of a function's http triggers.
+func httpRoutes(fn *Function) []httpRoute {
+	var routes []httpRoute
+	for i, trigger := range fn.Triggers {
+		if trigger.Type != "http" {
+			continue
+		}
+		routes = append(routes, httpRoute{
+			function: fn.Name,
+			trigger:  triggerName(i, trigger),
+			host:     strings.ToLower(trigger.Config["host"]),
+			segments: pathSegments(trigger.Config["path"]),
+			methods:  parseMethods(trigger.Config["methods"]),
+		})
+	}
+	return routes
+}
+
+func pathSegments(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// parseMethods splits a comma-separated method list.
+func parseMethods(list string) []string {
+	var methods []string
+	for _, method := range strings.Split(list, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+func isPathParam(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// pattern returns the route's path with params unnamed, so that routes
+// matching the same requests compare equal.
+func (r httpRoute) pattern() string {
+	segments := make([]string, len(r.segments))
+	for i, segment := range r.segments {
+		if isPathParam(segment) {
+			segment = "{}"
+		}
+		segments[i] = segment
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func (r httpRoute) allows(method string) bool {
+	if len(r.methods) == 0 {
+		return true
+	}
+	for _, m := range r.methods {
+		if m == method || (m == http.MethodGet && method == http.MethodHead) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether two routes would serve the same requests.
+func (r httpRoute) overlaps(other httpRoute) bool {
+	if r.host != other.host || r.pattern() != other.pattern() {
+		return false
+	}
+	if len(r.methods) == 0 || len(other.methods) == 0 {
+		return true
+	}
+	for _, m := range r.methods {
+		if other.allows(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches a request's host and cleaned path, returning its path
+// params and the remainder of the path after the route's prefix.
+func (r httpRoute) match(host string, segments []string) (map[string]string, string, bool) {
+	if r.host != "" && r.host != host {
+		return nil, "", false
+	}
+	if len(segments) < len(r.segments) {
+		return nil, "", false
+	}
+
+	params := make(map[string]string)
+	for i, segment := range r.segments {
+		if isPathParam(segment) {
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, "", false
+		}
+	}
+	return params, "/" + strings.Join(segments[len(r.segments):], "/"), true
+}
+
+// sortRoutes orders routes so the most specific match wins: routes for a
+// host before those for any host, then longer paths, then paths with more
+// literal segments.
+func sortRoutes(routes []httpRoute) {
+	literals := func(r httpRoute) int {
+		n := 0
+		for _, segment := range r.segments {
+			if !isPathParam(segment) {
+				n++
+			}
+		}
+		return n
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if (a.host != "") != (b.host != "") {
+			return a.host != ""
+		}
+		if len(a.segments) != len(b.segments) {
+			return len(a.segments) > len(b.segments)
+		}
+		if literals(a) != literals(b) {
+			return literals(a) > literals(b)
+		}
+		if a.function != b.function {
+			return a.function < b.function
+		}
+		return a.trigger < b.trigger
+	})
+}
+
+// checkHTTPRoutes rejects http triggers that would serve the same requests
+// as a trigger of another function.
+func (k *KubernetesClient) checkHTTPRoutes(ctx context.Context, fn *Function) error {
+	routes := httpRoutes(fn)
+	if len(routes) == 0 {
+		return nil
+	}
+
+	functions, err := k.ListFunctions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range functions {
+		if other.Name == fn.Name {
+			continue
+		}
+		for _, theirs := range httpRoutes(&other) {
+			for _, ours := range routes {
+				if ours.overlaps(theirs) {
+					return NewAPIError(http.StatusConflict, fmt.Sprintf(
+						"http trigger %s routes %s%s, which is already routed to function %s",
+						ours.trigger, ours.host, ours.pattern(), other.Name))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterEventSource(NewGateway())
+}
+
+// Gateway is the event source of http triggers: it serves functions on the
+// paths of their triggers. Every API server replica runs one, on the
+// gateway port.
+type Gateway struct {
+	mu        sync.RWMutex
+	delivery  *Delivery
+	server    *http.Server
+	routes    []httpRoute
+	byName    map[string][]httpRoute
+	functions map[string]*Function
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{
+		byName:    make(map[string][]httpRoute),
+		functions: make(map[string]*Function),
+	}
+}
+
+func (g *Gateway) Type() string { return "http" }
+
+func (g *Gateway) LeaderOnly() bool { return false }
+
+func (g *Gateway) Validate(errs *ValidationErrors, field string, config map[string]string) {
+	path, pathField := config["path"], field+".path"
+	if path == "" {
+		errs.add(pathField, "required")
+	} else if !strings.HasPrefix(path, "/") {
+		errs.add(pathField, "must start with /")
+	} else {
+		validateRoutePath(errs, pathField, path)
+	}
+	if methods := config["methods"]; methods != "" {
+		for _, method := range parseMethods(methods) {
+			if !containsString(httpMethods, method) {
+				errs.add(field+".methods", "unsupported method %q, must be one of %s", method, strings.Join(httpMethods, ", "))
+			}
+		}
+	}
+	if host := config["host"]; host != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(host) {
+			errs.add(field+".host", "%s", msg)
+		}
+	}
+}
+
+// validateRoutePath checks the path of an http trigger: whole segments,
+// with params written as {name} and named at most once.
+func validateRoutePath(errs *ValidationErrors, field, path string) {
+	params := make(map[string]bool)
+	for _, segment := range pathSegments(path) {
+		switch {
+		case segment == "" || segment == "." || segment == "..":
+			errs.add(field, "must not contain empty, . or .. segments")
+			return
+		case isPathParam(segment):
+			name := segment[1 : len(segment)-1]
+			if !routeParamPattern.MatchString(name) {
+				errs.add(field, "invalid path param %q, must be a letter followed by letters, digits or _", name)
+			} else if params[name] {
+				errs.add(field, "duplicate path param %q", name)
+			}
+			params[name] = true
+		case strings.ContainsAny(segment, "{}"):
+			errs.add(field, "path params must be whole segments, found %q", segment)
+		}
+	}
+}
+
+// Start listens on the gateway port, unless it is disabled.
+func (g *Gateway) Start(ctx context.Context, delivery *Delivery) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.delivery = delivery
+	port := delivery.server.gatewayPort
+	if port == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	server := newHTTPServer("", g)
+	g.server = server
+	go func() {
+		log.Printf("Starting function gateway on port %s", port)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Function gateway stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the listener and forgets all routes.
+func (g *Gateway) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.server != nil {
+		g.server.Close()
+		g.server = nil
+	}
+	g.routes = nil
+	g.byName = make(map[string][]httpRoute)
+	g.functions = make(map[string]*Function)
+}
+
+// Sync replaces the routes of fn.
+func (g *Gateway) Sync(fn *Function) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.functions[fn.Name] = fn
+	g.byName[fn.Name] = httpRoutes(fn)
+	g.rebuild()
+}
+
+// Remove drops the routes of a function.
+func (g *Gateway) Remove(function string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.functions, function)
+	delete(g.byName, function)
+	g.rebuild()
+}
+
+func (g *Gateway) rebuild() {
+	var routes []httpRoute
+	for _, r := range g.byName {
+		routes = append(routes, r...)
+	}
+	sortRoutes(routes)
+	g.routes = routes
+}
+
+// route returns the function serving a request and the route it matched.
+// If only the method did not match, it returns the methods allowed.
+func (g *Gateway) route(r *http.Request) (*Function, map[string]string, string, []string) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	segments := pathSegments(path.Clean("/" + r.URL.Path))
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var allowed []string
+	for _, route := range g.routes {
+		params, rest, ok := route.match(host, segments)
+		if !ok {
+			continue
+		}
+		if !route.allows(r.Method) {
+			allowed = append(allowed, route.methods...)
+			continue
+		}
+		return g.functions[route.function], params, rest, nil
+	}
+	return nil, nil, "", allowed
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fn, params, rest, allowed := g.route(r)
+	if fn == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, NewAPIError(http.StatusMethodNotAllowed, r.Method+" not allowed on "+r.URL.Path))
+			return
+		}
+		writeError(w, NewAPIError(http.StatusNotFound, "no function is routed at "+r.URL.Path))
+		return
+	}
+
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	r.Header.Set(functionPathHeader, rest)
+	r.Header.Set(functionParamsHeader, string(encoded))
+
+	g.mu.RLock()
+	delivery := g.delivery
+	g.mu.RUnlock()
+	delivery.Serve(w, r, fn)
+}
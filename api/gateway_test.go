@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startGateway returns a gateway routing the http triggers of functions,
+// which all invoke the workload "hello" served by runtime.
+func startGateway(t *testing.T, runtime http.Handler, functions ...*Function) *Gateway {
+	t.Helper()
+
+	g := NewGateway()
+	if err := g.Start(context.Background(), NewDelivery(newTestServer(t, runtime))); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Stop)
+	for _, fn := range functions {
+		g.Sync(fn)
+	}
+	return g
+}
+
+func httpFunction(name string, configs ...map[string]string) *Function {
+	fn := testFunction()
+	fn.Name = name
+	for _, config := range configs {
+		fn.Triggers = append(fn.Triggers, Trigger{Type: "http", Config: config})
+	}
+	return fn
+}
+
+func TestGatewayRoutesMostSpecificTrigger(t *testing.T) {
+	g := startGateway(t, http.NotFoundHandler(),
+		httpFunction("catalog", map[string]string{"path": "/shop"}),
+		httpFunction("product", map[string]string{"path": "/shop/{id}"}),
+		httpFunction("featured", map[string]string{"path": "/shop/featured"}),
+		httpFunction("admin", map[string]string{"path": "/shop", "host": "admin.example.com"}),
+		httpFunction("orders", map[string]string{"path": "/orders", "methods": "POST"}),
+	)
+
+	tests := []struct {
+		method, host, path string
+		function           string
+		allowed            []string
+	}{
+		{"GET", "shop.example.com", "/shop", "catalog", nil},
+		{"GET", "shop.example.com", "/shop/42", "product", nil},
+		{"GET", "shop.example.com", "/shop/featured", "featured", nil},
+		{"GET", "shop.example.com", "/shop/42/reviews", "product", nil},
+		{"GET", "Admin.Example.com:8081", "/shop/42", "admin", nil},
+		{"POST", "shop.example.com", "/orders", "orders", nil},
+		{"GET", "shop.example.com", "/orders", "", []string{"POST"}},
+		{"GET", "shop.example.com", "/shopping", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.host+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+			fn, _, _, allowed := g.route(r)
+			var function string
+			if fn != nil {
+				function = fn.Name
+			}
+			if function != tt.function {
+				t.Errorf("routed to %q, want %q", function, tt.function)
+			}
+			if len(allowed) != len(tt.allowed) || (len(allowed) > 0 && allowed[0] != tt.allowed[0]) {
+				t.Errorf("allowed = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestGatewayForwardsPathAndParams(t *testing.T) {
+	var got *http.Request
+	g := startGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusAccepted)
+	}), httpFunction("hello", map[string]string{"path": "/users/{id}", "methods": "GET"}))
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/42/orders/7?full=1", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want the runtime's 202", w.Code)
+	}
+	if p := got.Header.Get(functionPathHeader); p != "/orders/7" {
+		t.Errorf("%s = %q, want /orders/7", functionPathHeader, p)
+	}
+	if p := got.Header.Get(functionParamsHeader); p != `{"id":"42"}` {
+		t.Errorf("%s = %q, want {\"id\":\"42\"}", functionParamsHeader, p)
+	}
+	if got.URL.Query().Get("full") != "1" {
+		t.Errorf("query = %q, want full=1", got.URL.RawQuery)
+	}
+
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/users/42", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("DELETE: status %d, Allow %q, want 405 and GET", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts/42", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unrouted path: status %d, want 404", w.Code)
+	}
+}
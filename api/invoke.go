@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultTimeoutSeconds is the timeout of functions that leave
+	// timeoutSeconds unset.
+	defaultTimeoutSeconds = 60
+	maxTimeoutSeconds     = 900
+)
+
+// invocationLimits bound the invocations of a function: how many an API
+// server replica runs at once and holds waiting (a zero maxConcurrency is
+// unlimited), and how long the function has to respond.
+type invocationLimits struct {
+	maxConcurrency int
+	maxQueueDepth  int
+	timeout        time.Duration
+}
+
+func invocationLimitsOf(fn *Function) invocationLimits {
+	return invocationLimits{
+		maxConcurrency: int(fn.MaxConcurrency),
+		maxQueueDepth:  int(fn.MaxQueueDepth),
+		timeout:        time.Duration(effectiveTimeoutSeconds(fn)) * time.Second,
+	}
+}
+
+// effectiveTimeoutSeconds returns the function's timeout with the default
+// filled in.
+func effectiveTimeoutSeconds(fn *Function) int32 {
+	if fn.TimeoutSeconds == 0 {
+		return defaultTimeoutSeconds
+	}
+	return fn.TimeoutSeconds
+}
+
+// Hop-by-hop headers are meaningful only for a single transport-level
+// connection and must not be forwarded by proxies (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// InvocationRequest is the request forwarded to a function's runtime.
+type InvocationRequest struct {
+	Method string
+	Header http.Header
+	Query  url.Values
+	Body   []byte
+}
+
+// InvocationResponse is what the function's runtime sent back.
+type InvocationResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// NewInvocationRequest captures an incoming HTTP request so it can be
+// forwarded to a function.
+func NewInvocationRequest(r *http.Request) (*InvocationRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	header := r.Header.Clone()
+	removeHopHeaders(header)
+
+	return &InvocationRequest{
+		Method: r.Method,
+		Header: header,
+		Query:  r.URL.Query(),
+		Body:   body,
+	}, nil
+}
+
+func (k *KubernetesClient) InvokeFunction(ctx context.Context, name string, inv *InvocationRequest) (*InvocationResponse, error) {
+	// Get service endpoint
+	service, err := k.clientset.CoreV1().Services(k.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	target := k.serviceURL(service)
+	target.RawQuery = inv.Query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, inv.Method, target.String(), bytes.NewReader(inv.Body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range inv.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	removeHopHeaders(req.Header)
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errFunctionUnreachable, name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read response from %s: %v", errFunctionUnreachable, name, err)
+	}
+
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+
+	return &InvocationResponse{
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       body,
+	}, nil
+}
+
+// serviceURL returns the base URL of the runtime behind a function Service.
+func (k *KubernetesClient) serviceURL(service *corev1.Service) *url.URL {
+	host := service.Spec.ClusterIP
+	if host == "" || host == corev1.ClusterIPNone {
+		host = fmt.Sprintf("%s.%s.svc", service.Name, service.Namespace)
+	}
+
+	port := int32(80)
+	for _, p := range service.Spec.Ports {
+		if p.Name == "http" {
+			port = p.Port
+			break
+		}
+	}
+
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+		Path:   "/",
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
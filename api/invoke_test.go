@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "kube-serverless"
+
+// newInvokeTestClient returns a client whose function Service "hello"
+// points at a ready runtime stand-in serving handler.
+func newInvokeTestClient(t *testing.T, handler http.Handler) (*KubernetesClient, *httptest.Server) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "hello", Namespace: testNamespace},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: host,
+				Ports:     []corev1.ServicePort{{Name: "http", Port: int32(portNumber)}},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "hello", Namespace: testNamespace},
+			Subsets:    []corev1.EndpointSubset{{Addresses: []corev1.EndpointAddress{{IP: host}}}},
+		},
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{functionGVR: "FunctionList"})
+	return &KubernetesClient{
+		clientset:  clientset,
+		dynamic:    dynamicClient,
+		namespace:  testNamespace,
+		httpClient: server.Client(),
+		config:     NewConfigStore(),
+	}, server
+}
+
+// newTestServer returns a server that invokes the function "hello" on a
+// runtime stand-in serving handler.
+func newTestServer(t *testing.T, handler http.Handler) *Server {
+	t.Helper()
+
+	k, _ := newInvokeTestClient(t, handler)
+	return &Server{
+		k8sClient: k,
+		config:    k.config,
+		activator: NewActivator(k, k.config),
+		scaler:    NewIdleScaler(k, k.config),
+		limiter:   NewConcurrencyLimiter(k.config),
+	}
+}
+
+// eventually fails the test if cond does not hold within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInvokeFunctionForwardsRequest(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	k, _ := newInvokeTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	inv := &InvocationRequest{
+		Method: http.MethodPut,
+		Header: http.Header{
+			"Content-Type":        {"application/json"},
+			"X-Request-Id":        {"abc"},
+			"Keep-Alive":          {"timeout=5"},
+			"Proxy-Authorization": {"Basic c2VjcmV0"},
+			"Te":                  {"trailers"},
+		},
+		Query: url.Values{"user": {"42"}},
+		Body:  []byte(`{"name":"world"}`),
+	}
+	if _, err := k.InvokeFunction(context.Background(), "hello", inv); err != nil {
+		t.Fatalf("InvokeFunction: %v", err)
+	}
+
+	if got.Method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", got.Method)
+	}
+	if got.URL.Query().Get("user") != "42" {
+		t.Errorf("query = %q, want user=42", got.URL.RawQuery)
+	}
+	if string(gotBody) != `{"name":"world"}` {
+		t.Errorf("body = %q", gotBody)
+	}
+	for _, h := range []string{"Content-Type", "X-Request-Id"} {
+		if got.Header.Get(h) != inv.Header.Get(h) {
+			t.Errorf("header %s = %q, want %q", h, got.Header.Get(h), inv.Header.Get(h))
+		}
+	}
+	for _, h := range []string{"Keep-Alive", "Proxy-Authorization", "Te"} {
+		if v := got.Header.Get(h); v != "" {
+			t.Errorf("hop-by-hop header %s forwarded as %q", h, v)
+		}
+	}
+	if inv.Header.Get("Keep-Alive") == "" {
+		t.Error("InvokeFunction modified the invocation's headers")
+	}
+}
+
+func TestInvokeFunctionPassesResponseThrough(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"ok", http.StatusOK, `{"message":"hello"}`},
+		{"created", http.StatusCreated, ""},
+		{"client error", http.StatusNotFound, "no such user"},
+		{"server error", http.StatusInternalServerError, "boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, _ := newInvokeTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Function", "hello")
+				w.Header().Set("Proxy-Authenticate", "Basic")
+				w.Header().Set("Keep-Alive", "timeout=5")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+
+			resp, err := k.InvokeFunction(context.Background(), "hello", &InvocationRequest{Method: http.MethodGet})
+			if err != nil {
+				t.Fatalf("InvokeFunction: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if string(resp.Body) != tt.body {
+				t.Errorf("body = %q, want %q", resp.Body, tt.body)
+			}
+			if resp.Header.Get("X-Function") != "hello" {
+				t.Errorf("header X-Function = %q, want hello", resp.Header.Get("X-Function"))
+			}
+			for _, h := range []string{"Proxy-Authenticate", "Keep-Alive"} {
+				if v := resp.Header.Get(h); v != "" {
+					t.Errorf("hop-by-hop header %s passed back as %q", h, v)
+				}
+			}
+		})
+	}
+}
+
+func TestInvokeFunctionUnreachable(t *testing.T) {
+	k, runtime := newInvokeTestClient(t, http.NotFoundHandler())
+	runtime.Close()
+
+	_, err := k.InvokeFunction(context.Background(), "hello", &InvocationRequest{Method: http.MethodGet})
+	if !errors.Is(err, errFunctionUnreachable) {
+		t.Fatalf("err = %v, want errFunctionUnreachable", err)
+	}
+	if status := toAPIError(err).Code; status != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", status, http.StatusBadGateway)
+	}
+}
+
+func TestInvokeFunctionMissingService(t *testing.T) {
+	k, _ := newInvokeTestClient(t, http.NotFoundHandler())
+
+	_, err := k.InvokeFunction(context.Background(), "missing", &InvocationRequest{Method: http.MethodGet})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("err = %v, want NotFound", err)
+	}
+}
+
+func TestExecuteTimesOutAfterGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		status   int
+		timedOut bool
+	}{
+		// The runtime enforces the timeout itself and answers within the
+		// grace period; its response is passed through.
+		{"runtime answers", 100 * time.Millisecond, http.StatusGatewayTimeout, false},
+		{"runtime hangs", timeoutGrace + time.Second, http.StatusGatewayTimeout, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.delay):
+					w.WriteHeader(http.StatusGatewayTimeout)
+					io.WriteString(w, "runtime timeout")
+				case <-r.Context().Done():
+				}
+			}))
+			timeouts := functionTimeouts.WithLabelValues("hello", tt.name)
+			before := testutil.ToFloat64(timeouts)
+
+			limits := invocationLimits{timeout: 50 * time.Millisecond}
+			target := invocationTarget{backend: "hello", revision: tt.name}
+			resp, _, err := s.execute(context.Background(), "hello", target, limits, &InvocationRequest{Method: http.MethodPost})
+
+			if tt.timedOut {
+				if status := toAPIError(err).Code; err == nil || status != tt.status {
+					t.Fatalf("err = %v, want status %d", err, tt.status)
+				}
+			} else if err != nil || resp.StatusCode != tt.status || string(resp.Body) != "runtime timeout" {
+				t.Fatalf("resp = %+v, err = %v, want the runtime's %d", resp, err, tt.status)
+			}
+			want := 0.0
+			if tt.timedOut {
+				want = 1
+			}
+			if got := testutil.ToFloat64(timeouts) - before; got != want {
+				t.Errorf("%v timeouts counted, want %v", got, want)
+			}
+		})
+	}
+}
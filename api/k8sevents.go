@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+var k8sEventWatchErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "k8s_event_watch_errors_total",
+		Help: "Failed lists and watches of the informers of k8s-event triggers, by API version and resource",
+	},
+	[]string{"resource"},
+)
+
+func init() {
+	prometheus.MustRegister(k8sEventWatchErrors)
+	RegisterEventSource(NewK8sEventSource())
+}
+
+// Event types of k8s-event triggers.
+const (
+	K8sEventAdded   = "added"
+	K8sEventUpdated = "updated"
+	K8sEventDeleted = "deleted"
+)
+
+var k8sEventTypes = []string{K8sEventAdded, K8sEventUpdated, K8sEventDeleted}
+
+// watchableResources are the resources k8s-event triggers can watch, by API
+// group; k8s/rbac.yaml grants the API server read access to each. Resources
+// that may hold credentials are left out so that triggers cannot hand them
+// to functions: secrets and service accounts, and configmaps, which include
+// the platform's own.
+var watchableResources = map[string][]string{
+	"":                   {"endpoints", "events", "namespaces", "nodes", "persistentvolumeclaims", "persistentvolumes", "pods", "services"},
+	"apps":               {"daemonsets", "deployments", "replicasets", "statefulsets"},
+	"autoscaling":        {"horizontalpodautoscalers"},
+	"batch":              {"cronjobs", "jobs"},
+	"events.k8s.io":      {"events"},
+	"networking.k8s.io":  {"ingresses"},
+	"serverless.kube.io": {"functions"},
+}
+
+// ignoredDiffFields change on every write and are left out of diffs.
+var ignoredDiffFields = map[string]bool{
+	"metadata.resourceVersion": true,
+	"metadata.managedFields":   true,
+}
+
+// k8sEventTrigger is a validated k8s-event trigger with defaults filled in.
+type k8sEventTrigger struct {
+	name     string
+	resource schema.GroupVersionResource
+	// namespace is empty for all namespaces and cluster-scoped resources.
+	namespace     string
+	labelSelector string
+	// eventTypes is a sorted, comma-separated list.
+	eventTypes string
+	filter     string
+}
+
+// k8sEventTriggers returns the k8s-event triggers of a function. Config
+// values are checked by validation.
+func k8sEventTriggers(fn *Function) []k8sEventTrigger {
+	var triggers []k8sEventTrigger
+	for _, trigger := range triggersOfType(fn, "k8s-event") {
+		config := trigger.config
+		apiVersion := config["apiVersion"]
+		if apiVersion == "" {
+			apiVersion = "v1"
+		}
+		gv, _ := schema.ParseGroupVersion(apiVersion)
+
+		eventTypes := parseEventTypes(config["eventTypes"])
+		if len(eventTypes) == 0 {
+			eventTypes = append([]string(nil), k8sEventTypes...)
+		}
+		sort.Strings(eventTypes)
+
+		triggers = append(triggers, k8sEventTrigger{
+			name:          trigger.name,
+			resource:      gv.WithResource(config["resource"]),
+			namespace:     config["namespace"],
+			labelSelector: config["labelSelector"],
+			eventTypes:    strings.Join(eventTypes, ","),
+			filter:        config["filter"],
+		})
+	}
+	return triggers
+}
+
+func parseEventTypes(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (t k8sEventTrigger) wants(eventType string) bool {
+	return containsString(strings.Split(t.eventTypes, ","), eventType)
+}
+
+// informerKey identifies the informer a trigger shares with every other
+// trigger watching the same objects.
+func (t k8sEventTrigger) informerKey() string {
+	return strings.Join([]string{t.resource.String(), t.namespace, t.labelSelector}, "|")
+}
+
+// fieldCondition is one condition of a k8s-event filter. The path is a
+// dot-separated field path; lists along it match if any element does.
+type fieldCondition struct {
+	path   []string
+	value  string
+	negate bool
+}
+
+// parseFieldFilter parses a comma-separated list of path=value and
+// path!=value conditions, all of which must hold.
+func parseFieldFilter(filter string) ([]fieldCondition, error) {
+	var conditions []fieldCondition
+	for _, term := range strings.Split(filter, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var c fieldCondition
+		path, value, ok := strings.Cut(term, "!=")
+		if ok {
+			c.negate = true
+		} else if path, value, ok = strings.Cut(term, "="); !ok {
+			return nil, fmt.Errorf("condition %q must be path=value or path!=value", term)
+		}
+		path = strings.TrimSpace(path)
+		if path == "" {
+			return nil, fmt.Errorf("condition %q has no path", term)
+		}
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return nil, fmt.Errorf("condition %q has an empty path segment", term)
+			}
+			c.path = append(c.path, segment)
+		}
+		c.value = strings.TrimSpace(value)
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// fieldValues returns the scalar values at path in obj, descending into
+// every element of lists along the way.
+func fieldValues(obj interface{}, path []string) []string {
+	switch v := obj.(type) {
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fieldValues(item, path)...)
+		}
+		return values
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return nil
+		}
+		child, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return fieldValues(child, path[1:])
+	case nil:
+		return nil
+	default:
+		if len(path) > 0 {
+			return nil
+		}
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// matchesFilter reports whether obj satisfies every condition.
+func matchesFilter(obj map[string]interface{}, conditions []fieldCondition) bool {
+	for _, c := range conditions {
+		found := containsString(fieldValues(obj, c.path), c.value)
+		if found == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldChange is one changed field of an updated object.
+type fieldChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// diffObjects lists the fields that differ between two objects, descending
+// into maps and into lists whose length did not change.
+func diffObjects(path string, old, new interface{}) []fieldChange {
+	if ignoredDiffFields[path] || reflect.DeepEqual(old, new) {
+		return nil
+	}
+
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	switch o := old.(type) {
+	case map[string]interface{}:
+		n, ok := new.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range o {
+			keys[k] = true
+		}
+		for k := range n {
+			keys[k] = true
+		}
+		var changes []fieldChange
+		for _, k := range sortedSet(keys) {
+			changes = append(changes, diffObjects(join(k), o[k], n[k])...)
+		}
+		return changes
+	case []interface{}:
+		n, ok := new.([]interface{})
+		if !ok || len(n) != len(o) {
+			break
+		}
+		var changes []fieldChange
+		for i := range o {
+			changes = append(changes, diffObjects(fmt.Sprintf("%s[%d]", path, i), o[i], n[i])...)
+		}
+		return changes
+	}
+	return []fieldChange{{Path: path, Old: old, New: new}}
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// k8sEvent is the body of an invocation by a k8s-event trigger. OldObject
+// and Diff are set for updates.
+type k8sEvent struct {
+	Type       string                 `json:"type"`
+	APIVersion string                 `json:"apiVersion"`
+	Resource   string                 `json:"resource"`
+	Namespace  string                 `json:"namespace,omitempty"`
+	Name       string                 `json:"name"`
+	Object     map[string]interface{} `json:"object"`
+	OldObject  map[string]interface{} `json:"oldObject,omitempty"`
+	Diff       []fieldChange          `json:"diff,omitempty"`
+}
+
+// K8sEventSource is the event source of k8s-event triggers, which invoke
+// their function when objects of a resource are added, updated or deleted.
+// Triggers watching the same resource, namespace and label selector share
+// one informer. Each event is an asynchronous invocation, so it is retried
+// and dead-lettered like any other. Objects that exist when an informer
+// starts do not fire added events. It runs on the replica holding the
+// controller lease; events while no replica held the lease are missed.
+type K8sEventSource struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	delivery  *Delivery
+	informers map[string]*k8sEventInformer
+	// subscriptions maps each function/trigger to its informer key.
+	subscriptions map[string]string
+}
+
+// k8sEventInformer is an informer and the triggers it fires.
+type k8sEventInformer struct {
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	subscriptions map[string]*k8sEventSubscription
+}
+
+type k8sEventSubscription struct {
+	function *Function
+	trigger  k8sEventTrigger
+	filter   []fieldCondition
+}
+
+func NewK8sEventSource() *K8sEventSource {
+	return &K8sEventSource{
+		informers:     make(map[string]*k8sEventInformer),
+		subscriptions: make(map[string]string),
+	}
+}
+
+func (s *K8sEventSource) Type() string { return "k8s-event" }
+
+func (s *K8sEventSource) LeaderOnly() bool { return true }
+
+func (s *K8sEventSource) Validate(errs *ValidationErrors, field string, config map[string]string) {
+	apiVersion := config["apiVersion"]
+	if apiVersion == "" {
+		apiVersion = "v1"
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		errs.add(field+".apiVersion", "%v", err)
+	}
+	if resource := config["resource"]; resource == "" {
+		errs.add(field+".resource", "required")
+	} else if msgs := validation.IsDNS1123Subdomain(resource); len(msgs) > 0 {
+		for _, msg := range msgs {
+			errs.add(field+".resource", "must be the lowercase plural name of a resource: %s", msg)
+		}
+	} else if err == nil && !containsString(watchableResources[gv.Group], resource) {
+		errs.add(field+".resource", "%s cannot be watched by k8s-event triggers", gv.WithResource(resource).GroupResource())
+	}
+	if namespace := config["namespace"]; namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			errs.add(field+".namespace", "%s", msg)
+		}
+	}
+	if selector := config["labelSelector"]; selector != "" {
+		if _, err := labels.Parse(selector); err != nil {
+			errs.add(field+".labelSelector", "%v", err)
+		}
+	}
+	for _, t := range parseEventTypes(config["eventTypes"]) {
+		if !containsString(k8sEventTypes, t) {
+			errs.add(field+".eventTypes", "unsupported event type %q, must be one of %s", t, strings.Join(k8sEventTypes, ", "))
+		}
+	}
+	if _, err := parseFieldFilter(config["filter"]); err != nil {
+		errs.add(field+".filter", "%v", err)
+	}
+}
+
+// Start enables watching until Stop is called or ctx is cancelled.
+// Triggers are added by Sync.
+func (s *K8sEventSource) Start(ctx context.Context, delivery *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	s.delivery = delivery
+	return nil
+}
+
+// Stop stops every informer and forgets all triggers.
+func (s *K8sEventSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, informer := range s.informers {
+		informer.cancel()
+	}
+	s.informers = make(map[string]*k8sEventInformer)
+	s.subscriptions = make(map[string]string)
+	s.ctx = nil
+}
+
+// Sync subscribes the k8s-event triggers of fn to their informers, starting
+// informers no other trigger shares and stopping those no longer used.
+func (s *K8sEventSource) Sync(fn *Function) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, trigger := range k8sEventTriggers(fn) {
+		key := fn.Name + "/" + trigger.name
+		current[key] = true
+
+		filter, err := parseFieldFilter(trigger.filter)
+		if err != nil {
+			// Validation rejects such filters before they get here.
+			log.Printf("K8sEvent: skipping trigger %s of %s: %v", trigger.name, fn.Name, err)
+			s.unsubscribe(key)
+			continue
+		}
+		sub := &k8sEventSubscription{function: fn, trigger: trigger, filter: filter}
+
+		if informerKey, ok := s.subscriptions[key]; ok && informerKey != trigger.informerKey() {
+			s.unsubscribe(key)
+		}
+		informer, ok := s.informers[trigger.informerKey()]
+		if !ok {
+			informer = s.startInformer(trigger)
+			s.informers[trigger.informerKey()] = informer
+		}
+		informer.mu.Lock()
+		informer.subscriptions[key] = sub
+		informer.mu.Unlock()
+		s.subscriptions[key] = trigger.informerKey()
+	}
+
+	for key := range s.subscriptions {
+		if strings.HasPrefix(key, fn.Name+"/") && !current[key] {
+			s.unsubscribe(key)
+		}
+	}
+}
+
+// Remove unsubscribes all k8s-event triggers of a function.
+func (s *K8sEventSource) Remove(function string) {
+	s.Sync(&Function{Name: function})
+}
+
+// unsubscribe removes a trigger from its informer, stopping the informer
+// once no trigger uses it.
+func (s *K8sEventSource) unsubscribe(key string) {
+	informerKey, ok := s.subscriptions[key]
+	if !ok {
+		return
+	}
+	delete(s.subscriptions, key)
+
+	informer := s.informers[informerKey]
+	informer.mu.Lock()
+	delete(informer.subscriptions, key)
+	empty := len(informer.subscriptions) == 0
+	informer.mu.Unlock()
+
+	if empty {
+		informer.cancel()
+		delete(s.informers, informerKey)
+	}
+}
+
+func (s *K8sEventSource) startInformer(trigger k8sEventTrigger) *k8sEventInformer {
+	ctx, cancel := context.WithCancel(s.ctx)
+	informer := &k8sEventInformer{
+		cancel:        cancel,
+		subscriptions: make(map[string]*k8sEventSubscription),
+	}
+
+	selector := trigger.labelSelector
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+		s.delivery.k8sClient.dynamic, 0, trigger.namespace,
+		func(options *metav1.ListOptions) { options.LabelSelector = selector })
+	shared := factory.ForResource(trigger.resource).Informer()
+
+	delivery, resource := s.delivery, trigger.resource
+	// The informer keeps retrying failed lists and watches, such as those
+	// the API server is not allowed to make, without reporting them.
+	watched := resource.GroupVersion().String() + "/" + resource.Resource
+	shared.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		k8sEventWatchErrors.WithLabelValues(watched).Inc()
+		log.Printf("K8sEvent: failed to watch %s in namespace %q: %v", watched, trigger.namespace, err)
+	})
+	shared.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if !isInInitialList {
+				informer.dispatch(delivery, resource, K8sEventAdded, nil, obj)
+			}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			informer.dispatch(delivery, resource, K8sEventUpdated, old, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			informer.dispatch(delivery, resource, K8sEventDeleted, nil, obj)
+		},
+	})
+
+	go shared.Run(ctx.Done())
+	return informer
+}
+
+// dispatch queues an invocation for every trigger that wants an event. An
+// update fires a trigger with a filter only when the filter starts
+// matching, and one without only when a field other than the resource
+// version changed.
+func (i *k8sEventInformer) dispatch(delivery *Delivery, resource schema.GroupVersionResource, eventType string, oldObj, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	var old *unstructured.Unstructured
+	if eventType == K8sEventUpdated {
+		if old, ok = oldObj.(*unstructured.Unstructured); !ok {
+			return
+		}
+	}
+
+	i.mu.Lock()
+	subscriptions := make([]*k8sEventSubscription, 0, len(i.subscriptions))
+	for _, sub := range i.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	i.mu.Unlock()
+
+	var diff []fieldChange
+	if old != nil {
+		diff = diffObjects("", old.Object, u.Object)
+		if len(diff) == 0 {
+			return
+		}
+	}
+
+	for _, sub := range subscriptions {
+		if !sub.trigger.wants(eventType) {
+			continue
+		}
+		if len(sub.filter) > 0 {
+			if !matchesFilter(u.Object, sub.filter) {
+				continue
+			}
+			if old != nil && matchesFilter(old.Object, sub.filter) {
+				continue
+			}
+		}
+
+		event := k8sEvent{
+			Type:       eventType,
+			APIVersion: resource.GroupVersion().String(),
+			Resource:   resource.Resource,
+			Namespace:  u.GetNamespace(),
+			Name:       u.GetName(),
+			Object:     u.Object,
+			Diff:       diff,
+		}
+		if old != nil {
+			event.OldObject = old.Object
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("K8sEvent: failed to encode %s event of %s for %s: %v", eventType, u.GetName(), sub.function.Name, err)
+			continue
+		}
+
+		inv := &InvocationRequest{
+			Method: http.MethodPost,
+			Header: http.Header{
+				"Content-Type": []string{"application/json"},
+				"X-Event-Type": []string{eventType},
+				"X-Trigger":    []string{sub.trigger.name},
+			},
+			Query: url.Values{},
+			Body:  body,
+		}
+		if _, err := delivery.Enqueue(sub.function, SourceK8sEvent, inv, nil); err != nil {
+			log.Printf("K8sEvent: failed to queue %s event of %s for trigger %s of %s: %v",
+				eventType, u.GetName(), sub.trigger.name, sub.function.Name, err)
+		}
+	}
+}
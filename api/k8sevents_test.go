@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var podsGVR = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+func TestK8sEventSourceValidateResource(t *testing.T) {
+	tests := []struct {
+		apiVersion string
+		resource   string
+		valid      bool
+	}{
+		{"", "pods", true},
+		{"apps/v1", "replicasets", true},
+		{"batch/v1", "jobs", true},
+		{"", "secrets", false},
+		{"v1", "configmaps", false},
+		{"v1", "serviceaccounts", false},
+		{"apps/v1", "pods", false},
+		{"example.com/v1", "widgets", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.apiVersion+"/"+tt.resource, func(t *testing.T) {
+			var errs ValidationErrors
+			config := map[string]string{"apiVersion": tt.apiVersion, "resource": tt.resource}
+			NewK8sEventSource().Validate(&errs, "triggers[0].config", config)
+			if valid := len(errs) == 0; valid != tt.valid {
+				t.Errorf("valid = %v, want %v (errors: %v)", valid, tt.valid, errs)
+			}
+		})
+	}
+}
+
+func pod(name, nodeName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "shop"},
+		"spec":       map[string]interface{}{"nodeName": nodeName},
+	}}
+}
+
+// newK8sEventClient returns a fake dynamic client holding objects, which
+// can list pods.
+func newK8sEventClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			functionGVR: "FunctionList",
+			podsGVR:     "PodList",
+		}, objects...)
+}
+
+// startK8sEventSource runs a k8s-event source with the triggers of fn on
+// dynamicClient. Queued invocations are left in the async queue, which the
+// test reads.
+func startK8sEventSource(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient, fn *Function) *AsyncInvoker {
+	t.Helper()
+
+	k := &KubernetesClient{dynamic: dynamicClient, namespace: testNamespace, config: NewConfigStore()}
+	async := NewAsyncInvoker(k, nil, k.config, "test")
+
+	s := NewK8sEventSource()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		s.Stop()
+		cancel()
+	})
+	if err := s.Start(ctx, NewDelivery(&Server{k8sClient: k, config: k.config, async: async})); err != nil {
+		t.Fatal(err)
+	}
+	s.Sync(fn)
+	return async
+}
+
+// nextEvent returns the body of the next queued invocation.
+func nextEvent(t *testing.T, async *AsyncInvoker) k8sEvent {
+	t.Helper()
+
+	select {
+	case job := <-async.queue:
+		if job.source != SourceK8sEvent {
+			t.Errorf("source = %q, want %q", job.source, SourceK8sEvent)
+		}
+		var event k8sEvent
+		if err := json.Unmarshal(job.request.Body, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return k8sEvent{}
+}
+
+func TestK8sEventSourceDeliversChanges(t *testing.T) {
+	fn := testFunction()
+	fn.Triggers = []Trigger{{Type: "k8s-event", Config: map[string]string{
+		"resource":  "pods",
+		"namespace": "shop",
+	}}}
+	dynamicClient := newK8sEventClient(pod("checkout", "node-a"))
+	async := startK8sEventSource(t, dynamicClient, fn)
+	pods := dynamicClient.Resource(podsGVR).Namespace("shop")
+	ctx := context.Background()
+
+	// The existing object fires no added event; once the informer watches,
+	// an update fires with the changed field.
+	eventually(t, "the informer to watch pods", func() bool {
+		for _, action := range dynamicClient.Actions() {
+			if action.GetVerb() == "watch" && action.GetResource() == podsGVR {
+				return true
+			}
+		}
+		return false
+	})
+	if _, err := pods.Update(ctx, pod("checkout", "node-b"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	event := nextEvent(t, async)
+	if event.Type != K8sEventUpdated || event.Name != "checkout" || event.Resource != "pods" {
+		t.Errorf("event = %s %s %s, want updated pods checkout", event.Type, event.Resource, event.Name)
+	}
+	if len(event.Diff) != 1 || event.Diff[0].Path != "spec.nodeName" || event.Diff[0].Old != "node-a" || event.Diff[0].New != "node-b" {
+		t.Errorf("diff = %+v, want spec.nodeName from node-a to node-b", event.Diff)
+	}
+
+	if _, err := pods.Create(ctx, pod("cart", ""), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, async); event.Type != K8sEventAdded || event.Name != "cart" {
+		t.Errorf("event = %s %s, want added cart", event.Type, event.Name)
+	}
+
+	if err := pods.Delete(ctx, "cart", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, async); event.Type != K8sEventDeleted || event.Name != "cart" {
+		t.Errorf("event = %s %s, want deleted cart", event.Type, event.Name)
+	}
+}
+
+func TestK8sEventSourceReportsWatchErrors(t *testing.T) {
+	fn := testFunction()
+	fn.Triggers = []Trigger{{Type: "k8s-event", Config: map[string]string{"resource": "pods"}}}
+
+	watchErrors := k8sEventWatchErrors.WithLabelValues("v1/pods")
+	before := testutil.ToFloat64(watchErrors)
+
+	dynamicClient := newK8sEventClient()
+	dynamicClient.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(podsGVR.GroupResource(), "", errors.New("denied by test"))
+	})
+	startK8sEventSource(t, dynamicClient, fn)
+
+	eventually(t, "the failed list to be counted", func() bool { return testutil.ToFloat64(watchErrors) > before })
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	kafkaMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_messages_total",
+			Help: "Messages consumed by kafka triggers, by outcome (committed, failed, dead_lettered)",
+		},
+		[]string{"function", "trigger", "outcome"},
+	)
+
+	kafkaConsumerLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_consumer_lag",
+			Help: "Messages of a partition not yet committed by a kafka trigger's consumer group",
+		},
+		[]string{"function", "trigger", "topic", "partition"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(kafkaMessages)
+	prometheus.MustRegister(kafkaConsumerLag)
+	RegisterEventSource(NewKafkaSource())
+}
+
+// Defaults for kafka trigger config.
+const (
+	defaultKafkaBatchSize   = 1
+	defaultKafkaBatchWindow = time.Second
+	defaultKafkaStartOffset = "latest"
+)
+
+// kafkaReconnectDelay is the wait before a consumer reconnects after an
+// error.
+const kafkaReconnectDelay = 5 * time.Second
+
+// kafkaTrigger is a validated kafka trigger with defaults filled in.
+type kafkaTrigger struct {
+	name    string
+	brokers string
+	topic   string
+	group   string
+	// batchSize is the most messages of one partition sent in a single
+	// invocation; 1 invokes the function per message.
+	batchSize int
+	// batchWindow is how long a batch waits to fill up.
+	batchWindow time.Duration
+	startOffset string
+}
+
+// kafkaTriggers returns the kafka triggers of a function. Config values are
+// checked by validation.
+func kafkaTriggers(fn *Function) []kafkaTrigger {
+	var triggers []kafkaTrigger
+	for _, trigger := range triggersOfType(fn, "kafka") {
+		config := trigger.config
+		t := kafkaTrigger{
+			name:        trigger.name,
+			brokers:     config["brokers"],
+			topic:       config["topic"],
+			group:       config["group"],
+			batchSize:   defaultKafkaBatchSize,
+			batchWindow: defaultKafkaBatchWindow,
+			startOffset: config["startOffset"],
+		}
+		if t.group == "" {
+			t.group = fmt.Sprintf("kube-serverless.%s.%s", fn.Name, trigger.name)
+		}
+		if v, err := strconv.Atoi(config["batchSize"]); err == nil {
+			t.batchSize = v
+		}
+		if v, err := time.ParseDuration(config["batchWindow"]); err == nil {
+			t.batchWindow = v
+		}
+		if t.startOffset == "" {
+			t.startOffset = defaultKafkaStartOffset
+		}
+		triggers = append(triggers, t)
+	}
+	return triggers
+}
+
+func (t kafkaTrigger) startOffsetValue() int64 {
+	if t.startOffset == "earliest" {
+		return kafka.FirstOffset
+	}
+	return kafka.LastOffset
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// kafkaRecord is a message in the body of a batch invocation. Key and value
+// are base64-encoded.
+type kafkaRecord struct {
+	Offset    int64             `json:"offset"`
+	Key       []byte            `json:"key,omitempty"`
+	Value     []byte            `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// kafkaBatch is the body of a batch invocation.
+type kafkaBatch struct {
+	Topic     string        `json:"topic"`
+	Partition int           `json:"partition"`
+	Messages  []kafkaRecord `json:"messages"`
+}
+
+// request builds the invocation for messages of one partition. A single
+// message is sent as is, with its metadata in headers; a batch is sent as a
+// JSON kafkaBatch.
+func (t kafkaTrigger) request(messages []kafka.Message) (*InvocationRequest, error) {
+	first := messages[0]
+	header := http.Header{
+		"X-Kafka-Topic":     []string{first.Topic},
+		"X-Kafka-Partition": []string{strconv.Itoa(first.Partition)},
+	}
+
+	if t.batchSize == 1 {
+		contentType := "application/json"
+		for _, h := range first.Headers {
+			if strings.EqualFold(h.Key, "content-type") {
+				contentType = string(h.Value)
+			}
+		}
+		header.Set("Content-Type", contentType)
+		header.Set("X-Kafka-Offset", strconv.FormatInt(first.Offset, 10))
+		if len(first.Key) > 0 {
+			header.Set("X-Kafka-Key", string(first.Key))
+		}
+		return &InvocationRequest{Method: http.MethodPost, Header: header, Query: url.Values{}, Body: first.Value}, nil
+	}
+
+	batch := kafkaBatch{Topic: first.Topic, Partition: first.Partition}
+	for _, msg := range messages {
+		record := kafkaRecord{Offset: msg.Offset, Key: msg.Key, Value: msg.Value, Timestamp: msg.Time}
+		if len(msg.Headers) > 0 {
+			record.Headers = make(map[string]string, len(msg.Headers))
+			for _, h := range msg.Headers {
+				record.Headers[h.Key] = string(h.Value)
+			}
+		}
+		batch.Messages = append(batch.Messages, record)
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", "application/json")
+	return &InvocationRequest{Method: http.MethodPost, Header: header, Query: url.Values{}, Body: body}, nil
+}
+
+// kafkaBroker is how a KafkaSource reaches Kafka.
+type kafkaBroker interface {
+	// JoinGroup joins the consumer group of a trigger.
+	JoinGroup(t kafkaTrigger) (kafkaGroup, error)
+	// ReadPartition reads a partition of the trigger's topic from offset,
+	// which may be kafka.FirstOffset or kafka.LastOffset.
+	ReadPartition(t kafkaTrigger, partition int, offset int64) (kafkaPartitionReader, error)
+}
+
+// kafkaGroup is the membership of a consumer group.
+type kafkaGroup interface {
+	// Next waits for the next generation of the group.
+	Next(ctx context.Context) (kafkaGeneration, error)
+	Close() error
+}
+
+// kafkaGeneration is a generation of a consumer group, which lasts until
+// the group rebalances.
+type kafkaGeneration interface {
+	// Partitions returns the partitions of the topic assigned to this
+	// member, with the offsets to start from.
+	Partitions() []kafka.PartitionAssignment
+	// Start runs fn in a goroutine with a context that is cancelled when the
+	// generation ends. The generation ends when fn returns.
+	Start(fn func(ctx context.Context))
+	// Commit commits the offset of the next message to consume from a
+	// partition.
+	Commit(partition int, offset int64) error
+}
+
+// kafkaPartitionReader reads the messages of one partition in order.
+type kafkaPartitionReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	// ReadLag returns how many messages follow the last one fetched.
+	ReadLag(ctx context.Context) (int64, error)
+	Close() error
+}
+
+// kafkaGoBroker reaches Kafka with kafka-go.
+type kafkaGoBroker struct{}
+
+func (kafkaGoBroker) JoinGroup(t kafkaTrigger) (kafkaGroup, error) {
+	group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:          t.group,
+		Brokers:     splitList(t.brokers),
+		Topics:      []string{t.topic},
+		StartOffset: t.startOffsetValue(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kafkaGoGroup{group: group, topic: t.topic}, nil
+}
+
+func (kafkaGoBroker) ReadPartition(t kafkaTrigger, partition int, offset int64) (kafkaPartitionReader, error) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   splitList(t.brokers),
+		Topic:     t.topic,
+		Partition: partition,
+		MaxWait:   time.Second,
+	})
+	if err := reader.SetOffset(offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+type kafkaGoGroup struct {
+	group *kafka.ConsumerGroup
+	topic string
+}
+
+func (g kafkaGoGroup) Next(ctx context.Context) (kafkaGeneration, error) {
+	gen, err := g.group.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return kafkaGoGeneration{Generation: gen, topic: g.topic}, nil
+}
+
+func (g kafkaGoGroup) Close() error { return g.group.Close() }
+
+type kafkaGoGeneration struct {
+	*kafka.Generation
+	topic string
+}
+
+func (g kafkaGoGeneration) Partitions() []kafka.PartitionAssignment {
+	return g.Assignments[g.topic]
+}
+
+func (g kafkaGoGeneration) Commit(partition int, offset int64) error {
+	return g.CommitOffsets(map[string]map[int]int64{g.topic: {partition: offset}})
+}
+
+// KafkaSource is the event source of kafka triggers. Each trigger consumes
+// its topic in a consumer group and invokes its function per message or per
+// batch of messages from one partition. Every assigned partition has its own
+// reader, so partitions are handled independently, and the messages of a
+// partition one invocation at a time, in order. An offset is committed only
+// once its batch is done with: the function handled it, or it still failed
+// after the last attempt of the function's retry policy and was stored as a
+// dead letter. It runs on the replica holding the controller lease.
+type KafkaSource struct {
+	broker kafkaBroker
+
+	mu        sync.Mutex
+	delivery  *Delivery
+	ctx       context.Context
+	consumers map[string]*kafkaConsumer
+}
+
+type kafkaConsumer struct {
+	trigger kafkaTrigger
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	function *Function
+}
+
+func (c *kafkaConsumer) fn() *Function {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.function
+}
+
+func NewKafkaSource() *KafkaSource {
+	return &KafkaSource{
+		broker:    kafkaGoBroker{},
+		consumers: make(map[string]*kafkaConsumer),
+	}
+}
+
+func (s *KafkaSource) Type() string { return "kafka" }
+
+func (s *KafkaSource) LeaderOnly() bool { return true }
+
+func (s *KafkaSource) Validate(errs *ValidationErrors, field string, config map[string]string) {
+	if brokers := splitList(config["brokers"]); len(brokers) == 0 {
+		errs.add(field+".brokers", "required")
+	} else {
+		for _, broker := range brokers {
+			if _, port, err := net.SplitHostPort(broker); err != nil || port == "" {
+				errs.add(field+".brokers", "invalid broker address %q, must be host:port", broker)
+			}
+		}
+	}
+	if config["topic"] == "" {
+		errs.add(field+".topic", "required")
+	}
+	if v := config["batchSize"]; v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			errs.add(field+".batchSize", "must be an integer greater than or equal to 1")
+		}
+	}
+	if v := config["batchWindow"]; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			errs.add(field+".batchWindow", "must be a positive duration, such as 500ms")
+		}
+	}
+	if v := config["startOffset"]; v != "" && v != "earliest" && v != "latest" {
+		errs.add(field+".startOffset", "must be earliest or latest")
+	}
+}
+
+// Start enables consuming until Stop is called or ctx is cancelled.
+// Triggers are added by Sync.
+func (s *KafkaSource) Start(ctx context.Context, delivery *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	s.delivery = delivery
+	return nil
+}
+
+// Stop stops all consumers. Messages being handled are not committed and
+// are consumed again by the group.
+func (s *KafkaSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, consumer := range s.consumers {
+		consumer.cancel()
+		delete(s.consumers, key)
+	}
+	s.ctx = nil
+}
+
+// Sync starts consumers for the kafka triggers of fn, restarting those
+// whose config changed and stopping those no longer in its spec.
+func (s *KafkaSource) Sync(fn *Function) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, trigger := range kafkaTriggers(fn) {
+		key := fn.Name + "/" + trigger.name
+		current[key] = true
+
+		if consumer, ok := s.consumers[key]; ok {
+			if consumer.trigger == trigger {
+				consumer.mu.Lock()
+				consumer.function = fn
+				consumer.mu.Unlock()
+				continue
+			}
+			consumer.cancel()
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		consumer := &kafkaConsumer{trigger: trigger, cancel: cancel, function: fn}
+		s.consumers[key] = consumer
+		go s.run(ctx, consumer)
+	}
+
+	for key, consumer := range s.consumers {
+		if strings.HasPrefix(key, fn.Name+"/") && !current[key] {
+			consumer.cancel()
+			delete(s.consumers, key)
+		}
+	}
+}
+
+// Remove stops the consumers of a function.
+func (s *KafkaSource) Remove(function string) {
+	s.Sync(&Function{Name: function})
+}
+
+// run consumes a trigger's topic until ctx is cancelled, joining its group
+// again after errors.
+func (s *KafkaSource) run(ctx context.Context, consumer *kafkaConsumer) {
+	function, t := consumer.fn().Name, consumer.trigger
+	defer kafkaConsumerLag.DeletePartialMatch(prometheus.Labels{"function": function, "trigger": t.name})
+
+	for {
+		err := s.consume(ctx, consumer)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Kafka: trigger %s of %s stopped consuming, retrying in %s: %v",
+			t.name, function, kafkaReconnectDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kafkaReconnectDelay):
+		}
+	}
+}
+
+// consume joins the trigger's consumer group and, for every generation of
+// the group, consumes each partition assigned to it until the group
+// rebalances. It returns when the group fails or ctx is cancelled.
+func (s *KafkaSource) consume(ctx context.Context, consumer *kafkaConsumer) error {
+	group, err := s.broker.JoinGroup(consumer.trigger)
+	if err != nil {
+		return err
+	}
+	defer group.Close()
+
+	for {
+		gen, err := group.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for _, assignment := range gen.Partitions() {
+			partition, offset := assignment.ID, assignment.Offset
+			gen.Start(func(genCtx context.Context) {
+				// Stop with the generation, or with the trigger.
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				defer context.AfterFunc(genCtx, cancel)()
+				s.partition(ctx, gen, consumer, partition, offset)
+			})
+		}
+	}
+}
+
+// partition consumes one partition from offset until ctx is cancelled. A
+// failing reader is reconnected without holding up the other partitions.
+func (s *KafkaSource) partition(ctx context.Context, gen kafkaGeneration, consumer *kafkaConsumer, partition int, offset int64) {
+	for {
+		err := s.readPartition(ctx, gen, consumer, partition, &offset)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Kafka: partition %d of trigger %s of %s stopped, retrying in %s: %v",
+			partition, consumer.trigger.name, consumer.fn().Name, kafkaReconnectDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kafkaReconnectDelay):
+		}
+	}
+}
+
+// readPartition handles the messages of a partition in order, starting at
+// *offset, and commits each batch once it is done with. *offset is kept at
+// the first message not yet committed.
+func (s *KafkaSource) readPartition(ctx context.Context, gen kafkaGeneration, consumer *kafkaConsumer, partition int, offset *int64) error {
+	t := consumer.trigger
+	reader, err := s.broker.ReadPartition(t, partition, *offset)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	lag := kafkaConsumerLag.WithLabelValues(consumer.fn().Name, t.name, t.topic, strconv.Itoa(partition))
+	for {
+		batch, err := fetchBatch(ctx, reader, t)
+		if err != nil {
+			return err
+		}
+		first, last := batch[0], batch[len(batch)-1]
+		*offset = first.Offset
+
+		// The batch is lag until it is committed, like the messages behind
+		// it, which keep arriving while it is retried.
+		lag.Set(float64(last.HighWaterMark - first.Offset))
+		stuck := func() {
+			if behind, err := reader.ReadLag(ctx); err == nil {
+				lag.Set(float64(behind + last.Offset + 1 - first.Offset))
+			}
+		}
+
+		if !s.deliver(ctx, consumer, batch, stuck) {
+			return ctx.Err()
+		}
+		if err := gen.Commit(partition, last.Offset+1); err != nil {
+			return fmt.Errorf("failed to commit offset %d: %w", last.Offset, err)
+		}
+		*offset = last.Offset + 1
+		lag.Set(float64(max(last.HighWaterMark-last.Offset-1, 0)))
+	}
+}
+
+// fetchBatch waits for the next message of a partition and, if the trigger
+// batches, for up to batchSize-1 more within its batch window.
+func fetchBatch(ctx context.Context, reader kafkaPartitionReader, t kafkaTrigger) ([]kafka.Message, error) {
+	msg, err := reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := []kafka.Message{msg}
+
+	window, cancel := context.WithTimeout(ctx, t.batchWindow)
+	defer cancel()
+	for len(batch) < t.batchSize {
+		msg, err := reader.FetchMessage(window)
+		if err != nil {
+			if ctx.Err() == nil && window.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+// deliver invokes the function with a batch, retrying failures with the
+// function's retry policy; a batch that fails its last attempt is stored as
+// a dead letter. stuck is called after every failed attempt. deliver
+// returns false if ctx was cancelled before the batch was done with.
+func (s *KafkaSource) deliver(ctx context.Context, consumer *kafkaConsumer, batch []kafka.Message, stuck func()) bool {
+	s.mu.Lock()
+	delivery := s.delivery
+	s.mu.Unlock()
+
+	t := consumer.trigger
+	first := batch[0]
+	for attempt := int32(1); ; attempt++ {
+		fn := consumer.fn()
+		inv, err := t.request(batch)
+		if err != nil {
+			// Only marshalling can fail, which retrying does not fix.
+			log.Printf("Kafka: dropping batch of %s at offset %d of partition %d: %v", fn.Name, first.Offset, first.Partition, err)
+			return true
+		}
+
+		resp, err := delivery.Invoke(ctx, fn, inv)
+		if ctx.Err() != nil {
+			return false
+		}
+
+		policy := effectiveRetryPolicy(fn)
+		if !policy.failed(resp, err) {
+			kafkaMessages.WithLabelValues(fn.Name, t.name, "committed").Add(float64(len(batch)))
+			return true
+		}
+		kafkaMessages.WithLabelValues(fn.Name, t.name, "failed").Add(float64(len(batch)))
+		stuck()
+
+		if !policy.shouldRetry(attempt, resp, err) {
+			log.Printf("Kafka: invoking %s with offset %d of %s/%d failed after %d attempts, storing a dead letter: %s",
+				fn.Name, first.Offset, first.Topic, first.Partition, attempt, attemptError(resp, err))
+			dl := newDeadLetter(fn.Name, SourceKafka, attempt, resp, err)
+			if !s.storeDeadLetter(ctx, delivery, dl, inv, policy) {
+				return false
+			}
+			kafkaMessages.WithLabelValues(fn.Name, t.name, "dead_lettered").Add(float64(len(batch)))
+			return true
+		}
+
+		backoff := policy.backoff(attempt)
+		log.Printf("Kafka: invoking %s with offset %d of %s/%d failed (attempt %d), retrying in %s: %s",
+			fn.Name, first.Offset, first.Topic, first.Partition, attempt, backoff, attemptError(resp, err))
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// storeDeadLetter stores a failed batch, retrying with the policy's backoff
+// so that the batch is committed only once it is kept. It returns false if
+// ctx was cancelled first.
+func (s *KafkaSource) storeDeadLetter(ctx context.Context, delivery *Delivery, dl *DeadLetter, inv *InvocationRequest, policy RetryPolicy) bool {
+	for retry := int32(1); ; retry++ {
+		err := delivery.k8sClient.CreateDeadLetter(ctx, dl, inv)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		backoff := policy.backoff(retry)
+		log.Printf("Kafka: failed to store dead letter for %s, retrying in %s: %v", dl.Function, backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+	}
+}
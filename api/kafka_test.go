@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka is an in-process stand-in for a Kafka cluster with a single
+// topic, whose consumer group assigns every partition to its one member.
+type fakeKafka struct {
+	mu         sync.Mutex
+	topic      string
+	partitions [][]kafka.Message
+	committed  map[int]int64
+}
+
+func newFakeKafka(topic string, partitions int) *fakeKafka {
+	return &fakeKafka{
+		topic:      topic,
+		partitions: make([][]kafka.Message, partitions),
+		committed:  make(map[int]int64),
+	}
+}
+
+func (k *fakeKafka) produce(partition int, value string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.partitions[partition] = append(k.partitions[partition], kafka.Message{
+		Topic:     k.topic,
+		Partition: partition,
+		Offset:    int64(len(k.partitions[partition])),
+		Value:     []byte(value),
+	})
+}
+
+// committedOffset returns the committed offset of a partition, or -1.
+func (k *fakeKafka) committedOffset(partition int) int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if offset, ok := k.committed[partition]; ok {
+		return offset
+	}
+	return -1
+}
+
+func (k *fakeKafka) JoinGroup(t kafkaTrigger) (kafkaGroup, error) {
+	if t.topic != k.topic {
+		return nil, errors.New("unknown topic " + t.topic)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fakeKafkaGroup{kafka: k, ctx: ctx, cancel: cancel}, nil
+}
+
+func (k *fakeKafka) ReadPartition(t kafkaTrigger, partition int, offset int64) (kafkaPartitionReader, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch offset {
+	case kafka.FirstOffset:
+		offset = 0
+	case kafka.LastOffset:
+		offset = int64(len(k.partitions[partition]))
+	}
+	return &fakePartitionReader{kafka: k, partition: partition, next: offset}, nil
+}
+
+type fakeKafkaGroup struct {
+	kafka  *fakeKafka
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	joined bool
+}
+
+// Next hands out one generation, which lasts until the group is closed.
+func (g *fakeKafkaGroup) Next(ctx context.Context) (kafkaGeneration, error) {
+	if !g.joined {
+		g.joined = true
+		return fakeGeneration{g}, nil
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-g.ctx.Done():
+		return nil, errors.New("group closed")
+	}
+}
+
+func (g *fakeKafkaGroup) Close() error {
+	g.cancel()
+	g.wg.Wait()
+	return nil
+}
+
+type fakeGeneration struct{ group *fakeKafkaGroup }
+
+func (g fakeGeneration) Partitions() []kafka.PartitionAssignment {
+	k := g.group.kafka
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var assignments []kafka.PartitionAssignment
+	for partition := range k.partitions {
+		offset, ok := k.committed[partition]
+		if !ok {
+			offset = kafka.FirstOffset
+		}
+		assignments = append(assignments, kafka.PartitionAssignment{ID: partition, Offset: offset})
+	}
+	return assignments
+}
+
+func (g fakeGeneration) Start(fn func(ctx context.Context)) {
+	g.group.wg.Add(1)
+	go func() {
+		defer g.group.wg.Done()
+		fn(g.group.ctx)
+	}()
+}
+
+func (g fakeGeneration) Commit(partition int, offset int64) error {
+	k := g.group.kafka
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.committed[partition] = offset
+	return nil
+}
+
+type fakePartitionReader struct {
+	kafka     *fakeKafka
+	partition int
+	next      int64
+}
+
+func (r *fakePartitionReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		if msg, ok := r.poll(); ok {
+			return msg, nil
+		}
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (r *fakePartitionReader) poll() (kafka.Message, bool) {
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+	messages := r.kafka.partitions[r.partition]
+	if r.next >= int64(len(messages)) {
+		return kafka.Message{}, false
+	}
+	msg := messages[r.next]
+	msg.HighWaterMark = int64(len(messages))
+	r.next++
+	return msg, true
+}
+
+func (r *fakePartitionReader) ReadLag(ctx context.Context) (int64, error) {
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+	return int64(len(r.kafka.partitions[r.partition])) - r.next, nil
+}
+
+func (r *fakePartitionReader) Close() error { return nil }
+
+// kafkaRuntime is a runtime stand-in that records the bodies it was invoked
+// with per partition and answers with status.
+type kafkaRuntime struct {
+	status int
+	// hold, if set, holds invocations of partition 0 until it is closed.
+	hold chan struct{}
+
+	mu     sync.Mutex
+	bodies map[string][]string
+}
+
+func (r *kafkaRuntime) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	partition := req.Header.Get("X-Kafka-Partition")
+	if r.hold != nil && partition == "0" {
+		select {
+		case <-r.hold:
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	if r.bodies == nil {
+		r.bodies = make(map[string][]string)
+	}
+	r.bodies[partition] = append(r.bodies[partition], string(body))
+	r.mu.Unlock()
+
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+func (r *kafkaRuntime) received(partition int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bodies[strconv.Itoa(partition)]...)
+}
+
+// startKafkaSource runs a kafka source against broker with a kafka trigger
+// of fn, which is served by runtime.
+func startKafkaSource(t *testing.T, broker *fakeKafka, runtime http.Handler, fn *Function) *Server {
+	t.Helper()
+
+	server := newTestServer(t, runtime)
+	if _, _, err := server.k8sClient.createOrAdoptFunctionResource(context.Background(), fn); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewKafkaSource()
+	s.broker = broker
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		s.Stop()
+		cancel()
+	})
+	if err := s.Start(ctx, NewDelivery(server)); err != nil {
+		t.Fatal(err)
+	}
+
+	fn.Triggers = []Trigger{{Type: "kafka", Config: map[string]string{
+		"brokers":     "kafka.test:9092",
+		"topic":       broker.topic,
+		"startOffset": "earliest",
+	}}}
+	s.Sync(fn)
+	return server
+}
+
+func TestKafkaSourceCommitsPartitionsInOrder(t *testing.T) {
+	broker := newFakeKafka("orders", 2)
+	for _, value := range []string{"a", "b", "c"} {
+		broker.produce(0, "p0-"+value)
+		broker.produce(1, "p1-"+value)
+	}
+	runtime := &kafkaRuntime{}
+	startKafkaSource(t, broker, runtime, testFunction())
+
+	eventually(t, "both partitions to be committed", func() bool {
+		return broker.committedOffset(0) == 3 && broker.committedOffset(1) == 3
+	})
+	for partition := 0; partition < 2; partition++ {
+		got := runtime.received(partition)
+		prefix := "p" + strconv.Itoa(partition) + "-"
+		want := []string{prefix + "a", prefix + "b", prefix + "c"}
+		if len(got) != len(want) {
+			t.Fatalf("partition %d got %q, want %q", partition, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("partition %d got %q, want %q", partition, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestKafkaSourceStuckPartitionDoesNotBlockOthers(t *testing.T) {
+	broker := newFakeKafka("orders", 2)
+	for i := 0; i < 3; i++ {
+		broker.produce(0, "held")
+		broker.produce(1, "free")
+	}
+	runtime := &kafkaRuntime{hold: make(chan struct{})}
+	defer close(runtime.hold)
+	startKafkaSource(t, broker, runtime, testFunction())
+
+	eventually(t, "partition 1 to be committed", func() bool { return broker.committedOffset(1) == 3 })
+	if offset := broker.committedOffset(0); offset != -1 {
+		t.Errorf("held partition 0 committed offset %d", offset)
+	}
+
+	// The held partition's lag counts the message being delivered and the
+	// ones behind it.
+	lag := kafkaConsumerLag.WithLabelValues("hello", "kafka-0", "orders", "0")
+	eventually(t, "the lag of partition 0", func() bool { return testutil.ToFloat64(lag) == 3 })
+}
+
+func TestKafkaSourceDeadLettersAfterMaxAttempts(t *testing.T) {
+	broker := newFakeKafka("orders", 1)
+	broker.produce(0, `{"order":1}`)
+	broker.produce(0, `{"order":2}`)
+	runtime := &kafkaRuntime{status: http.StatusServiceUnavailable}
+	fn := testFunction()
+	fn.RetryPolicy = &RetryPolicy{MaxAttempts: 2, InitialBackoffSeconds: 1}
+	server := startKafkaSource(t, broker, runtime, fn)
+
+	// One backoff of a second before the first message's last attempt.
+	eventually(t, "the first message to be committed", func() bool { return broker.committedOffset(0) >= 1 })
+
+	letters, err := server.k8sClient.ListDeadLetters(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) == 0 {
+		t.Fatal("no dead letter stored")
+	}
+	dl := letters[0]
+	if dl.Source != SourceKafka || dl.Attempts != 2 || dl.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("dead letter = %+v", dl)
+	}
+	if got := runtime.received(0); len(got) < 2 || got[0] != `{"order":1}` || got[1] != `{"order":1}` {
+		t.Errorf("invocations = %q, want the first message twice", got)
+	}
+}
@@ -2,50 +2,105 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
-	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 )
 
 type KubernetesClient struct {
-	clientset *kubernetes.Clientset
-	namespace string
+	clientset  kubernetes.Interface
+	dynamic    dynamic.Interface
+	namespace  string
+	httpClient *http.Client
+	config     *ConfigStore
 }
 
+// Function is the REST API representation of a function: its name, the
+// spec fields inlined, and its status.
 type Function struct {
-	Name        string            `json:"name"`
+	Name string `json:"name"`
+	FunctionSpec
+	Status FunctionStatus `json:"status,omitempty"`
+}
+
+// FunctionSpec is the desired state of a function. It is shared by the
+// REST API and the spec of the Function custom resource.
+type FunctionSpec struct {
 	Runtime     string            `json:"runtime"`
 	Handler     string            `json:"handler"`
 	Code        string            `json:"code"`
 	Environment map[string]string `json:"environment,omitempty"`
-	MinReplicas int32             `json:"minReplicas,omitempty"`
-	MaxReplicas int32             `json:"maxReplicas,omitempty"`
-	Triggers    []Trigger         `json:"triggers,omitempty"`
-	Status      FunctionStatus    `json:"status,omitempty"`
+	// EnvFrom and SecretMounts pass Secrets and ConfigMaps to the function
+	// by reference.
+	EnvFrom      []EnvVarSource   `json:"envFrom,omitempty"`
+	SecretMounts []SecretMount    `json:"secretMounts,omitempty"`
+	MinReplicas  int32            `json:"minReplicas,omitempty"`
+	MaxReplicas  int32            `json:"maxReplicas,omitempty"`
+	Triggers     []Trigger        `json:"triggers,omitempty"`
+	Traffic      []TrafficTarget  `json:"traffic,omitempty"`
+	Aliases      map[string]int64 `json:"aliases,omitempty"`
+	RetryPolicy  *RetryPolicy     `json:"retryPolicy,omitempty"`
+	// Resources are the requests and limits of the function's container.
+	Resources *FunctionResources `json:"resources,omitempty"`
+	Scaling   *ScalingPolicy     `json:"scaling,omitempty"`
+	// MaxConcurrency caps the invocations of the function each API server
+	// replica runs at once; MaxQueueDepth more wait for a slot.
+	MaxConcurrency int32 `json:"maxConcurrency,omitempty"`
+	MaxQueueDepth  int32 `json:"maxQueueDepth,omitempty"`
+	// TimeoutSeconds is how long an invocation may run. Runtimes get it as
+	// FUNCTION_TIMEOUT, and the API server gives up shortly after it.
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
 }
 
 type Trigger struct {
+	// Name identifies the trigger within its function. It defaults to
+	// <type>-<index>.
+	Name   string            `json:"name,omitempty"`
 	Type   string            `json:"type"`
 	Config map[string]string `json:"config"`
 }
 
+// triggerName returns the name of the i-th trigger of a function.
+func triggerName(i int, trigger Trigger) string {
+	if trigger.Name != "" {
+		return trigger.Name
+	}
+	return fmt.Sprintf("%s-%d", trigger.Type, i)
+}
+
 type FunctionStatus struct {
-	State          string    `json:"state"`
-	Endpoint       string    `json:"endpoint,omitempty"`
-	Replicas       int32     `json:"replicas"`
-	LastDeployment time.Time `json:"lastDeployment,omitempty"`
+	State              string       `json:"state"`
+	Message            string       `json:"message,omitempty"`
+	Endpoint           string       `json:"endpoint,omitempty"`
+	Replicas           int32        `json:"replicas"`
+	LastDeployment     *metav1.Time `json:"lastDeployment,omitempty"`
+	ObservedGeneration int64        `json:"observedGeneration,omitempty"`
+	Revision           int64        `json:"revision,omitempty"`
 }
 
+// Function states reported in FunctionStatus.State.
+const (
+	FunctionStateDeploying = "deploying"
+	FunctionStateRunning   = "running"
+	FunctionStateIdle      = "idle"
+	FunctionStateFailed    = "failed"
+)
+
 type FunctionMetrics struct {
 	Invocations   int64   `json:"invocations"`
 	ColdStarts    int64   `json:"coldStarts"`
@@ -54,8 +109,8 @@ type FunctionMetrics struct {
 	CostEstimate  float64 `json:"costEstimate"`
 }
 
-func NewKubernetesClient() (*KubernetesClient, error) {
-	config, err := rest.InClusterConfig()
+func NewKubernetesClient(opts ClientOptions, platformConfig *ConfigStore) (*KubernetesClient, error) {
+	config, namespace, err := loadClientConfig(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -65,15 +120,19 @@ func NewKubernetesClient() (*KubernetesClient, error) {
 		return nil, err
 	}
 
-	namespace := "kube-serverless"
-	// Try to get namespace from environment
-	if ns := corev1.Namespace(); ns != "" {
-		namespace = ns
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
+	log.Printf("Using Kubernetes API server %s, namespace %s", config.Host, namespace)
+
 	return &KubernetesClient{
-		clientset: clientset,
-		namespace: namespace,
+		clientset:  clientset,
+		dynamic:    dynamicClient,
+		namespace:  namespace,
+		httpClient: &http.Client{},
+		config:     platformConfig,
 	}, nil
 }
 
@@ -82,118 +141,333 @@ func (k *KubernetesClient) Ping() error {
 	return err
 }
 
+// functions returns a client for Function resources in the platform
+// namespace.
+func (k *KubernetesClient) functions() dynamic.ResourceInterface {
+	return k.dynamic.Resource(functionGVR).Namespace(k.namespace)
+}
+
+func (k *KubernetesClient) getFunctionResource(ctx context.Context, name string) (*FunctionResource, error) {
+	u, err := k.functions().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return functionResourceFromUnstructured(u)
+}
+
 func (k *KubernetesClient) ListFunctions(ctx context.Context) ([]Function, error) {
-	deployments, err := k.clientset.AppsV1().Deployments(k.namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: "app.kubernetes.io/managed-by=kube-serverless",
-	})
+	list, err := k.functions().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	functions := make([]Function, 0, len(deployments.Items))
-	for _, dep := range deployments.Items {
-		function := k.deploymentToFunction(&dep)
-		functions = append(functions, function)
+	functions := make([]Function, 0, len(list.Items))
+	for i := range list.Items {
+		res, err := functionResourceFromUnstructured(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		functions = append(functions, *res.Function())
 	}
 
 	return functions, nil
 }
 
+// CreateFunction stores the function as a Function resource and provisions
+// its objects right away so that errors are reported to the caller. The
+// controller keeps them in sync afterwards.
+//
+// Creation is all or nothing: if provisioning fails, the objects created by
+// this call and the Function resource are deleted again. Retrying is safe,
+// since existing objects managed by kube-serverless are adopted, as is an
+// existing Function resource with an identical spec.
 func (k *KubernetesClient) CreateFunction(ctx context.Context, fn *Function) error {
-	// Set defaults
-	if fn.MinReplicas == 0 {
-		fn.MinReplicas = 0
-	}
-	if fn.MaxReplicas == 0 {
-		fn.MaxReplicas = 10
+	k.applyDefaults(fn)
+	if err := k.checkFunction(ctx, fn); err != nil {
+		return err
 	}
 
-	// Create ConfigMap for function code
-	if err := k.createFunctionConfigMap(ctx, fn); err != nil {
+	res, createdResource, err := k.createOrAdoptFunctionResource(ctx, fn)
+	if err != nil {
 		return err
 	}
 
-	// Create Deployment
-	if err := k.createFunctionDeployment(ctx, fn); err != nil {
+	var created []functionObject
+	revision, err := k.ensureRevision(ctx, fn, res.Generation, res.ownerReference())
+	if err == nil {
+		created, err = k.applyFunction(ctx, fn, res.ownerReference())
+	}
+	if err != nil {
+		// Clean up even if the caller has gone away.
+		cleanupCtx := context.WithoutCancel(ctx)
+		if cleanupErr := k.deleteFunctionObjects(cleanupCtx, created); cleanupErr != nil {
+			log.Printf("Failed to roll back function %s: %v", fn.Name, cleanupErr)
+		}
+		if createdResource {
+			if cleanupErr := k.functions().Delete(cleanupCtx, fn.Name, metav1.DeleteOptions{}); cleanupErr != nil && !apierrors.IsNotFound(cleanupErr) {
+				log.Printf("Failed to roll back function %s: %v", fn.Name, cleanupErr)
+			}
+		}
 		return err
 	}
 
-	// Create Service
-	if err := k.createFunctionService(ctx, fn); err != nil {
+	fn.Status = res.Function().Status
+	fn.Status.Revision = revision
+	return nil
+}
+
+// checkFunction validates a function with defaults applied and checks it
+// against the platform's resource bounds and the objects it refers to.
+func (k *KubernetesClient) checkFunction(ctx context.Context, fn *Function) error {
+	if err := ValidateFunction(fn); err != nil {
 		return err
 	}
-
-	// Create HPA for auto-scaling
-	if err := k.createFunctionHPA(ctx, fn); err != nil {
+	if err := k.checkResourceBounds(fn); err != nil {
 		return err
 	}
+	if err := k.checkRevisionReferences(ctx, fn); err != nil {
+		return err
+	}
+	if err := k.checkHTTPRoutes(ctx, fn); err != nil {
+		return err
+	}
+	return k.checkSecretReferences(ctx, fn)
+}
 
-	return nil
+// createOrAdoptFunctionResource creates the Function resource for fn. An
+// existing resource is adopted if it is managed by kube-serverless and has
+// the same spec, which makes retrying a create idempotent. It reports
+// whether the resource was created by this call.
+func (k *KubernetesClient) createOrAdoptFunctionResource(ctx context.Context, fn *Function) (*FunctionResource, bool, error) {
+	res := &FunctionResource{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fn.Name,
+			Namespace: k.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       fn.Name,
+				"app.kubernetes.io/managed-by": "kube-serverless",
+			},
+		},
+		Spec: fn.FunctionSpec,
+	}
+
+	u, err := res.toUnstructured()
+	if err != nil {
+		return nil, false, err
+	}
+
+	created, err := k.functions().Create(ctx, u, metav1.CreateOptions{})
+	if err == nil {
+		res, err = functionResourceFromUnstructured(created)
+		return res, true, err
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return nil, false, err
+	}
+
+	existing, getErr := k.getFunctionResource(ctx, fn.Name)
+	if getErr != nil {
+		return nil, false, err
+	}
+	if existing.Labels["app.kubernetes.io/managed-by"] != "kube-serverless" ||
+		existing.DeletionTimestamp != nil ||
+		!equality.Semantic.DeepEqual(existing.Spec, fn.FunctionSpec) {
+		return nil, false, err
+	}
+
+	return existing, false, nil
 }
 
+// applyDefaults fills in unset replica bounds and resources from the
+// platform config.
+func (k *KubernetesClient) applyDefaults(fn *Function) {
+	cfg := k.config.Get()
+	if fn.MinReplicas == 0 {
+		fn.MinReplicas = cfg.DefaultMinReplicas
+	}
+	if fn.MaxReplicas == 0 {
+		fn.MaxReplicas = cfg.DefaultMaxReplicas
+	}
+	applyResourceDefaults(fn, cfg)
+}
+
+// GetFunction returns a function with its effective resources: functions
+// stored without some of them are deployed with the platform defaults.
 func (k *KubernetesClient) GetFunction(ctx context.Context, name string) (*Function, error) {
-	deployment, err := k.clientset.AppsV1().Deployments(k.namespace).Get(ctx, name, metav1.GetOptions{})
+	res, err := k.getFunctionResource(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-
-	function := k.deploymentToFunction(deployment)
-	return &function, nil
+	fn := res.Function()
+	applyResourceDefaults(fn, k.config.Get())
+	return fn, nil
 }
 
+// UpdateFunction replaces the spec of a Function resource, records a
+// revision if its code changed, and provisions the change right away.
 func (k *KubernetesClient) UpdateFunction(ctx context.Context, fn *Function) error {
-	// Update ConfigMap
-	if err := k.updateFunctionConfigMap(ctx, fn); err != nil {
+	k.applyDefaults(fn)
+	if err := k.checkFunction(ctx, fn); err != nil {
 		return err
 	}
 
-	// Update Deployment
-	deployment, err := k.clientset.AppsV1().Deployments(k.namespace).Get(ctx, fn.Name, metav1.GetOptions{})
+	var res *FunctionResource
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := k.getFunctionResource(ctx, fn.Name)
+		if err != nil {
+			return err
+		}
+		current.Spec = fn.FunctionSpec
+
+		u, err := current.toUnstructured()
+		if err != nil {
+			return err
+		}
+		updated, err := k.functions().Update(ctx, u, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		res, err = functionResourceFromUnstructured(updated)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	deployment.Spec.Template.Spec.Containers[0].Image = k.getRuntimeImage(fn.Runtime)
-	deployment.Spec.Template.Spec.Containers[0].Env = k.buildEnvVars(fn)
+	revision, err := k.ensureRevision(ctx, fn, res.Generation, res.ownerReference())
+	if err != nil {
+		return err
+	}
 
-	_, err = k.clientset.AppsV1().Deployments(k.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
-	return err
+	if err := k.ApplyFunction(ctx, fn, res.ownerReference()); err != nil {
+		return err
+	}
+
+	fn.Status = res.Function().Status
+	fn.Status.Revision = revision
+	return nil
 }
 
+// DeleteFunction deletes a Function resource; its objects are garbage
+// collected through their owner references.
 func (k *KubernetesClient) DeleteFunction(ctx context.Context, name string) error {
-	// Delete Deployment
-	if err := k.clientset.AppsV1().Deployments(k.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+	policy := metav1.DeletePropagationBackground
+	return k.functions().Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &policy})
+}
+
+// UpdateFunctionStatus writes status to the status subresource of a
+// Function resource.
+func (k *KubernetesClient) UpdateFunctionStatus(ctx context.Context, res *FunctionResource, status FunctionStatus) error {
+	updated := *res
+	updated.Status = status
+
+	u, err := updated.toUnstructured()
+	if err != nil {
 		return err
 	}
 
-	// Delete Service
-	if err := k.clientset.CoreV1().Services(k.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
-		return err
+	_, err = k.dynamic.Resource(functionGVR).Namespace(res.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// ReadyEndpoints returns the number of ready pod addresses behind a
+// function's Service.
+func (k *KubernetesClient) ReadyEndpoints(ctx context.Context, name string) (int, error) {
+	endpoints, err := k.clientset.CoreV1().Endpoints(k.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
 	}
 
-	// Delete ConfigMap
-	if err := k.clientset.CoreV1().ConfigMaps(k.namespace).Delete(ctx, name+"-code", metav1.DeleteOptions{}); err != nil {
-		return err
+	ready := 0
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
 	}
+	return ready, nil
+}
+
+// ScaleFromZero sets a function's Deployment to one replica if it is
+// currently scaled to zero, and reports whether it did. The HPA takes over
+// scaling from there.
+func (k *KubernetesClient) ScaleFromZero(ctx context.Context, name string) (bool, error) {
+	scaled := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := k.clientset.AppsV1().Deployments(k.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
 
-	// Delete HPA
-	if err := k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+		if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas > 0 {
+			return nil
+		}
+
+		// Count the wake-up as an invocation so that other API server
+		// replicas do not reap the function before they see its traffic.
+		if deployment.Annotations == nil {
+			deployment.Annotations = map[string]string{}
+		}
+		deployment.Annotations[lastInvocationAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		deployment.Spec.Replicas = int32Ptr(1)
+		_, err = k.clientset.AppsV1().Deployments(k.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+		scaled = err == nil
 		return err
-	}
+	})
+	return scaled, err
+}
 
-	return nil
+// ScaleFunction sets the replicas of a function's Deployment, unless it
+// has been scaled to zero in the meantime.
+func (k *KubernetesClient) ScaleFunction(ctx context.Context, name string, replicas int32) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := k.clientset.AppsV1().Deployments(k.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas == 0 {
+			return nil
+		}
+
+		deployment.Spec.Replicas = int32Ptr(replicas)
+		_, err = k.clientset.AppsV1().Deployments(k.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	})
 }
 
-func (k *KubernetesClient) InvokeFunction(ctx context.Context, name string, body io.Reader) ([]byte, error) {
-	// Get service endpoint
-	service, err := k.clientset.CoreV1().Services(k.namespace).Get(ctx, name, metav1.GetOptions{})
+// ScaleToZero sets a function's Deployment to zero replicas. The HPA stops
+// acting on a Deployment with zero replicas until the activator wakes it.
+func (k *KubernetesClient) ScaleToZero(ctx context.Context, name string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := k.clientset.AppsV1().Deployments(k.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		deployment.Spec.Replicas = int32Ptr(0)
+		_, err = k.clientset.AppsV1().Deployments(k.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// ListFunctionDeployments returns the Deployments of all managed functions.
+func (k *KubernetesClient) ListFunctionDeployments(ctx context.Context) ([]appsv1.Deployment, error) {
+	deployments, err := k.clientset.AppsV1().Deployments(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/managed-by=kube-serverless",
+	})
 	if err != nil {
 		return nil, err
 	}
+	return deployments.Items, nil
+}
 
-	// In a real implementation, we would make an HTTP request to the function
-	// For now, return a placeholder response
-	return []byte(fmt.Sprintf(`{"function": "%s", "status": "invoked"}`, name)), nil
+// AnnotateLastInvocation records when a function was last invoked on its
+// Deployment.
+func (k *KubernetesClient) AnnotateLastInvocation(ctx context.Context, name string, t time.Time) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, lastInvocationAnnotation, t.UTC().Format(time.RFC3339))
+	_, err := k.clientset.AppsV1().Deployments(k.namespace).Patch(ctx, name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
 }
 
 func (k *KubernetesClient) GetFunctionMetrics(ctx context.Context, name string) (*FunctionMetrics, error) {
@@ -208,8 +482,8 @@ func (k *KubernetesClient) GetFunctionMetrics(ctx context.Context, name string)
 	}, nil
 }
 
-func (k *KubernetesClient) createFunctionConfigMap(ctx context.Context, fn *Function) error {
-	cm := &corev1.ConfigMap{
+func (k *KubernetesClient) functionConfigMap(fn *Function) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      fn.Name + "-code",
 			Namespace: k.namespace,
@@ -223,50 +497,50 @@ func (k *KubernetesClient) createFunctionConfigMap(ctx context.Context, fn *Func
 			"code":    fn.Code,
 		},
 	}
-
-	_, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Create(ctx, cm, metav1.CreateOptions{})
-	return err
 }
 
-func (k *KubernetesClient) updateFunctionConfigMap(ctx context.Context, fn *Function) error {
-	cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, fn.Name+"-code", metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
+func (k *KubernetesClient) functionDeployment(fn *Function, w workload) *appsv1.Deployment {
+	replicas := fn.MinReplicas
+	secretVolumes, secretMounts := secretVolumes(fn)
 
-	cm.Data["handler"] = fn.Handler
-	cm.Data["code"] = fn.Code
+	annotations := effectiveScalingPolicy(fn).annotations(fn)
+	annotations[minReplicasAnnotation] = strconv.Itoa(int(fn.MinReplicas))
 
-	_, err = k.clientset.CoreV1().ConfigMaps(k.namespace).Update(ctx, cm, metav1.UpdateOptions{})
-	return err
-}
-
-func (k *KubernetesClient) createFunctionDeployment(ctx context.Context, fn *Function) error {
-	replicas := fn.MinReplicas
+	codeVolume := &corev1.ConfigMapVolumeSource{
+		LocalObjectReference: corev1.LocalObjectReference{
+			Name: w.codeConfigMap,
+		},
+	}
+	if w.revision > 0 {
+		// Revision ConfigMaps also hold the runtime and environment,
+		// which the runtimes do not expect under /function.
+		codeVolume.Items = []corev1.KeyToPath{
+			{Key: "handler", Path: "handler"},
+			{Key: "code", Path: "code"},
+		}
+	}
 
-	deployment := &appsv1.Deployment{
+	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fn.Name,
-			Namespace: k.namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":       fn.Name,
-				"app.kubernetes.io/managed-by": "kube-serverless",
-				"function":                     fn.Name,
-			},
+			Name:        w.name,
+			Namespace:   k.namespace,
+			Labels:      w.labels(fn),
+			Annotations: annotations,
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					"function": fn.Name,
+					"function": w.name,
 				},
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"function":                     fn.Name,
-						"app.kubernetes.io/name":       fn.Name,
-						"app.kubernetes.io/managed-by": "kube-serverless",
+					Labels: w.labels(fn),
+					// Code is mounted from a ConfigMap, so a hash of it
+					// rolls the pods when only the code changes.
+					Annotations: map[string]string{
+						codeHashAnnotation: revisionContentOf(&fn.FunctionSpec).hash(),
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -281,54 +555,38 @@ func (k *KubernetesClient) createFunctionDeployment(ctx context.Context, fn *Fun
 								},
 							},
 							Env: k.buildEnvVars(fn),
-							VolumeMounts: []corev1.VolumeMount{
+							VolumeMounts: append([]corev1.VolumeMount{
 								{
 									Name:      "function-code",
 									MountPath: "/function",
 								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse("100m"),
-									corev1.ResourceMemory: resource.MustParse("128Mi"),
-								},
-								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse("500m"),
-									corev1.ResourceMemory: resource.MustParse("512Mi"),
-								},
-							},
+							}, secretMounts...),
+							Resources: resourceRequirements(fn.Resources),
 						},
 					},
-					Volumes: []corev1.Volume{
+					Volumes: append([]corev1.Volume{
 						{
 							Name: "function-code",
 							VolumeSource: corev1.VolumeSource{
-								ConfigMap: &corev1.ConfigMapVolumeSource{
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: fn.Name + "-code",
-									},
-								},
+								ConfigMap: codeVolume,
 							},
 						},
-					},
+					}, secretVolumes...),
 				},
 			},
 		},
 	}
-
-	_, err := k.clientset.AppsV1().Deployments(k.namespace).Create(ctx, deployment, metav1.CreateOptions{})
-	return err
 }
 
-func (k *KubernetesClient) createFunctionService(ctx context.Context, fn *Function) error {
-	service := &corev1.Service{
+func (k *KubernetesClient) functionService(fn *Function, w workload) *corev1.Service {
+	labels := w.labels(fn)
+	delete(labels, "function")
+
+	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fn.Name,
+			Name:      w.name,
 			Namespace: k.namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":       fn.Name,
-				"app.kubernetes.io/managed-by": "kube-serverless",
-			},
+			Labels:    labels,
 		},
 		Spec: corev1.ServiceSpec{
 			Type: corev1.ServiceTypeClusterIP,
@@ -340,33 +598,42 @@ func (k *KubernetesClient) createFunctionService(ctx context.Context, fn *Functi
 				},
 			},
 			Selector: map[string]string{
-				"function": fn.Name,
+				"function": w.name,
 			},
 		},
 	}
-
-	_, err := k.clientset.CoreV1().Services(k.namespace).Create(ctx, service, metav1.CreateOptions{})
-	return err
 }
 
-func (k *KubernetesClient) createFunctionHPA(ctx context.Context, fn *Function) error {
-	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+func (k *KubernetesClient) functionHPA(fn *Function, w workload) *autoscalingv2.HorizontalPodAutoscaler {
+	// The HPA cannot target fewer than one replica; scaling to zero is left
+	// to the idle scaler and the activator.
+	minReplicas := fn.MinReplicas
+	if minReplicas < 1 {
+		minReplicas = 1
+	}
+	maxReplicas := fn.MaxReplicas
+	if maxReplicas < minReplicas {
+		maxReplicas = minReplicas
+	}
+
+	labels := w.labels(fn)
+	delete(labels, "function")
+
+	policy := effectiveScalingPolicy(fn)
+	return &autoscalingv2.HorizontalPodAutoscaler{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fn.Name,
+			Name:      w.name,
 			Namespace: k.namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":       fn.Name,
-				"app.kubernetes.io/managed-by": "kube-serverless",
-			},
+			Labels:    labels,
 		},
 		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
 			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
 				APIVersion: "apps/v1",
 				Kind:       "Deployment",
-				Name:       fn.Name,
+				Name:       w.name,
 			},
-			MinReplicas: &fn.MinReplicas,
-			MaxReplicas: fn.MaxReplicas,
+			MinReplicas: &minReplicas,
+			MaxReplicas: maxReplicas,
 			Metrics: []autoscalingv2.MetricSpec{
 				{
 					Type: autoscalingv2.ResourceMetricSourceType,
@@ -374,25 +641,24 @@ func (k *KubernetesClient) createFunctionHPA(ctx context.Context, fn *Function)
 						Name: corev1.ResourceCPU,
 						Target: autoscalingv2.MetricTarget{
 							Type:               autoscalingv2.UtilizationMetricType,
-							AverageUtilization: int32Ptr(80),
+							AverageUtilization: int32Ptr(policy.Target),
 						},
 					},
 				},
 			},
+			Behavior: policy.hpaBehavior(),
 		},
 	}
+}
 
-	_, err := k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace).Create(ctx, hpa, metav1.CreateOptions{})
-	return err
+// runtimeImages maps each supported runtime to its container image.
+var runtimeImages = map[string]string{
+	"nodejs18": "node:18-alpine",
+	"python39": "python:3.9-alpine",
+	"go119":    "golang:1.19-alpine",
 }
 
 func (k *KubernetesClient) getRuntimeImage(runtime string) string {
-	runtimeImages := map[string]string{
-		"nodejs18": "node:18-alpine",
-		"python39": "python:3.9-alpine",
-		"go119":    "golang:1.19-alpine",
-	}
-
 	if image, ok := runtimeImages[runtime]; ok {
 		return image
 	}
@@ -414,43 +680,27 @@ func (k *KubernetesClient) buildEnvVars(fn *Function) []corev1.EnvVar {
 			Name:  "RUNTIME",
 			Value: fn.Runtime,
 		},
+		{
+			Name:  "FUNCTION_TIMEOUT",
+			Value: strconv.Itoa(int(effectiveTimeoutSeconds(fn))),
+		},
+	}
+
+	// Sorted so the pod template is stable across reconciles.
+	keys := make([]string, 0, len(fn.Environment))
+	for key := range fn.Environment {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	for key, value := range fn.Environment {
+	for _, key := range keys {
 		envVars = append(envVars, corev1.EnvVar{
 			Name:  key,
-			Value: value,
+			Value: fn.Environment[key],
 		})
 	}
 
-	return envVars
-}
-
-func (k *KubernetesClient) deploymentToFunction(dep *appsv1.Deployment) Function {
-	function := Function{
-		Name:    dep.Name,
-		Runtime: k.getEnvVar(dep.Spec.Template.Spec.Containers[0].Env, "RUNTIME"),
-		Handler: k.getEnvVar(dep.Spec.Template.Spec.Containers[0].Env, "FUNCTION_HANDLER"),
-		Status: FunctionStatus{
-			State:    "running",
-			Replicas: dep.Status.ReadyReplicas,
-		},
-	}
-
-	if dep.Spec.Replicas != nil {
-		function.MinReplicas = *dep.Spec.Replicas
-	}
-
-	return function
-}
-
-func (k *KubernetesClient) getEnvVar(envVars []corev1.EnvVar, name string) string {
-	for _, env := range envVars {
-		if env.Name == name {
-			return env.Value
-		}
-	}
-	return ""
+	return append(envVars, secretEnvVars(fn)...)
 }
 
 func int32Ptr(i int32) *int32 {
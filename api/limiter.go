@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// concurrencyRetryAfter is the Retry-After sent with invocations rejected
+// by a function's concurrency limit.
+const concurrencyRetryAfter = time.Second
+
+var (
+	concurrencyQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "function_concurrency_queue_length",
+			Help: "Invocations waiting for a function's concurrency limit on this API server replica",
+		},
+		[]string{"function"},
+	)
+	concurrencyRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "function_concurrency_rejections_total",
+			Help: "Invocations rejected by a function's concurrency limit",
+		},
+		[]string{"function", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(concurrencyQueueLength)
+	prometheus.MustRegister(concurrencyRejections)
+}
+
+// ConcurrencyLimiter enforces the concurrency limits of functions on this
+// API server replica. Invocations over a function's maxConcurrency wait in
+// a FIFO queue of up to maxQueueDepth for at most the platform's
+// concurrencyQueueTimeout; the others are rejected with 429 Too Many
+// Requests.
+type ConcurrencyLimiter struct {
+	config *ConfigStore
+
+	mu        sync.Mutex
+	functions map[string]*functionLimiter
+}
+
+type functionLimiter struct {
+	active int
+	// waiting are the queued invocations, oldest first. A slot is handed
+	// to one by closing its channel.
+	waiting []chan struct{}
+}
+
+func NewConcurrencyLimiter(config *ConfigStore) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		config:    config,
+		functions: make(map[string]*functionLimiter),
+	}
+}
+
+// Acquire waits for a slot to invoke a function. The returned func must be
+// called when the invocation finishes.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, function string, limits invocationLimits) (func(), error) {
+	if limits.maxConcurrency <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	f, ok := l.functions[function]
+	if !ok {
+		f = &functionLimiter{}
+		l.functions[function] = f
+	}
+	release := func() { l.release(function) }
+
+	if f.active < limits.maxConcurrency && len(f.waiting) == 0 {
+		f.active++
+		l.mu.Unlock()
+		return release, nil
+	}
+	if len(f.waiting) >= limits.maxQueueDepth {
+		l.forget(function, f)
+		l.mu.Unlock()
+		return nil, l.reject(function, "queue_full", fmt.Sprintf("function %s is at its concurrency limit of %d", function, limits.maxConcurrency))
+	}
+
+	ready := make(chan struct{})
+	f.waiting = append(f.waiting, ready)
+	concurrencyQueueLength.WithLabelValues(function).Set(float64(len(f.waiting)))
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.config.Get().ConcurrencyQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return release, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ch := range f.waiting {
+		if ch != ready {
+			continue
+		}
+		f.waiting = append(f.waiting[:i], f.waiting[i+1:]...)
+		concurrencyQueueLength.WithLabelValues(function).Set(float64(len(f.waiting)))
+		l.forget(function, f)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, l.reject(function, "queue_timeout", fmt.Sprintf("function %s is at its concurrency limit of %d, timed out waiting", function, limits.maxConcurrency))
+	}
+	// A slot was handed over while giving up.
+	return release, nil
+}
+
+// release hands the slot of a finished invocation to the oldest waiting
+// one, or frees it.
+func (l *ConcurrencyLimiter) release(function string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.functions[function]
+	if len(f.waiting) > 0 {
+		close(f.waiting[0])
+		f.waiting = f.waiting[1:]
+		concurrencyQueueLength.WithLabelValues(function).Set(float64(len(f.waiting)))
+		return
+	}
+	f.active--
+	l.forget(function, f)
+}
+
+// forget drops the state of a function without invocations. Callers hold
+// l.mu.
+func (l *ConcurrencyLimiter) forget(function string, f *functionLimiter) {
+	if f.active == 0 && len(f.waiting) == 0 {
+		delete(l.functions, function)
+		concurrencyQueueLength.DeleteLabelValues(function)
+	}
+}
+
+func (l *ConcurrencyLimiter) reject(function, reason, message string) error {
+	concurrencyRejections.WithLabelValues(function, reason).Inc()
+	err := NewAPIError(http.StatusTooManyRequests, message)
+	err.RetryAfter = concurrencyRetryAfter
+	return err
+}
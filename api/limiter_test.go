@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// heldRuntime is a runtime stand-in that holds every invocation until
+// release is closed.
+type heldRuntime struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newHeldRuntime() *heldRuntime {
+	return &heldRuntime{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (r *heldRuntime) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.started <- struct{}{}
+	select {
+	case <-r.release:
+	case <-req.Context().Done():
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// invokeHello invokes fn, served by the workload "hello", through s as the
+// invoke endpoint would.
+func invokeHello(s *Server, fn *Function) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/functions/hello/invoke", strings.NewReader(`{}`))
+	s.invoke(w, r, fn, invocationTarget{backend: "hello", revision: "1"})
+	return w
+}
+
+// startHeldInvocation starts an invocation of fn and returns once the
+// runtime received it. The returned channel yields its response.
+func startHeldInvocation(t *testing.T, s *Server, runtime *heldRuntime, fn *Function) <-chan *httptest.ResponseRecorder {
+	t.Helper()
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- invokeHello(s, fn) }()
+	select {
+	case <-runtime.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the runtime to be invoked")
+	}
+	return done
+}
+
+func TestConcurrencyLimitRejectsWithRetryAfter(t *testing.T) {
+	runtime := newHeldRuntime()
+	s := newTestServer(t, runtime)
+	fn := testFunction()
+	fn.MaxConcurrency = 1
+	rejections := concurrencyRejections.WithLabelValues("hello", "queue_full")
+	before := testutil.ToFloat64(rejections)
+
+	first := startHeldInvocation(t, s, runtime, fn)
+
+	w := invokeHello(s, fn)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("over the limit: status %d, Retry-After %q, want 429 and 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(rejections) - before; got != 1 {
+		t.Errorf("%v rejections counted, want 1", got)
+	}
+
+	close(runtime.release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("first invocation: status %d, want 200", w.Code)
+	}
+}
+
+func TestConcurrencyLimitQueuesInvocations(t *testing.T) {
+	runtime := newHeldRuntime()
+	s := newTestServer(t, runtime)
+	fn := testFunction()
+	fn.MaxConcurrency = 1
+	fn.MaxQueueDepth = 1
+
+	first := startHeldInvocation(t, s, runtime, fn)
+
+	queued := make(chan *httptest.ResponseRecorder, 1)
+	go func() { queued <- invokeHello(s, fn) }()
+	queueLength := concurrencyQueueLength.WithLabelValues("hello")
+	eventually(t, "the second invocation to be queued", func() bool { return testutil.ToFloat64(queueLength) == 1 })
+
+	if w := invokeHello(s, fn); w.Code != http.StatusTooManyRequests {
+		t.Errorf("with a full queue: status %d, want 429", w.Code)
+	}
+
+	close(runtime.release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("first invocation: status %d, want 200", w.Code)
+	}
+	if w := <-queued; w.Code != http.StatusOK {
+		t.Errorf("queued invocation: status %d, want 200", w.Code)
+	}
+}
+
+func TestConcurrencyLimitQueueTimeout(t *testing.T) {
+	runtime := newHeldRuntime()
+	s := newTestServer(t, runtime)
+	cfg := s.config.Get()
+	cfg.ConcurrencyQueueTimeout = 50 * time.Millisecond
+	s.config.Set(cfg)
+	fn := testFunction()
+	fn.MaxConcurrency = 1
+	fn.MaxQueueDepth = 1
+
+	first := startHeldInvocation(t, s, runtime, fn)
+
+	w := invokeHello(s, fn)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("after the queue timeout: status %d, Retry-After %q, want 429 and 1", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(runtime.release)
+	<-first
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -27,7 +30,7 @@ var (
 			Name: "function_invocations_total",
 			Help: "Total number of function invocations",
 		},
-		[]string{"function"},
+		[]string{"function", "revision"},
 	)
 	functionDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -35,14 +38,21 @@ var (
 			Help:    "Function execution duration in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"function"},
+		[]string{"function", "revision"},
 	)
 	coldStarts = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "function_cold_starts_total",
 			Help: "Total number of cold starts",
 		},
-		[]string{"function"},
+		[]string{"function", "revision"},
+	)
+	functionTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "function_timeouts_total",
+			Help: "Total number of invocations that exceeded the function's timeout",
+		},
+		[]string{"function", "revision"},
 	)
 )
 
@@ -51,26 +61,91 @@ func init() {
 	prometheus.MustRegister(functionInvocations)
 	prometheus.MustRegister(functionDuration)
 	prometheus.MustRegister(coldStarts)
+	prometheus.MustRegister(functionTimeouts)
 }
 
+// timeoutGrace is how much longer than a function's timeout the API server
+// waits for its response, so that runtimes enforcing FUNCTION_TIMEOUT answer
+// first.
+const timeoutGrace = 2 * time.Second
+
 type Server struct {
 	k8sClient *KubernetesClient
+	config    *ConfigStore
+	activator *Activator
+	scaler    *IdleScaler
+	limiter   *ConcurrencyLimiter
+	async     *AsyncInvoker
 	port      string
+	// gatewayPort serves functions on their http trigger paths; empty
+	// disables the gateway.
+	gatewayPort string
+	// internalPort serves other API server replicas, such as the
+	// autoscaler collecting load. No Service exposes it.
+	internalPort string
 }
 
-func NewServer(port string) (*Server, error) {
-	k8sClient, err := NewKubernetesClient()
+func NewServer(port, gatewayPort, internalPort string, clientOpts ClientOptions) (*Server, error) {
+	config := NewConfigStore()
+
+	k8sClient, err := NewKubernetesClient(clientOpts, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
 	}
 
 	return &Server{
-		k8sClient: k8sClient,
-		port:      port,
+		k8sClient:    k8sClient,
+		config:       config,
+		activator:    NewActivator(k8sClient, config),
+		scaler:       NewIdleScaler(k8sClient, config),
+		limiter:      NewConcurrencyLimiter(config),
+		port:         port,
+		gatewayPort:  gatewayPort,
+		internalPort: internalPort,
 	}, nil
 }
 
 func (s *Server) Start() error {
+	ctx := context.Background()
+
+	// Platform config and scale-to-zero
+	s.k8sClient.WatchPlatformConfig(ctx, s.config)
+	go s.scaler.Run(ctx)
+
+	// Asynchronous invocations, sized from the loaded platform config
+	identity, err := replicaIdentity()
+	if err != nil {
+		return err
+	}
+	invoke := func(ctx context.Context, name string, target invocationTarget, limits invocationLimits, inv *InvocationRequest) (*InvocationResponse, error) {
+		resp, _, err := s.execute(ctx, name, target, limits, inv)
+		return resp, err
+	}
+	s.async = NewAsyncInvoker(s.k8sClient, invoke, s.config, identity)
+	go s.async.Run(ctx)
+
+	// Event sources of triggers, and the Function CRD controller, which
+	// runs the leader-only ones and the autoscaler while it leads
+	triggers := NewTriggerManager(NewDelivery(s))
+	go triggers.Run(ctx)
+	go func() {
+		autoscaler := NewAutoscaler(s.k8sClient, s.config, s.collectLoad)
+		newController := func() *Controller { return NewController(s.k8sClient, triggers, autoscaler) }
+		if err := RunControllerWithLeaderElection(ctx, s.k8sClient, newController, 2); err != nil {
+			log.Printf("Controller stopped: %v", err)
+		}
+	}()
+
+	// Load seen by this replica, collected by the autoscaler
+	internal := mux.NewRouter()
+	internal.HandleFunc("/internal/load", s.loadHandler).Methods("GET")
+	go func() {
+		log.Printf("Starting internal server on port %s", s.internalPort)
+		if err := newHTTPServer(":"+s.internalPort, internal).ListenAndServe(); err != nil {
+			log.Fatalf("Failed to start internal server: %v", err)
+		}
+	}()
+
 	r := mux.NewRouter()
 
 	// Health endpoints
@@ -80,21 +155,70 @@ func (s *Server) Start() error {
 	// Function management
 	r.HandleFunc("/api/v1/functions", s.listFunctionsHandler).Methods("GET")
 	r.HandleFunc("/api/v1/functions", s.createFunctionHandler).Methods("POST")
+	r.HandleFunc("/api/v1/functions:validate", s.validateFunctionHandler).Methods("POST")
 	r.HandleFunc("/api/v1/functions/{name}", s.getFunctionHandler).Methods("GET")
 	r.HandleFunc("/api/v1/functions/{name}", s.updateFunctionHandler).Methods("PUT")
 	r.HandleFunc("/api/v1/functions/{name}", s.deleteFunctionHandler).Methods("DELETE")
 
+	// Revisions
+	r.HandleFunc("/api/v1/functions/{name}/revisions", s.listRevisionsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/functions/{name}/rollback", s.rollbackFunctionHandler).Methods("POST")
+
+	// Aliases
+	r.HandleFunc("/api/v1/functions/{name}/aliases", s.listAliasesHandler).Methods("GET")
+	r.HandleFunc("/api/v1/functions/{name}/aliases/{alias}", s.getAliasHandler).Methods("GET")
+	r.HandleFunc("/api/v1/functions/{name}/aliases/{alias}", s.setAliasHandler).Methods("PUT")
+	r.HandleFunc("/api/v1/functions/{name}/aliases/{alias}", s.deleteAliasHandler).Methods("DELETE")
+
 	// Function invocation
 	r.HandleFunc("/api/v1/functions/{name}/invoke", s.invokeFunctionHandler).Methods("POST")
+	r.HandleFunc("/api/v1/functions/{name}/aliases/{alias}/invoke", s.invokeAliasHandler).Methods("POST")
+
+	r.HandleFunc("/api/v1/invocations/{id}", s.getInvocationHandler).Methods("GET")
+
+	// Triggers
+	r.HandleFunc("/api/v1/functions/{name}/triggers/{trigger}/runs", s.listTriggerRunsHandler).Methods("GET")
+
+	// Dead letters
+	r.HandleFunc("/api/v1/functions/{name}/deadletters", s.listDeadLettersHandler).Methods("GET")
+	r.HandleFunc("/api/v1/functions/{name}/deadletters/{id}", s.getDeadLetterHandler).Methods("GET")
+	r.HandleFunc("/api/v1/functions/{name}/deadletters/{id}", s.deleteDeadLetterHandler).Methods("DELETE")
+	r.HandleFunc("/api/v1/functions/{name}/deadletters/{id}/redrive", s.redriveDeadLetterHandler).Methods("POST")
+
+	// Secrets
+	r.HandleFunc("/api/v1/secrets", s.listSecretsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/secrets", s.createSecretHandler).Methods("POST")
+	r.HandleFunc("/api/v1/secrets/{name}", s.getSecretHandler).Methods("GET")
+	r.HandleFunc("/api/v1/secrets/{name}", s.deleteSecretHandler).Methods("DELETE")
 
 	// Metrics
 	r.HandleFunc("/api/v1/functions/{name}/metrics", s.functionMetricsHandler).Methods("GET")
 
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, NewAPIError(http.StatusNotFound, "no route for "+r.URL.Path))
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, NewAPIError(http.StatusMethodNotAllowed, r.Method+" not allowed on "+r.URL.Path))
+	})
+
 	// CORS middleware
 	r.Use(corsMiddleware)
 
 	log.Printf("Starting API server on port %s", s.port)
-	return http.ListenAndServe(":"+s.port, r)
+	return newHTTPServer(":"+s.port, r).ListenAndServe()
+}
+
+// newHTTPServer returns a server that drops clients too slow to send their
+// request or idle too long. It sets no write timeout: invocations are
+// bounded by their function's timeoutSeconds instead.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
 }
 
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -114,7 +238,7 @@ func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) listFunctionsHandler(w http.ResponseWriter, r *http.Request) {
 	functions, err := s.k8sClient.ListFunctions(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -125,13 +249,13 @@ func (s *Server) listFunctionsHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) createFunctionHandler(w http.ResponseWriter, r *http.Request) {
 	var function Function
 	if err := json.NewDecoder(r.Body).Decode(&function); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, badRequest(err))
 		return
 	}
 
 	if err := s.k8sClient.CreateFunction(r.Context(), &function); err != nil {
 		functionDeployments.WithLabelValues(function.Name, "failed").Inc()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -142,13 +266,34 @@ func (s *Server) createFunctionHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(function)
 }
 
+// validateFunctionHandler checks a function spec without deploying it.
+func (s *Server) validateFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	var function Function
+	if err := json.NewDecoder(r.Body).Decode(&function); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	s.k8sClient.applyDefaults(&function)
+	if err := ValidateFunction(&function); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.k8sClient.checkResourceBounds(&function); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"valid": true})
+}
+
 func (s *Server) getFunctionHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
 	function, err := s.k8sClient.GetFunction(r.Context(), name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 
@@ -162,7 +307,7 @@ func (s *Server) updateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 
 	var function Function
 	if err := json.NewDecoder(r.Body).Decode(&function); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, badRequest(err))
 		return
 	}
 
@@ -170,7 +315,7 @@ func (s *Server) updateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := s.k8sClient.UpdateFunction(r.Context(), &function); err != nil {
 		functionDeployments.WithLabelValues(function.Name, "failed").Inc()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -185,31 +330,351 @@ func (s *Server) deleteFunctionHandler(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 
 	if err := s.k8sClient.DeleteFunction(r.Context(), name); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) listRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	revisions, err := s.k8sClient.ListRevisions(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, revisions)
+}
+
+// rollbackFunctionHandler restores the revision given by the "to" query
+// parameter, or the previous revision when it is omitted.
+func (s *Server) rollbackFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var to int64
+	if v := r.URL.Query().Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeError(w, NewAPIError(http.StatusBadRequest, fmt.Sprintf("invalid revision %q", v)))
+			return
+		}
+		to = n
+	}
+
+	function, err := s.k8sClient.RollbackFunction(r.Context(), name, to)
+	if err != nil {
+		functionDeployments.WithLabelValues(name, "failed").Inc()
+		writeError(w, err)
+		return
+	}
+
+	functionDeployments.WithLabelValues(name, "success").Inc()
+	writeJSON(w, http.StatusOK, function)
+}
+
 func (s *Server) invokeFunctionHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
+	fn, err := s.k8sClient.GetFunction(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.invoke(w, r, fn, routeInvocation(fn))
+}
+
+// invokeAliasHandler invokes the revision an alias points at.
+func (s *Server) invokeAliasHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	fn, err := s.k8sClient.GetFunction(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	target, err := aliasTarget(fn, vars["alias"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.invoke(w, r, fn, target)
+}
+
+// invoke forwards an invocation of fn to the workload chosen for it, or
+// queues it when the caller asked for an asynchronous invocation.
+func (s *Server) invoke(w http.ResponseWriter, r *http.Request, fn *Function, target invocationTarget) {
+	if isAsyncInvocation(r) {
+		s.invokeAsync(w, r, fn, target)
+		return
+	}
+
+	inv, err := NewInvocationRequest(r)
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	resp, coldStart, err := s.execute(r.Context(), fn.Name, target, invocationLimitsOf(fn), inv)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if coldStart {
+		w.Header().Set("X-Cold-Start", "true")
+	}
+	w.Header().Set("X-Function-Revision", target.revision)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+// execute runs an invocation on the target workload once the function's
+// concurrency limits allow, waking the workload up first if it is scaled to
+// zero, and gives up when the function's timeout passes. It reports whether
+// the invocation hit a cold start.
+func (s *Server) execute(ctx context.Context, name string, target invocationTarget, limits invocationLimits, inv *InvocationRequest) (*InvocationResponse, bool, error) {
+	// Invocations waiting for a slot count as load for the scalers.
+	done := s.scaler.Begin(target.backend)
+	defer done()
+
+	release, err := s.limiter.Acquire(ctx, name, limits)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
 	start := time.Now()
-	functionInvocations.WithLabelValues(name).Inc()
+	functionInvocations.WithLabelValues(name, target.revision).Inc()
 
-	result, err := s.k8sClient.InvokeFunction(r.Context(), name, r.Body)
+	coldStart, err := s.activator.Activate(ctx, name, target)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, coldStart, err
+	}
+
+	// The timeout starts once the function is ready, so a cold start does
+	// not count against it.
+	invokeCtx, cancel := context.WithTimeout(ctx, limits.timeout+timeoutGrace)
+	defer cancel()
+
+	resp, err := s.k8sClient.InvokeFunction(invokeCtx, target.backend, inv)
+	if err != nil {
+		if ctx.Err() == nil && invokeCtx.Err() == context.DeadlineExceeded {
+			functionTimeouts.WithLabelValues(name, target.revision).Inc()
+			return nil, coldStart, NewAPIError(http.StatusGatewayTimeout,
+				fmt.Sprintf("function %s did not respond within its timeout of %s", name, limits.timeout))
+		}
+		return nil, coldStart, err
+	}
+
+	functionDuration.WithLabelValues(name, target.revision).Observe(time.Since(start).Seconds())
+	return resp, coldStart, nil
+}
+
+func (s *Server) listAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	aliases, err := s.k8sClient.ListAliases(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	duration := time.Since(start).Seconds()
-	functionDuration.WithLabelValues(name).Observe(duration)
+	writeJSON(w, http.StatusOK, aliases)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(result)
+func (s *Server) getAliasHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	alias, err := s.k8sClient.GetAlias(r.Context(), vars["name"], vars["alias"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, alias)
+}
+
+// setAliasHandler creates an alias or moves it to another revision.
+func (s *Server) setAliasHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var body struct {
+		Revision int64 `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	alias, err := s.k8sClient.SetAlias(r.Context(), vars["name"], vars["alias"], body.Revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, alias)
+}
+
+func (s *Server) deleteAliasHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := s.k8sClient.DeleteAlias(r.Context(), vars["name"], vars["alias"]); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listTriggerRunsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	runs, err := s.k8sClient.ListTriggerRuns(r.Context(), vars["name"], vars["trigger"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func (s *Server) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	deadLetters, err := s.k8sClient.ListDeadLetters(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deadLetters)
+}
+
+func (s *Server) getDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	dl, err := s.k8sClient.GetDeadLetter(r.Context(), vars["name"], vars["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dl)
+}
+
+func (s *Server) deleteDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := s.k8sClient.DeleteDeadLetter(r.Context(), vars["name"], vars["id"]); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redriveDeadLetterHandler queues the request of a dead letter again as an
+// asynchronous invocation of the function's current traffic split. The dead
+// letter is removed once the invocation is queued; if it fails again a new
+// dead letter is stored.
+func (s *Server) redriveDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["id"]
+
+	fn, err := s.k8sClient.GetFunction(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	dl, err := s.k8sClient.GetDeadLetter(r.Context(), name, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	inv, err := dl.invocationRequest()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	record, err := s.async.Enqueue(fn, SourceRedrive, routeInvocation(fn), inv)
+	if err != nil {
+		if errors.Is(err, errAsyncQueueFull) {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeError(w, err)
+		return
+	}
+
+	if err := s.k8sClient.DeleteDeadLetter(r.Context(), name, id); err != nil {
+		log.Printf("Failed to delete re-driven dead letter %s of %s: %v", id, name, err)
+	}
+
+	w.Header().Set("Location", "/api/v1/invocations/"+record.ID)
+	writeJSON(w, http.StatusAccepted, record)
+}
+
+func (s *Server) listSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	secrets, err := s.k8sClient.ListSecrets(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, secrets)
+}
+
+// createSecretHandler stores a secret. The response, like every other
+// secret response, lists its keys but never its values.
+func (s *Server) createSecretHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateSecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	secret, err := s.k8sClient.CreateSecret(r.Context(), &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, secret)
+}
+
+func (s *Server) getSecretHandler(w http.ResponseWriter, r *http.Request) {
+	secret, err := s.k8sClient.GetSecret(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, secret)
+}
+
+func (s *Server) deleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.k8sClient.DeleteSecret(r.Context(), mux.Vars(r)["name"]); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) functionMetricsHandler(w http.ResponseWriter, r *http.Request) {
@@ -218,7 +683,7 @@ func (s *Server) functionMetricsHandler(w http.ResponseWriter, r *http.Request)
 
 	metrics, err := s.k8sClient.GetFunctionMetrics(r.Context(), name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -230,7 +695,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Invocation-Type")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -244,12 +709,17 @@ func corsMiddleware(next http.Handler) http.Handler {
 func startMetricsServer(port string) {
 	http.Handle("/metrics", promhttp.Handler())
 	log.Printf("Starting metrics server on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := newHTTPServer(":"+port, nil).ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start metrics server: %v", err)
 	}
 }
 
 func main() {
+	var clientOpts ClientOptions
+	flag.StringVar(&clientOpts.Kubeconfig, "kubeconfig", "", "path to a kubeconfig file, for running outside the cluster (defaults to KUBECONFIG, then ~/.kube/config)")
+	flag.StringVar(&clientOpts.Context, "context", "", "kubeconfig context to use (defaults to the current context)")
+	flag.Parse()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -260,10 +730,21 @@ func main() {
 		metricsPort = "9090"
 	}
 
+	// The gateway is on unless GATEWAY_PORT is set to an empty value.
+	gatewayPort, ok := os.LookupEnv("GATEWAY_PORT")
+	if !ok {
+		gatewayPort = "8081"
+	}
+
+	internalPort := os.Getenv("INTERNAL_PORT")
+	if internalPort == "" {
+		internalPort = "8082"
+	}
+
 	// Start metrics server in background
 	go startMetricsServer(metricsPort)
 
-	server, err := NewServer(port)
+	server, err := NewServer(port, gatewayPort, internalPort, clientOpts)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
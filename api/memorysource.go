@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// MemorySource is an event source whose events are published in process
+// with Publish. It exists for tests and for trying out triggers without a
+// broker, so it is not registered by default: register one with
+// RegisterEventSource(NewMemorySource("memory")) before the trigger manager
+// is created. Its triggers take an optional contentType config.
+type MemorySource struct {
+	typ string
+
+	mu        sync.Mutex
+	delivery  *Delivery
+	functions map[string]*Function
+}
+
+func NewMemorySource(typ string) *MemorySource {
+	return &MemorySource{
+		typ:       typ,
+		functions: make(map[string]*Function),
+	}
+}
+
+func (m *MemorySource) Type() string { return m.typ }
+
+func (m *MemorySource) LeaderOnly() bool { return false }
+
+func (m *MemorySource) Validate(errs *ValidationErrors, field string, config map[string]string) {
+	if contentType := config["contentType"]; contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			errs.add(field+".contentType", "invalid media type: %v", err)
+		}
+	}
+}
+
+func (m *MemorySource) Start(ctx context.Context, delivery *Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delivery = delivery
+	return nil
+}
+
+func (m *MemorySource) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delivery = nil
+	m.functions = make(map[string]*Function)
+}
+
+func (m *MemorySource) Sync(fn *Function) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(triggersOfType(fn, m.typ)) == 0 {
+		delete(m.functions, fn.Name)
+		return
+	}
+	m.functions[fn.Name] = fn
+}
+
+func (m *MemorySource) Remove(function string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.functions, function)
+}
+
+// Triggers returns the names of the synced triggers of a function, sorted.
+func (m *MemorySource) Triggers(function string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fn, ok := m.functions[function]
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, trigger := range triggersOfType(fn, m.typ) {
+		names = append(names, trigger.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Publish invokes a function with an event of one of its triggers and
+// returns the function's response.
+func (m *MemorySource) Publish(ctx context.Context, function, trigger string, body []byte) (*InvocationResponse, error) {
+	m.mu.Lock()
+	delivery, fn := m.delivery, m.functions[function]
+	m.mu.Unlock()
+
+	if delivery == nil {
+		return nil, fmt.Errorf("%s source is not running", m.typ)
+	}
+	if fn == nil {
+		return nil, fmt.Errorf("function %s has no %s triggers", function, m.typ)
+	}
+
+	for _, t := range triggersOfType(fn, m.typ) {
+		if t.name != trigger {
+			continue
+		}
+		contentType := t.config["contentType"]
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		return delivery.Invoke(ctx, fn, &InvocationRequest{
+			Method: http.MethodPost,
+			Header: http.Header{"Content-Type": []string{contentType}},
+			Query:  url.Values{},
+			Body:   body,
+		})
+	}
+	return nil, fmt.Errorf("function %s has no %s trigger %s", function, m.typ, trigger)
+}
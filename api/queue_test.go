@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker is an in-process stand-in for an AMQP 0-9-1 broker. It routes
+// by exact binding key, dead-letters rejected messages through the queue's
+// x-dead-letter-exchange and confirms publishes on channels in confirm
+// mode.
+type fakeBroker struct {
+	mu       sync.Mutex
+	bindings map[string][]fakeBinding
+	queues   map[string]*fakeQueue
+	unacked  map[uint64]fakeMessage
+	nextTag  uint64
+	// refusePublishes is how many confirmed publishes the broker nacks.
+	refusePublishes int
+}
+
+type fakeBinding struct {
+	key   string
+	queue string
+}
+
+type fakeQueue struct {
+	args      amqp.Table
+	ready     chan amqp.Delivery
+	consuming bool
+}
+
+type fakeMessage struct {
+	queue    string
+	delivery amqp.Delivery
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		bindings: make(map[string][]fakeBinding),
+		queues:   make(map[string]*fakeQueue),
+		unacked:  make(map[uint64]fakeMessage),
+	}
+}
+
+func (b *fakeBroker) dial(string) (queueConnection, error) {
+	return fakeConnection{b}, nil
+}
+
+// publish routes a message to the queues bound to exchange with key; the
+// default exchange routes to the queue named key.
+func (b *fakeBroker) publish(exchange, key string, msg amqp.Publishing) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishLocked(exchange, key, msg)
+}
+
+func (b *fakeBroker) publishLocked(exchange, key string, msg amqp.Publishing) {
+	delivery := amqp.Delivery{
+		Headers:       msg.Headers,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  msg.DeliveryMode,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		Exchange:      exchange,
+		RoutingKey:    key,
+		Body:          msg.Body,
+	}
+	if exchange == "" {
+		b.enqueueLocked(key, delivery)
+		return
+	}
+	for _, binding := range b.bindings[exchange] {
+		if binding.key == key {
+			b.enqueueLocked(binding.queue, delivery)
+		}
+	}
+}
+
+func (b *fakeBroker) enqueueLocked(queue string, delivery amqp.Delivery) {
+	q, ok := b.queues[queue]
+	if !ok {
+		return
+	}
+	b.nextTag++
+	delivery.DeliveryTag = b.nextTag
+	delivery.Acknowledger = b
+	b.unacked[delivery.DeliveryTag] = fakeMessage{queue: queue, delivery: delivery}
+	q.ready <- delivery
+}
+
+func (b *fakeBroker) Ack(tag uint64, multiple bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.unacked[tag]; !ok {
+		return errors.New("unknown delivery tag")
+	}
+	delete(b.unacked, tag)
+	return nil
+}
+
+func (b *fakeBroker) Nack(tag uint64, multiple, requeue bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, ok := b.unacked[tag]
+	if !ok {
+		return errors.New("unknown delivery tag")
+	}
+	delete(b.unacked, tag)
+
+	if requeue {
+		msg.delivery.Redelivered = true
+		b.enqueueLocked(msg.queue, msg.delivery)
+		return nil
+	}
+	args := b.queues[msg.queue].args
+	if exchange, ok := args["x-dead-letter-exchange"].(string); ok {
+		key, _ := args["x-dead-letter-routing-key"].(string)
+		b.publishLocked(exchange, key, amqp.Publishing{
+			Headers:     msg.delivery.Headers,
+			ContentType: msg.delivery.ContentType,
+			Body:        msg.delivery.Body,
+		})
+	}
+	return nil
+}
+
+func (b *fakeBroker) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
+
+// ready returns the messages waiting in a queue.
+func (b *fakeBroker) ready(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0
+	}
+	return len(q.ready)
+}
+
+func (b *fakeBroker) consuming(queue string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	return ok && q.consuming
+}
+
+func (b *fakeBroker) outstanding() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.unacked)
+}
+
+type fakeConnection struct{ broker *fakeBroker }
+
+func (c fakeConnection) Channel() (queueChannel, error) { return &fakeChannel{broker: c.broker}, nil }
+func (c fakeConnection) IsClosed() bool                 { return false }
+func (c fakeConnection) Close() error                   { return nil }
+
+type fakeChannel struct {
+	broker     *fakeBroker
+	confirming bool
+}
+
+func (c *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[name]; !ok {
+		b.queues[name] = &fakeQueue{args: args, ready: make(chan amqp.Delivery, 100)}
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bindings[exchange] = append(b.bindings[exchange], fakeBinding{key: key, queue: name})
+	return nil
+}
+
+func (c *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error { return nil }
+
+func (c *fakeChannel) Confirm(noWait bool) error {
+	c.confirming = true
+	return nil
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, errors.New("no queue " + queue)
+	}
+	q.consuming = true
+	return q.ready, nil
+}
+
+func (c *fakeChannel) PublishConfirmed(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if !c.confirming {
+		return errors.New("channel is not in confirm mode")
+	}
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.refusePublishes > 0 {
+		b.refusePublishes--
+		return errPublishNacked
+	}
+	b.publishLocked(exchange, key, msg)
+	return nil
+}
+
+func (c *fakeChannel) Close() error { return nil }
+
+// queueRuntime is a runtime stand-in that answers with the statuses in
+// order, then with 200, and records the bodies it was invoked with.
+type queueRuntime struct {
+	statuses []int
+	calls    atomic.Int32
+
+	mu     sync.Mutex
+	bodies []string
+	header http.Header
+}
+
+func (r *queueRuntime) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.bodies = append(r.bodies, string(body))
+	r.header = req.Header.Clone()
+	r.mu.Unlock()
+
+	status := http.StatusOK
+	if n := int(r.calls.Add(1)); n <= len(r.statuses) {
+		status = r.statuses[n-1]
+	}
+	w.WriteHeader(status)
+}
+
+// startQueueDispatcher runs a dispatcher against broker with a queue
+// trigger of the function "hello" served by runtime.
+func startQueueDispatcher(t *testing.T, broker *fakeBroker, runtime http.Handler, config map[string]string) {
+	t.Helper()
+
+	server := newTestServer(t, runtime)
+
+	d := NewQueueDispatcher()
+	d.brokerURL = "amqp://broker.test"
+	d.dial = broker.dial
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		d.Stop()
+		cancel()
+	})
+	if err := d.Start(ctx, NewDelivery(server)); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := testFunction()
+	fn.Triggers = []Trigger{{Type: "queue", Config: config}}
+	d.Sync(fn)
+	eventually(t, "the trigger to consume", func() bool { return broker.consuming(config["queue"]) })
+}
+
+func TestQueueDispatcherAcksHandledMessages(t *testing.T) {
+	broker := newFakeBroker()
+	runtime := &queueRuntime{}
+	startQueueDispatcher(t, broker, runtime, map[string]string{"queue": "orders"})
+
+	broker.publish(defaultQueueExchange, "function.hello", amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   "m-1",
+		Body:        []byte(`{"order":1}`),
+	})
+
+	eventually(t, "the message to be acked", func() bool { return runtime.calls.Load() == 1 && broker.outstanding() == 0 })
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+	if runtime.bodies[0] != `{"order":1}` {
+		t.Errorf("body = %q", runtime.bodies[0])
+	}
+	if runtime.header.Get("X-Queue") != "orders" || runtime.header.Get("X-Message-Id") != "m-1" {
+		t.Errorf("headers = %v", runtime.header)
+	}
+}
+
+func TestQueueDispatcherDeadLettersAfterMaxRedeliveries(t *testing.T) {
+	broker := newFakeBroker()
+	runtime := &queueRuntime{statuses: []int{500, 500, 500, 500, 500}}
+	startQueueDispatcher(t, broker, runtime, map[string]string{"queue": "orders", "maxRedeliveries": "2"})
+
+	broker.publish(defaultQueueExchange, "function.hello", amqp.Publishing{Body: []byte(`{"order":2}`)})
+
+	eventually(t, "the message to be dead-lettered", func() bool { return broker.ready("orders.dead") == 1 })
+	if calls := runtime.calls.Load(); calls != 3 {
+		t.Errorf("invocations = %d, want 3", calls)
+	}
+	if n := broker.ready("orders"); n != 0 {
+		t.Errorf("%d messages left in the queue", n)
+	}
+}
+
+func TestQueueDispatcherDeadLettersNonRetryableFailures(t *testing.T) {
+	broker := newFakeBroker()
+	runtime := &queueRuntime{statuses: []int{http.StatusNotImplemented}}
+	startQueueDispatcher(t, broker, runtime, map[string]string{"queue": "orders"})
+
+	broker.publish(defaultQueueExchange, "function.hello", amqp.Publishing{Body: []byte(`not json`)})
+
+	eventually(t, "the message to be dead-lettered", func() bool { return broker.ready("orders.dead") == 1 })
+	if calls := runtime.calls.Load(); calls != 1 {
+		t.Errorf("invocations = %d, want 1", calls)
+	}
+}
+
+func TestQueueDispatcherKeepsUnconfirmedRetries(t *testing.T) {
+	broker := newFakeBroker()
+	broker.refusePublishes = 1
+	runtime := &queueRuntime{statuses: []int{503}}
+	startQueueDispatcher(t, broker, runtime, map[string]string{"queue": "orders"})
+
+	broker.publish(defaultQueueExchange, "function.hello", amqp.Publishing{Body: []byte(`{"order":3}`)})
+
+	// The refused copy must not cost the message: the original is put
+	// back and handled on redelivery.
+	eventually(t, "the message to be handled", func() bool { return runtime.calls.Load() == 2 && broker.outstanding() == 0 })
+	if n := broker.ready("orders.dead"); n != 0 {
+		t.Errorf("%d messages dead-lettered", n)
+	}
+	runtime.mu.Lock()
+	defer runtime.mu.Unlock()
+	if runtime.bodies[1] != `{"order":3}` {
+		t.Errorf("redelivered body = %q", runtime.bodies[1])
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// functionObject identifies an object created for a function.
+type functionObject struct {
+	kind string
+	name string
+}
+
+// ApplyFunction creates or updates the ConfigMap, Deployment, Service and
+// HPA of a function so they match its spec, along with a Deployment,
+// Service and HPA for every revision its traffic split or aliases pin, and
+// deletes those of revisions no longer pinned. Functions the autoscaler
+// scales get no HPA. Objects are owned by owner when it is set, so they are
+// garbage collected with the Function resource.
+func (k *KubernetesClient) ApplyFunction(ctx context.Context, fn *Function, owner *metav1.OwnerReference) error {
+	_, err := k.applyFunction(ctx, fn, owner)
+	return err
+}
+
+// applyFunction is ApplyFunction, additionally reporting the objects that
+// did not exist before and were created by this call, so that a failed
+// create can be rolled back.
+func (k *KubernetesClient) applyFunction(ctx context.Context, fn *Function, owner *metav1.OwnerReference) ([]functionObject, error) {
+	var created []functionObject
+
+	step := func(kind, name string, apply func() (bool, error)) error {
+		return applyWithRetry(func() error {
+			isNew, err := apply()
+			if isNew {
+				created = append(created, functionObject{kind: kind, name: name})
+			}
+			return err
+		})
+	}
+
+	cm := k.functionConfigMap(fn)
+	setOwner(&cm.ObjectMeta, owner)
+	if err := step("configmap", cm.Name, func() (bool, error) { return k.applyConfigMap(ctx, cm) }); err != nil {
+		return created, fmt.Errorf("configmap %s: %w", cm.Name, err)
+	}
+
+	applyWorkload := func(fn *Function, w workload) error {
+		deployment := k.functionDeployment(fn, w)
+		setOwner(&deployment.ObjectMeta, owner)
+		if err := step("deployment", deployment.Name, func() (bool, error) { return k.applyDeployment(ctx, deployment) }); err != nil {
+			return fmt.Errorf("deployment %s: %w", deployment.Name, err)
+		}
+
+		service := k.functionService(fn, w)
+		setOwner(&service.ObjectMeta, owner)
+		if err := step("service", service.Name, func() (bool, error) { return k.applyService(ctx, service) }); err != nil {
+			return fmt.Errorf("service %s: %w", service.Name, err)
+		}
+
+		// Functions scaled on concurrency or rps are scaled by the
+		// autoscaler, which an HPA would fight.
+		if effectiveScalingPolicy(fn).autoscaled() {
+			if err := k.deleteHPA(ctx, w.name); err != nil {
+				return fmt.Errorf("hpa %s: %w", w.name, err)
+			}
+			return nil
+		}
+
+		hpa := k.functionHPA(fn, w)
+		setOwner(&hpa.ObjectMeta, owner)
+		if err := step("hpa", hpa.Name, func() (bool, error) { return k.applyHPA(ctx, hpa) }); err != nil {
+			return fmt.Errorf("hpa %s: %w", hpa.Name, err)
+		}
+		return nil
+	}
+
+	if err := applyWorkload(fn, mainWorkload(fn)); err != nil {
+		return created, err
+	}
+
+	// Revisions pinned by the traffic split or aliases run side by side
+	// with the main workload.
+	for _, revision := range pinnedRevisions(fn) {
+		rfn, err := k.revisionFunction(ctx, fn, revision)
+		if err != nil {
+			return created, fmt.Errorf("revision %d: %w", revision, err)
+		}
+		if err := applyWorkload(rfn, revisionWorkload(fn.Name, revision)); err != nil {
+			return created, err
+		}
+	}
+
+	stale, err := k.staleRevisionWorkloads(ctx, fn)
+	if err != nil {
+		return created, err
+	}
+	if err := k.deleteFunctionObjects(ctx, stale); err != nil {
+		return created, err
+	}
+
+	return created, nil
+}
+
+// deleteFunctionObjects deletes objects in reverse creation order, ignoring
+// ones that are already gone.
+func (k *KubernetesClient) deleteFunctionObjects(ctx context.Context, objects []functionObject) error {
+	var errs []error
+
+	for i := len(objects) - 1; i >= 0; i-- {
+		obj := objects[i]
+
+		var err error
+		switch obj.kind {
+		case "configmap":
+			err = k.clientset.CoreV1().ConfigMaps(k.namespace).Delete(ctx, obj.name, metav1.DeleteOptions{})
+		case "deployment":
+			err = k.clientset.AppsV1().Deployments(k.namespace).Delete(ctx, obj.name, metav1.DeleteOptions{})
+		case "service":
+			err = k.clientset.CoreV1().Services(k.namespace).Delete(ctx, obj.name, metav1.DeleteOptions{})
+		case "hpa":
+			err = k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace).Delete(ctx, obj.name, metav1.DeleteOptions{})
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("%s %s: %w", obj.kind, obj.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (k *KubernetesClient) applyConfigMap(ctx context.Context, desired *corev1.ConfigMap) (bool, error) {
+	client := k.clientset.CoreV1().ConfigMaps(k.namespace)
+
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	changed, err := mergeObjectMeta(&existing.ObjectMeta, &desired.ObjectMeta)
+	if err != nil {
+		return false, err
+	}
+	if !equality.Semantic.DeepEqual(existing.Data, desired.Data) {
+		existing.Data = desired.Data
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return false, err
+}
+
+func (k *KubernetesClient) applyDeployment(ctx context.Context, desired *appsv1.Deployment) (bool, error) {
+	client := k.clientset.AppsV1().Deployments(k.namespace)
+
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Replicas are owned by the HPA or the autoscaler, the activator and
+	// the idle scaler, so only the pod template is reconciled.
+	changed, err := mergeObjectMeta(&existing.ObjectMeta, &desired.ObjectMeta)
+	if err != nil {
+		return false, err
+	}
+	if !equality.Semantic.DeepDerivative(desired.Spec.Template, existing.Spec.Template) {
+		existing.Spec.Template = desired.Spec.Template
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return false, err
+}
+
+func (k *KubernetesClient) applyService(ctx context.Context, desired *corev1.Service) (bool, error) {
+	client := k.clientset.CoreV1().Services(k.namespace)
+
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	changed, err := mergeObjectMeta(&existing.ObjectMeta, &desired.ObjectMeta)
+	if err != nil {
+		return false, err
+	}
+	if !equality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
+		// The cluster IP is allocated by Kubernetes and immutable.
+		existing.Spec.Type = desired.Spec.Type
+		existing.Spec.Ports = desired.Spec.Ports
+		existing.Spec.Selector = desired.Spec.Selector
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return false, err
+}
+
+func (k *KubernetesClient) applyHPA(ctx context.Context, desired *autoscalingv2.HorizontalPodAutoscaler) (bool, error) {
+	client := k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace)
+
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	changed, err := mergeObjectMeta(&existing.ObjectMeta, &desired.ObjectMeta)
+	if err != nil {
+		return false, err
+	}
+	if !equality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
+		existing.Spec = desired.Spec
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return false, err
+}
+
+// deleteHPA deletes the HPA of a workload if kube-serverless manages one.
+func (k *KubernetesClient) deleteHPA(ctx context.Context, name string) error {
+	client := k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace)
+
+	existing, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Labels["app.kubernetes.io/managed-by"] != "kube-serverless" {
+		return nil
+	}
+
+	err = client.Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// applyWithRetry retries an apply step that lost a race with another
+// writer, such as the controller and an API request provisioning the same
+// function at once.
+func applyWithRetry(apply func() error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err)
+	}, apply)
+}
+
+func setOwner(meta *metav1.ObjectMeta, owner *metav1.OwnerReference) {
+	if owner != nil {
+		meta.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+}
+
+// mergeObjectMeta copies the desired labels, annotations and controller
+// reference onto an existing object and reports whether anything changed.
+// Objects not managed by kube-serverless, or controlled by something else,
+// are never adopted.
+func mergeObjectMeta(existing, desired *metav1.ObjectMeta) (bool, error) {
+	if existing.Labels["app.kubernetes.io/managed-by"] != "kube-serverless" {
+		return false, fmt.Errorf("%s exists and is not managed by kube-serverless", existing.Name)
+	}
+
+	changed := false
+
+	if desiredOwner := metav1.GetControllerOfNoCopy(desired); desiredOwner != nil {
+		existingOwner := metav1.GetControllerOfNoCopy(existing)
+		switch {
+		case existingOwner == nil:
+			existing.OwnerReferences = append(existing.OwnerReferences, *desiredOwner)
+			changed = true
+		case existingOwner.UID == desiredOwner.UID:
+		case existingOwner.Kind == desiredOwner.Kind && existingOwner.Name == desiredOwner.Name:
+			// Left behind by a deleted Function of the same name that the
+			// garbage collector has not caught up with yet.
+			existingOwner.UID = desiredOwner.UID
+			existingOwner.APIVersion = desiredOwner.APIVersion
+			changed = true
+		default:
+			return false, fmt.Errorf("%s is controlled by %s %s", existing.Name, existingOwner.Kind, existingOwner.Name)
+		}
+	}
+
+	for key, value := range desired.Labels {
+		if existing.Labels[key] != value {
+			existing.Labels[key] = value
+			changed = true
+		}
+	}
+
+	for key, value := range desired.Annotations {
+		if existing.Annotations == nil {
+			existing.Annotations = map[string]string{}
+		}
+		if existing.Annotations[key] != value {
+			existing.Annotations[key] = value
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
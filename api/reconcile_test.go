@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var errInjected = errors.New("injected failure")
+
+// newFakeClient returns a client backed by fake clientsets holding objects.
+func newFakeClient(objects ...runtime.Object) (*KubernetesClient, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	clientset := fake.NewSimpleClientset(objects...)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{functionGVR: "FunctionList"})
+	return &KubernetesClient{
+		clientset: clientset,
+		dynamic:   dynamicClient,
+		namespace: testNamespace,
+		config:    NewConfigStore(),
+	}, clientset, dynamicClient
+}
+
+// reactor is a fake clientset that reactions can be added to.
+type reactor interface {
+	PrependReactor(verb, resource string, reaction k8stesting.ReactionFunc)
+}
+
+// failCreate makes creating the named object of a resource fail, times
+// times or forever if times is negative.
+func failCreate(client reactor, resource, name string, times int) {
+	client.PrependReactor("create", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := meta.Accessor(action.(k8stesting.CreateAction).GetObject())
+		if err != nil || obj.GetName() != name || times == 0 {
+			return false, nil, nil
+		}
+		times--
+		return true, nil, errInjected
+	})
+}
+
+func testFunction() *Function {
+	return &Function{
+		Name: "hello",
+		FunctionSpec: FunctionSpec{
+			Runtime: "python39",
+			Handler: "main.handler",
+			Code:    "def handler(event):\n    return event\n",
+		},
+	}
+}
+
+// functionObjects are the objects CreateFunction provisions for
+// testFunction.
+var functionObjects = []functionObject{
+	{kind: "configmap", name: "hello-code"},
+	{kind: "deployment", name: "hello"},
+	{kind: "service", name: "hello"},
+	{kind: "hpa", name: "hello"},
+}
+
+func getFunctionObject(k *KubernetesClient, obj functionObject) (metav1.Object, error) {
+	ctx := context.Background()
+	switch obj.kind {
+	case "configmap":
+		return k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, obj.name, metav1.GetOptions{})
+	case "deployment":
+		return k.clientset.AppsV1().Deployments(k.namespace).Get(ctx, obj.name, metav1.GetOptions{})
+	case "service":
+		return k.clientset.CoreV1().Services(k.namespace).Get(ctx, obj.name, metav1.GetOptions{})
+	case "hpa":
+		return k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace).Get(ctx, obj.name, metav1.GetOptions{})
+	}
+	return nil, errors.New("unknown kind " + obj.kind)
+}
+
+func TestCreateFunctionRollsBackOnFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		object   string
+	}{
+		{"function resource", "functions", "hello"},
+		{"revision", "configmaps", "hello-rev-1"},
+		{"configmap", "configmaps", "hello-code"},
+		{"deployment", "deployments", "hello"},
+		{"service", "services", "hello"},
+		{"hpa", "horizontalpodautoscalers", "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, clientset, dynamicClient := newFakeClient()
+			if tt.resource == "functions" {
+				failCreate(dynamicClient, tt.resource, tt.object, -1)
+			} else {
+				failCreate(clientset, tt.resource, tt.object, -1)
+			}
+
+			err := k.CreateFunction(context.Background(), testFunction())
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("CreateFunction error = %v, want the injected failure", err)
+			}
+
+			for _, obj := range functionObjects {
+				if _, err := getFunctionObject(k, obj); !apierrors.IsNotFound(err) {
+					t.Errorf("%s %s was not rolled back (get error %v)", obj.kind, obj.name, err)
+				}
+			}
+			if _, err := k.functions().Get(context.Background(), "hello", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("function resource was not rolled back (get error %v)", err)
+			}
+
+			// The revision is garbage collected with the function
+			// resource that owns it.
+			cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(context.Background(), "hello-rev-1", metav1.GetOptions{})
+			if err == nil && metav1.GetControllerOf(cm) == nil {
+				t.Errorf("revision configmap is left without an owner")
+			}
+		})
+	}
+}
+
+func TestCreateFunctionRetryAfterFailure(t *testing.T) {
+	for _, tt := range []struct{ resource, object string }{
+		{"deployments", "hello"},
+		{"services", "hello"},
+		{"horizontalpodautoscalers", "hello"},
+	} {
+		t.Run(tt.resource, func(t *testing.T) {
+			k, clientset, _ := newFakeClient()
+			failCreate(clientset, tt.resource, tt.object, 1)
+
+			if err := k.CreateFunction(context.Background(), testFunction()); !errors.Is(err, errInjected) {
+				t.Fatalf("first CreateFunction error = %v, want the injected failure", err)
+			}
+			if err := k.CreateFunction(context.Background(), testFunction()); err != nil {
+				t.Fatalf("retried CreateFunction: %v", err)
+			}
+
+			for _, obj := range functionObjects {
+				if _, err := getFunctionObject(k, obj); err != nil {
+					t.Errorf("%s %s: %v", obj.kind, obj.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateFunctionAdoptsManagedObjects(t *testing.T) {
+	leftover := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "hello-code",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "kube-serverless"},
+		},
+	}
+	k, _, _ := newFakeClient(leftover)
+
+	if err := k.CreateFunction(context.Background(), testFunction()); err != nil {
+		t.Fatalf("CreateFunction: %v", err)
+	}
+
+	cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(context.Background(), "hello-code", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := metav1.GetControllerOf(cm); owner == nil || owner.Name != "hello" {
+		t.Errorf("configmap controller = %v, want function hello", owner)
+	}
+	if cm.Data["handler"] != "main.handler" {
+		t.Errorf("configmap data was not updated: %v", cm.Data)
+	}
+}
+
+func TestCreateFunctionKeepsUnmanagedObjects(t *testing.T) {
+	foreign := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "hello", Namespace: testNamespace},
+	}
+	k, _, _ := newFakeClient(foreign)
+
+	if err := k.CreateFunction(context.Background(), testFunction()); err == nil {
+		t.Fatal("CreateFunction adopted a service not managed by kube-serverless")
+	}
+
+	if _, err := getFunctionObject(k, functionObject{kind: "service", name: "hello"}); err != nil {
+		t.Errorf("unmanaged service was deleted: %v", err)
+	}
+	for _, obj := range []functionObject{{kind: "configmap", name: "hello-code"}, {kind: "deployment", name: "hello"}} {
+		if _, err := getFunctionObject(k, obj); !apierrors.IsNotFound(err) {
+			t.Errorf("%s %s was not rolled back (get error %v)", obj.kind, obj.name, err)
+		}
+	}
+}
+
+// reconcileKubectlFunction stores fn as if it was applied with kubectl,
+// bypassing the API's checks, and reconciles it.
+func reconcileKubectlFunction(t *testing.T, k *KubernetesClient, fn *Function) *FunctionResource {
+	t.Helper()
+
+	res, _, err := k.createOrAdoptFunctionResource(context.Background(), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := res.toUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewController(k, nil, nil)
+	if err := c.functions.GetIndexer().Add(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(context.Background(), testNamespace+"/"+fn.Name); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	got, err := k.getFunctionResource(context.Background(), fn.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestReconcileProvisionsFunction(t *testing.T) {
+	k, _, _ := newFakeClient()
+
+	got := reconcileKubectlFunction(t, k, testFunction())
+	for _, obj := range functionObjects {
+		o, err := getFunctionObject(k, obj)
+		if err != nil {
+			t.Errorf("%s %s: %v", obj.kind, obj.name, err)
+			continue
+		}
+		if owner := metav1.GetControllerOf(o); owner == nil || owner.Kind != functionGVK.Kind || owner.Name != "hello" {
+			t.Errorf("%s %s is controlled by %v, want the function", obj.kind, obj.name, owner)
+		}
+	}
+
+	want := "hello." + testNamespace + ".svc.cluster.local"
+	if got.Status.State != FunctionStateDeploying || got.Status.Revision != 1 || got.Status.Endpoint != want || got.Status.Message != "" {
+		t.Errorf("status = %+v, want deploying revision 1 at %s", got.Status, want)
+	}
+}
+
+func TestReconcileRejectsResourcesOutOfBounds(t *testing.T) {
+	k, _, _ := newFakeClient()
+	fn := testFunction()
+	fn.Resources = &FunctionResources{
+		Requests: ResourceValues{CPU: "16"},
+		Limits:   ResourceValues{CPU: "16"},
+	}
+
+	got := reconcileKubectlFunction(t, k, fn)
+	if got.Status.State != FunctionStateFailed || !strings.Contains(got.Status.Message, "spec.resources.limits.cpu") {
+		t.Errorf("status = %+v, want failed on spec.resources.limits.cpu", got.Status)
+	}
+	if _, err := getFunctionObject(k, functionObject{kind: "deployment", name: "hello"}); !apierrors.IsNotFound(err) {
+		t.Errorf("deployment was created (get error %v)", err)
+	}
+}
+
+func TestReconcileRejectsUnmanagedSecrets(t *testing.T) {
+	k, _, _ := newFakeClient(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-serverless-controller-token", Namespace: testNamespace},
+		Type:       corev1.SecretTypeServiceAccountToken,
+		Data:       map[string][]byte{"token": []byte("eyJhbGciOi")},
+	})
+	fn := testFunction()
+	fn.SecretMounts = []SecretMount{{Secret: "kube-serverless-controller-token", MountPath: "/var/run/token"}}
+
+	got := reconcileKubectlFunction(t, k, fn)
+	if got.Status.State != FunctionStateFailed || !strings.Contains(got.Status.Message, "spec.secretMounts[0].secret") {
+		t.Errorf("status = %+v, want failed on spec.secretMounts[0].secret", got.Status)
+	}
+	if _, err := getFunctionObject(k, functionObject{kind: "deployment", name: "hello"}); !apierrors.IsNotFound(err) {
+		t.Errorf("deployment was created (get error %v)", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// FunctionResources are the compute resources of a function's container.
+// Values are Kubernetes quantities, such as 250m or 1Gi; unset values take
+// the platform defaults.
+type FunctionResources struct {
+	Requests ResourceValues `json:"requests,omitempty"`
+	Limits   ResourceValues `json:"limits,omitempty"`
+}
+
+type ResourceValues struct {
+	CPU              string `json:"cpu,omitempty"`
+	Memory           string `json:"memory,omitempty"`
+	EphemeralStorage string `json:"ephemeralStorage,omitempty"`
+}
+
+// functionResource ties a resource of FunctionResources to its Kubernetes
+// name and its platform bounds.
+type functionResource struct {
+	field  string
+	name   corev1.ResourceName
+	value  func(*ResourceValues) *string
+	bounds func(PlatformConfig) ResourceBounds
+}
+
+var functionResources = []functionResource{
+	{
+		field:  "cpu",
+		name:   corev1.ResourceCPU,
+		value:  func(v *ResourceValues) *string { return &v.CPU },
+		bounds: func(cfg PlatformConfig) ResourceBounds { return cfg.CPU },
+	},
+	{
+		field:  "memory",
+		name:   corev1.ResourceMemory,
+		value:  func(v *ResourceValues) *string { return &v.Memory },
+		bounds: func(cfg PlatformConfig) ResourceBounds { return cfg.Memory },
+	},
+	{
+		field:  "ephemeralStorage",
+		name:   corev1.ResourceEphemeralStorage,
+		value:  func(v *ResourceValues) *string { return &v.EphemeralStorage },
+		bounds: func(cfg PlatformConfig) ResourceBounds { return cfg.EphemeralStorage },
+	},
+}
+
+// quantityGreater reports whether a and b are both set and a is the larger
+// quantity. Malformed quantities compare as unset.
+func quantityGreater(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	qa, err := resource.ParseQuantity(a)
+	if err != nil {
+		return false
+	}
+	qb, err := resource.ParseQuantity(b)
+	if err != nil {
+		return false
+	}
+	return qa.Cmp(qb) > 0
+}
+
+// applyResourceDefaults fills in unset requests and limits from the
+// platform defaults. A default request above the function's limit is
+// lowered to the limit, and a default limit below the function's request is
+// raised to the request, so defaults never make a valid spec invalid.
+func applyResourceDefaults(fn *Function, cfg PlatformConfig) {
+	if fn.Resources == nil {
+		fn.Resources = &FunctionResources{}
+	}
+	for _, r := range functionResources {
+		bounds := r.bounds(cfg)
+		request := r.value(&fn.Resources.Requests)
+		limit := r.value(&fn.Resources.Limits)
+
+		if *limit == "" && bounds.DefaultLimit != "" {
+			*limit = bounds.DefaultLimit
+			if quantityGreater(*request, *limit) {
+				*limit = *request
+			}
+		}
+		if *request == "" && bounds.DefaultRequest != "" {
+			*request = bounds.DefaultRequest
+			if quantityGreater(*request, *limit) {
+				*request = *limit
+			}
+		}
+	}
+}
+
+// validateResources checks that resource values are positive quantities
+// and that no request exceeds its limit.
+func validateResources(errs *ValidationErrors, res *FunctionResources) {
+	if res == nil {
+		return
+	}
+	for _, r := range functionResources {
+		request := *r.value(&res.Requests)
+		limit := *r.value(&res.Limits)
+
+		valid := true
+		for _, v := range []struct{ field, value string }{
+			{"spec.resources.requests." + r.field, request},
+			{"spec.resources.limits." + r.field, limit},
+		} {
+			if v.value == "" {
+				continue
+			}
+			q, err := resource.ParseQuantity(v.value)
+			if err != nil {
+				errs.add(v.field, "invalid quantity %q", v.value)
+				valid = false
+			} else if q.Sign() <= 0 {
+				errs.add(v.field, "must be greater than 0")
+				valid = false
+			}
+		}
+		if valid && quantityGreater(request, limit) {
+			errs.add("spec.resources.requests."+r.field, "must not be greater than the limit (%s)", limit)
+		}
+	}
+}
+
+// checkResourceBounds checks a function's resources against the platform
+// bounds. Existing functions are not re-checked when the bounds change.
+func (k *KubernetesClient) checkResourceBounds(fn *Function) error {
+	if fn.Resources == nil {
+		return nil
+	}
+
+	cfg := k.config.Get()
+	var errs ValidationErrors
+	for _, r := range functionResources {
+		bounds := r.bounds(cfg)
+		for _, v := range []struct{ field, value string }{
+			{"spec.resources.requests." + r.field, *r.value(&fn.Resources.Requests)},
+			{"spec.resources.limits." + r.field, *r.value(&fn.Resources.Limits)},
+		} {
+			if quantityGreater(bounds.Min, v.value) {
+				errs.add(v.field, "must be at least %s", bounds.Min)
+			}
+			if quantityGreater(v.value, bounds.Max) {
+				errs.add(v.field, "must be at most %s", bounds.Max)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// resourceRequirements returns the container resources of a function.
+// Values are expected to have been validated.
+func resourceRequirements(res *FunctionResources) corev1.ResourceRequirements {
+	var requirements corev1.ResourceRequirements
+	if res == nil {
+		return requirements
+	}
+	for _, r := range functionResources {
+		if v := *r.value(&res.Requests); v != "" {
+			if requirements.Requests == nil {
+				requirements.Requests = corev1.ResourceList{}
+			}
+			requirements.Requests[r.name] = resource.MustParse(v)
+		}
+		if v := *r.value(&res.Limits); v != "" {
+			if requirements.Limits == nil {
+				requirements.Limits = corev1.ResourceList{}
+			}
+			requirements.Limits[r.name] = resource.MustParse(v)
+		}
+	}
+	return requirements
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+)
+
+// Retry defaults used for fields a function's RetryPolicy leaves unset.
+const (
+	defaultMaxAttempts           = 3
+	defaultInitialBackoffSeconds = 1
+	defaultMaxBackoffSeconds     = 60
+)
+
+var defaultRetryableStatusCodes = []int{429, 500, 502, 503, 504}
+
+// RetryPolicy controls how asynchronous and trigger-driven invocations of a
+// function are retried. Failures to reach the function are always
+// retryable; responses are retried if their status code is listed.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int32 `json:"maxAttempts,omitempty"`
+	// InitialBackoffSeconds is the wait before the first retry. It doubles
+	// with every further retry, up to MaxBackoffSeconds.
+	InitialBackoffSeconds int32 `json:"initialBackoffSeconds,omitempty"`
+	MaxBackoffSeconds     int32 `json:"maxBackoffSeconds,omitempty"`
+	RetryableStatusCodes  []int `json:"retryableStatusCodes,omitempty"`
+}
+
+// effectiveRetryPolicy returns the function's retry policy with defaults
+// filled in.
+func effectiveRetryPolicy(fn *Function) RetryPolicy {
+	var p RetryPolicy
+	if fn.RetryPolicy != nil {
+		p = *fn.RetryPolicy
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.InitialBackoffSeconds == 0 {
+		p.InitialBackoffSeconds = defaultInitialBackoffSeconds
+	}
+	if p.MaxBackoffSeconds == 0 {
+		p.MaxBackoffSeconds = defaultMaxBackoffSeconds
+	}
+	if p.RetryableStatusCodes == nil {
+		p.RetryableStatusCodes = defaultRetryableStatusCodes
+	}
+	return p
+}
+
+// failed reports whether an attempt failed: the function could not be
+// reached, answered with a 5xx status, or with a status the policy retries.
+func (p RetryPolicy) failed(resp *InvocationResponse, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500 || p.retryableStatus(resp.StatusCode)
+}
+
+func (p RetryPolicy) retryableStatus(code int) bool {
+	for _, c := range p.RetryableStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRetry reports whether a failed attempt is retried. Responses with a
+// status the policy does not list are final.
+func (p RetryPolicy) shouldRetry(attempt int32, resp *InvocationResponse, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	return err != nil || p.retryableStatus(resp.StatusCode)
+}
+
+// backoff returns the wait before the given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int32) time.Duration {
+	d := time.Duration(p.InitialBackoffSeconds) * time.Second
+	max := time.Duration(p.MaxBackoffSeconds) * time.Second
+	for i := int32(1); i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
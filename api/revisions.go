@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	functionLabel        = "serverless.kube.io/function"
+	revisionLabel        = "serverless.kube.io/revision"
+	codeHashAnnotation   = "serverless.kube.io/code-hash"
+	generationAnnotation = "serverless.kube.io/generation"
+	revisionHistorySize  = 10
+)
+
+// Revision is an immutable snapshot of the code a function ran at some
+// point. Every create and update of the Function resource records a new
+// one, even if it restores the code of an earlier revision.
+type Revision struct {
+	Number      int64             `json:"revision"`
+	Runtime     string            `json:"runtime"`
+	Handler     string            `json:"handler"`
+	Code        string            `json:"code"`
+	Environment map[string]string `json:"environment,omitempty"`
+	CreatedAt   metav1.Time       `json:"createdAt"`
+	Current     bool              `json:"current"`
+}
+
+// revisionContent is the part of a FunctionSpec captured by a revision.
+type revisionContent struct {
+	Runtime     string            `json:"runtime"`
+	Handler     string            `json:"handler"`
+	Code        string            `json:"code"`
+	Environment map[string]string `json:"environment,omitempty"`
+}
+
+func revisionContentOf(spec *FunctionSpec) revisionContent {
+	return revisionContent{
+		Runtime:     spec.Runtime,
+		Handler:     spec.Handler,
+		Code:        spec.Code,
+		Environment: spec.Environment,
+	}
+}
+
+// hash identifies the content of a revision. Map keys are marshalled in
+// sorted order, so equal content always hashes the same.
+func (c revisionContent) hash() string {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func revisionConfigMapName(function string, number int64) string {
+	return fmt.Sprintf("%s-rev-%d", function, number)
+}
+
+func (k *KubernetesClient) revisionConfigMap(fn *Function, number, generation int64) (*corev1.ConfigMap, error) {
+	content := revisionContentOf(&fn.FunctionSpec)
+	env, err := json.Marshal(content.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	immutable := true
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      revisionConfigMapName(fn.Name, number),
+			Namespace: k.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       fn.Name,
+				"app.kubernetes.io/managed-by": "kube-serverless",
+				functionLabel:                  fn.Name,
+				revisionLabel:                  strconv.FormatInt(number, 10),
+			},
+			Annotations: map[string]string{
+				codeHashAnnotation:   content.hash(),
+				generationAnnotation: strconv.FormatInt(generation, 10),
+			},
+		},
+		Immutable: &immutable,
+		Data: map[string]string{
+			"runtime":     content.Runtime,
+			"handler":     content.Handler,
+			"code":        content.Code,
+			"environment": string(env),
+		},
+	}, nil
+}
+
+func revisionFromConfigMap(cm *corev1.ConfigMap) (*Revision, error) {
+	number, err := strconv.ParseInt(cm.Labels[revisionLabel], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("configmap %s has invalid %s label: %w", cm.Name, revisionLabel, err)
+	}
+
+	rev := &Revision{
+		Number:    number,
+		Runtime:   cm.Data["runtime"],
+		Handler:   cm.Data["handler"],
+		Code:      cm.Data["code"],
+		CreatedAt: cm.CreationTimestamp,
+	}
+	if env := cm.Data["environment"]; env != "" && env != "null" {
+		if err := json.Unmarshal([]byte(env), &rev.Environment); err != nil {
+			return nil, fmt.Errorf("configmap %s has invalid environment: %w", cm.Name, err)
+		}
+	}
+	return rev, nil
+}
+
+// revisionConfigMaps returns the revision ConfigMaps of a function, oldest
+// first.
+func (k *KubernetesClient) revisionConfigMaps(ctx context.Context, name string) ([]corev1.ConfigMap, error) {
+	list, err := k.clientset.CoreV1().ConfigMaps(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			"app.kubernetes.io/managed-by": "kube-serverless",
+			functionLabel:                  name,
+		}).String() + "," + revisionLabel,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := list.Items
+	sort.Slice(items, func(i, j int) bool {
+		a, _ := strconv.ParseInt(items[i].Labels[revisionLabel], 10, 64)
+		b, _ := strconv.ParseInt(items[j].Labels[revisionLabel], 10, 64)
+		return a < b
+	})
+	return items, nil
+}
+
+// ListRevisions returns the recorded revisions of a function, oldest first,
+// marking the newest one its current spec matches.
+func (k *KubernetesClient) ListRevisions(ctx context.Context, name string) ([]Revision, error) {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	currentHash := revisionContentOf(&fn.FunctionSpec).hash()
+
+	cms, err := k.revisionConfigMaps(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]Revision, 0, len(cms))
+	current := -1
+	for i := range cms {
+		rev, err := revisionFromConfigMap(&cms[i])
+		if err != nil {
+			return nil, err
+		}
+		if cms[i].Annotations[codeHashAnnotation] == currentHash {
+			current = i
+		}
+		revisions = append(revisions, *rev)
+	}
+	if current >= 0 {
+		revisions[current].Current = true
+	}
+	return revisions, nil
+}
+
+// GetRevision returns a single revision of a function.
+func (k *KubernetesClient) GetRevision(ctx context.Context, name string, number int64) (*Revision, error) {
+	cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, revisionConfigMapName(name, number), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no revision %d", name, number))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cm.Labels[functionLabel] != name {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no revision %d", name, number))
+	}
+	return revisionFromConfigMap(cm)
+}
+
+// ensureRevision returns the revision of the given generation of a
+// function's spec, recording a new one unless the latest revision was
+// recorded for it. A reconcile of an older generation, racing an update,
+// gets the latest revision; one recorded before revisions kept their
+// generation is reused if it has the same code. It is safe to call
+// concurrently from the API and the controller: a lost race on the next
+// revision number is retried against the updated history.
+func (k *KubernetesClient) ensureRevision(ctx context.Context, fn *Function, generation int64, owner *metav1.OwnerReference) (int64, error) {
+	hash := revisionContentOf(&fn.FunctionSpec).hash()
+
+	var number int64
+	err := retry.OnError(retry.DefaultRetry, apierrors.IsAlreadyExists, func() error {
+		cms, err := k.revisionConfigMaps(ctx, fn.Name)
+		if err != nil {
+			return err
+		}
+
+		var latest int64
+		if len(cms) > 0 {
+			newest := cms[len(cms)-1]
+			latest, _ = strconv.ParseInt(newest.Labels[revisionLabel], 10, 64)
+			recordedFor, err := strconv.ParseInt(newest.Annotations[generationAnnotation], 10, 64)
+			if err == nil && recordedFor >= generation || err != nil && newest.Annotations[codeHashAnnotation] == hash {
+				number = latest
+				return nil
+			}
+		}
+
+		cm, err := k.revisionConfigMap(fn, latest+1, generation)
+		if err != nil {
+			return err
+		}
+		setOwner(&cm.ObjectMeta, owner)
+		if _, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		number = latest + 1
+
+		k.pruneRevisions(ctx, fn, append(cms, *cm), number)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("revision: %w", err)
+	}
+	return number, nil
+}
+
+// pruneRevisions deletes the oldest revisions beyond revisionHistorySize,
+// never the current one or one the traffic split or an alias pins. Failures are only
+// logged; the next revision retries them.
+func (k *KubernetesClient) pruneRevisions(ctx context.Context, fn *Function, cms []corev1.ConfigMap, current int64) {
+	keep := map[string]bool{strconv.FormatInt(current, 10): true}
+	for _, revision := range pinnedRevisions(fn) {
+		keep[strconv.FormatInt(revision, 10)] = true
+	}
+
+	excess := len(cms) - revisionHistorySize
+	for i := 0; i < len(cms) && excess > 0; i++ {
+		if keep[cms[i].Labels[revisionLabel]] {
+			continue
+		}
+		err := k.clientset.CoreV1().ConfigMaps(k.namespace).Delete(ctx, cms[i].Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Failed to prune revision %s of function %s: %v", cms[i].Labels[revisionLabel], fn.Name, err)
+			continue
+		}
+		excess--
+	}
+}
+
+// RollbackFunction restores the code, handler, runtime and environment of
+// an earlier revision. With to set to 0 it rolls back to the revision
+// before the current one. The rest of the spec is left as it is.
+func (k *KubernetesClient) RollbackFunction(ctx context.Context, name string, to int64) (*Function, error) {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if to == 0 {
+		to, err = k.previousRevision(ctx, fn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rev, err := k.GetRevision(ctx, name, to)
+	if err != nil {
+		return nil, err
+	}
+
+	fn.Runtime = rev.Runtime
+	fn.Handler = rev.Handler
+	fn.Code = rev.Code
+	fn.Environment = rev.Environment
+
+	if err := k.UpdateFunction(ctx, fn); err != nil {
+		return nil, err
+	}
+	return fn, nil
+}
+
+// previousRevision returns the newest revision older than the one the
+// function currently runs.
+func (k *KubernetesClient) previousRevision(ctx context.Context, fn *Function) (int64, error) {
+	revisions, err := k.ListRevisions(ctx, fn.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int64
+	for _, rev := range revisions {
+		if rev.Current {
+			current = rev.Number
+		}
+	}
+
+	var previous int64
+	for _, rev := range revisions {
+		if rev.Number < current && rev.Number > previous {
+			previous = rev.Number
+		}
+	}
+	if previous == 0 {
+		return 0, NewAPIError(http.StatusConflict, fmt.Sprintf("function %s has no revision before %d to roll back to", fn.Name, current))
+	}
+	return previous, nil
+}
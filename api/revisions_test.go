@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnsureRevisionRecordsEveryGeneration(t *testing.T) {
+	k, _, _ := newFakeClient()
+	ctx := context.Background()
+	a, b := testFunction(), testFunction()
+	b.Code = "def handler(event, context):\n    return 2\n"
+
+	steps := []struct {
+		name       string
+		fn         *Function
+		generation int64
+		want       int64
+	}{
+		{"create", a, 1, 1},
+		{"update", b, 2, 2},
+		{"update back to the first code", a, 3, 3},
+		{"reconcile of the same generation", a, 3, 3},
+		{"reconcile of an older generation", b, 2, 3},
+	}
+	for _, step := range steps {
+		got, err := k.ensureRevision(ctx, step.fn, step.generation, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got != step.want {
+			t.Errorf("%s: revision %d, want %d", step.name, got, step.want)
+		}
+	}
+
+	revisions, err := k.revisionConfigMaps(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 {
+		t.Errorf("%d revisions recorded, want 3", len(revisions))
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	lastInvocationAnnotation = "serverless.kube.io/last-invocation"
+	minReplicasAnnotation    = "serverless.kube.io/min-replicas"
+)
+
+// IdleScaler scales functions to zero once they have gone without
+// invocations for the configured scaleToZeroTimeout. Invocation times are
+// tracked in memory and flushed to a Deployment annotation so that every
+// API server replica sees the traffic the others handled.
+type IdleScaler struct {
+	k8sClient *KubernetesClient
+	config    *ConfigStore
+	interval  time.Duration
+
+	mu             sync.Mutex
+	lastInvocation map[string]time.Time
+	inFlight       map[string]int
+	invocations    map[string]int64
+	firstSeen      map[string]sighting
+}
+
+// sighting is when this replica first saw a Deployment. The UID tells a
+// re-created function apart from a deleted one of the same name.
+type sighting struct {
+	uid types.UID
+	at  time.Time
+}
+
+func NewIdleScaler(k8sClient *KubernetesClient, config *ConfigStore) *IdleScaler {
+	return &IdleScaler{
+		k8sClient:      k8sClient,
+		config:         config,
+		interval:       30 * time.Second,
+		lastInvocation: make(map[string]time.Time),
+		inFlight:       make(map[string]int),
+		invocations:    make(map[string]int64),
+		firstSeen:      make(map[string]sighting),
+	}
+}
+
+// Begin records the start of an invocation. The returned func must be
+// called when the invocation finishes.
+func (s *IdleScaler) Begin(name string) func() {
+	s.mu.Lock()
+	s.lastInvocation[name] = time.Now()
+	s.inFlight[name]++
+	s.invocations[name]++
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		s.lastInvocation[name] = time.Now()
+		s.inFlight[name]--
+		if s.inFlight[name] <= 0 {
+			delete(s.inFlight, name)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Load returns the invocations in flight and started on this replica for
+// every function workload it has invoked.
+func (s *IdleScaler) Load() map[string]WorkloadLoad {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	load := make(map[string]WorkloadLoad, len(s.invocations))
+	for name, invocations := range s.invocations {
+		load[name] = WorkloadLoad{InFlight: s.inFlight[name], Invocations: invocations}
+	}
+	return load
+}
+
+// Run reaps idle functions until ctx is cancelled.
+func (s *IdleScaler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reap(ctx)
+		}
+	}
+}
+
+func (s *IdleScaler) reap(ctx context.Context) {
+	deployments, err := s.k8sClient.ListFunctionDeployments(ctx)
+	if err != nil {
+		log.Printf("Idle scaler: failed to list deployments: %v", err)
+		return
+	}
+
+	cfg := s.config.Get()
+	now := time.Now()
+	s.forgetDeleted(deployments)
+
+	for i := range deployments {
+		dep := &deployments[i]
+		name := dep.Name
+
+		invoked, firstSeen, busy := s.observe(name, dep.UID, now)
+		recorded := annotationTime(dep)
+		last := latest(latest(invoked, firstSeen), recorded)
+
+		if invoked.Truncate(time.Second).After(recorded) {
+			if err := s.k8sClient.AnnotateLastInvocation(ctx, name, invoked); err != nil {
+				log.Printf("Idle scaler: failed to record last invocation of %s: %v", name, err)
+			}
+		}
+
+		if busy || cfg.ScaleToZeroTimeout == 0 {
+			continue
+		}
+		if dep.Spec.Replicas == nil || *dep.Spec.Replicas == 0 {
+			continue
+		}
+		if minReplicas(dep, cfg) > 0 {
+			continue
+		}
+		if now.Sub(last) < cfg.ScaleToZeroTimeout {
+			continue
+		}
+
+		log.Printf("Scaling idle function %s to zero (idle for %s)", name, now.Sub(last).Round(time.Second))
+		if err := s.k8sClient.ScaleToZero(ctx, name); err != nil {
+			log.Printf("Idle scaler: failed to scale %s to zero: %v", name, err)
+		}
+	}
+}
+
+// observe returns the last local invocation time of a function, when this
+// replica first saw its Deployment, and whether it has invocations in
+// flight. The first sighting counts as activity so a restart, or a function
+// re-created under the same name, is not immediately reaped.
+func (s *IdleScaler) observe(name string, uid types.UID, now time.Time) (time.Time, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seen, ok := s.firstSeen[name]; !ok || seen.uid != uid {
+		s.firstSeen[name] = sighting{uid: uid, at: now}
+	}
+
+	return s.lastInvocation[name], s.firstSeen[name].at, s.inFlight[name] > 0
+}
+
+// forgetDeleted drops the state of workloads whose Deployment is gone,
+// unless they still have invocations in flight.
+func (s *IdleScaler) forgetDeleted(deployments []appsv1.Deployment) {
+	exists := make(map[string]bool, len(deployments))
+	for i := range deployments {
+		exists[deployments[i].Name] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stale := func(name string) bool { return !exists[name] && s.inFlight[name] == 0 }
+	for name := range s.lastInvocation {
+		if stale(name) {
+			delete(s.lastInvocation, name)
+		}
+	}
+	for name := range s.invocations {
+		if stale(name) {
+			delete(s.invocations, name)
+		}
+	}
+	for name := range s.firstSeen {
+		if stale(name) {
+			delete(s.firstSeen, name)
+		}
+	}
+}
+
+func annotationTime(dep *appsv1.Deployment) time.Time {
+	t, err := time.Parse(time.RFC3339, dep.Annotations[lastInvocationAnnotation])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func minReplicas(dep *appsv1.Deployment, cfg PlatformConfig) int32 {
+	n, err := strconv.ParseInt(dep.Annotations[minReplicasAnnotation], 10, 32)
+	if err != nil {
+		return cfg.DefaultMinReplicas
+	}
+	return int32(n)
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func functionDeployment(name string, lastInvocation time.Time, annotations map[string]string) *appsv1.Deployment {
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[lastInvocationAnnotation] = lastInvocation.UTC().Format(time.RFC3339)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   testNamespace,
+			UID:         types.UID(name),
+			Labels:      map[string]string{"app.kubernetes.io/managed-by": "kube-serverless"},
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(1)},
+	}
+}
+
+func TestIdleScalerReapsIdleFunctions(t *testing.T) {
+	now := time.Now()
+	clientset := fake.NewSimpleClientset(
+		functionDeployment("idle", now.Add(-time.Hour), nil),
+		functionDeployment("busy", now.Add(-time.Hour), nil),
+		functionDeployment("invoked-here", now.Add(-time.Hour), nil),
+		functionDeployment("invoked-elsewhere", now, nil),
+		functionDeployment("pinned", now.Add(-time.Hour), map[string]string{minReplicasAnnotation: "1"}),
+	)
+	k := &KubernetesClient{clientset: clientset, namespace: testNamespace, config: NewConfigStore()}
+	cfg := k.config.Get()
+	cfg.ScaleToZeroTimeout = time.Minute
+	k.config.Set(cfg)
+	s := NewIdleScaler(k, k.config)
+	ctx := context.Background()
+
+	// Functions first seen by this replica count as just invoked.
+	s.reap(ctx)
+	s.mu.Lock()
+	for name, seen := range s.firstSeen {
+		seen.at = seen.at.Add(-time.Hour)
+		s.firstSeen[name] = seen
+	}
+	s.mu.Unlock()
+
+	// An invocation that started an hour ago and is still running.
+	defer s.Begin("busy")()
+	s.mu.Lock()
+	s.lastInvocation["busy"] = now.Add(-time.Hour)
+	s.mu.Unlock()
+
+	s.Begin("invoked-here")()
+	s.reap(ctx)
+
+	for name, wantReplicas := range map[string]int32{
+		"idle":              0,
+		"busy":              1,
+		"invoked-here":      1,
+		"invoked-elsewhere": 1,
+		"pinned":            1,
+	} {
+		dep, err := clientset.AppsV1().Deployments(testNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *dep.Spec.Replicas != wantReplicas {
+			t.Errorf("%s has %d replicas, want %d", name, *dep.Spec.Replicas, wantReplicas)
+		}
+		if name == "invoked-here" && annotationTime(dep).Before(now.Truncate(time.Second)) {
+			t.Errorf("last invocation of %s not recorded, annotation %s", name, dep.Annotations[lastInvocationAnnotation])
+		}
+	}
+}
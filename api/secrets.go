@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const secretLabel = "serverless.kube.io/secret"
+
+// EnvVarSource sets an environment variable from a key of a Secret or a
+// ConfigMap in the platform namespace. Exactly one ref is set. The value is
+// resolved by the kubelet, so it never appears in the Function or its
+// Deployment.
+type EnvVarSource struct {
+	Name         string  `json:"name"`
+	SecretRef    *KeyRef `json:"secretRef,omitempty"`
+	ConfigMapRef *KeyRef `json:"configMapRef,omitempty"`
+}
+
+// KeyRef selects a key of a Secret or ConfigMap.
+type KeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// SecretMount mounts the keys of a Secret as files in a directory of the
+// function's container.
+type SecretMount struct {
+	Secret    string `json:"secret"`
+	MountPath string `json:"mountPath"`
+}
+
+// secretEnvVars returns the environment variables of fn's env sources.
+func secretEnvVars(fn *Function) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	for _, source := range fn.EnvFrom {
+		envVar := corev1.EnvVar{Name: source.Name, ValueFrom: &corev1.EnvVarSource{}}
+		switch {
+		case source.SecretRef != nil:
+			envVar.ValueFrom.SecretKeyRef = &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: source.SecretRef.Name},
+				Key:                  source.SecretRef.Key,
+			}
+		case source.ConfigMapRef != nil:
+			envVar.ValueFrom.ConfigMapKeyRef = &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: source.ConfigMapRef.Name},
+				Key:                  source.ConfigMapRef.Key,
+			}
+		default:
+			continue
+		}
+		envVars = append(envVars, envVar)
+	}
+	return envVars
+}
+
+// secretVolumes returns the volumes and mounts of fn's secret mounts.
+func secretVolumes(fn *Function) ([]corev1.Volume, []corev1.VolumeMount) {
+	var (
+		volumes []corev1.Volume
+		mounts  []corev1.VolumeMount
+	)
+	for i, mount := range fn.SecretMounts {
+		name := fmt.Sprintf("secret-%d", i)
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: mount.Secret},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: mount.MountPath,
+			ReadOnly:  true,
+		})
+	}
+	return volumes, mounts
+}
+
+// checkSecretReferences verifies that the Secrets, ConfigMaps and keys the
+// env sources and secret mounts refer to exist, so a pod that cannot start
+// is rejected before the spec is stored. Only Secrets managed through the
+// API can be referenced; others, such as service account tokens, are
+// reported as not found, as by the secrets API. So are the platform's own
+// ConfigMaps.
+func (k *KubernetesClient) checkSecretReferences(ctx context.Context, fn *Function) error {
+	var errs ValidationErrors
+
+	secrets := make(map[string]*corev1.Secret)
+	getSecret := func(name string) (*corev1.Secret, error) {
+		if secret, ok := secrets[name]; ok {
+			return secret, nil
+		}
+		secret, err := k.clientset.CoreV1().Secrets(k.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && secret.Labels[secretLabel] != "true") {
+			secret, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = secret
+		return secret, nil
+	}
+
+	for i, source := range fn.EnvFrom {
+		field := fmt.Sprintf("spec.envFrom[%d]", i)
+		switch {
+		case source.SecretRef != nil:
+			secret, err := getSecret(source.SecretRef.Name)
+			if err != nil {
+				return err
+			}
+			if secret == nil {
+				errs.add(field+".secretRef.name", "secret %s not found", source.SecretRef.Name)
+			} else if _, ok := secret.Data[source.SecretRef.Key]; !ok {
+				errs.add(field+".secretRef.key", "secret %s has no key %s", source.SecretRef.Name, source.SecretRef.Key)
+			}
+		case source.ConfigMapRef != nil:
+			cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, source.ConfigMapRef.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) || (err == nil && platformConfigMap(cm)) {
+				errs.add(field+".configMapRef.name", "configmap %s not found", source.ConfigMapRef.Name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			_, inData := cm.Data[source.ConfigMapRef.Key]
+			_, inBinary := cm.BinaryData[source.ConfigMapRef.Key]
+			if !inData && !inBinary {
+				errs.add(field+".configMapRef.key", "configmap %s has no key %s", source.ConfigMapRef.Name, source.ConfigMapRef.Key)
+			}
+		}
+	}
+
+	for i, mount := range fn.SecretMounts {
+		secret, err := getSecret(mount.Secret)
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			errs.add(fmt.Sprintf("spec.secretMounts[%d].secret", i), "secret %s not found", mount.Secret)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// platformConfigMap reports whether cm belongs to the platform, such as
+// its config, function code, revisions and dead letters, rather than to
+// the functions' users.
+func platformConfigMap(cm *corev1.ConfigMap) bool {
+	if cm.Name == platformConfigName || cm.Labels["app.kubernetes.io/managed-by"] == "kube-serverless" {
+		return true
+	}
+	for _, label := range []string{deadLetterLabel, triggerLabel, revisionLabel, functionLabel} {
+		if _, ok := cm.Labels[label]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// referencesSecret reports whether fn uses a Secret.
+func referencesSecret(fn *Function, name string) bool {
+	for _, source := range fn.EnvFrom {
+		if source.SecretRef != nil && source.SecretRef.Name == name {
+			return true
+		}
+	}
+	for _, mount := range fn.SecretMounts {
+		if mount.Secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FunctionSecret is a Secret managed through the API. Its values are
+// write-only: responses list only the keys.
+type FunctionSecret struct {
+	Name      string    `json:"name"`
+	Keys      []string  `json:"keys"`
+	UsedBy    []string  `json:"usedBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CreateSecretRequest is the body of a request to create a secret.
+type CreateSecretRequest struct {
+	Name string            `json:"name"`
+	Data map[string]string `json:"data"`
+}
+
+func validateSecretRequest(req *CreateSecretRequest) error {
+	var errs ValidationErrors
+	if req.Name == "" {
+		errs.add("name", "required")
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(req.Name) {
+			errs.add("name", "%s", msg)
+		}
+	}
+	if len(req.Data) == 0 {
+		errs.add("data", "must have at least one key")
+	}
+	for _, key := range sortedKeys(req.Data) {
+		for _, msg := range validation.IsConfigMapKey(key) {
+			errs.add(fmt.Sprintf("data[%s]", key), "%s", msg)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// newFunctionSecret describes a Secret and the functions using it.
+func newFunctionSecret(secret *corev1.Secret, functions []Function) FunctionSecret {
+	fs := FunctionSecret{
+		Name:      secret.Name,
+		Keys:      make([]string, 0, len(secret.Data)),
+		CreatedAt: secret.CreationTimestamp.Time,
+	}
+	for key := range secret.Data {
+		fs.Keys = append(fs.Keys, key)
+	}
+	sort.Strings(fs.Keys)
+	for i := range functions {
+		if referencesSecret(&functions[i], secret.Name) {
+			fs.UsedBy = append(fs.UsedBy, functions[i].Name)
+		}
+	}
+	return fs
+}
+
+func (k *KubernetesClient) functionSecret(ctx context.Context, secret *corev1.Secret) (*FunctionSecret, error) {
+	functions, err := k.ListFunctions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fs := newFunctionSecret(secret, functions)
+	return &fs, nil
+}
+
+// CreateSecret stores a Secret functions can refer to.
+func (k *KubernetesClient) CreateSecret(ctx context.Context, req *CreateSecretRequest) (*FunctionSecret, error) {
+	if err := validateSecretRequest(req); err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      req.Name,
+			Namespace: k.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "kube-serverless",
+				secretLabel:                    "true",
+			},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: req.Data,
+	}
+
+	created, err := k.clientset.CoreV1().Secrets(k.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil, NewAPIError(http.StatusConflict, fmt.Sprintf("secret %s already exists", req.Name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.functionSecret(ctx, created)
+}
+
+// ListSecrets returns the Secrets managed through the API, sorted by name.
+func (k *KubernetesClient) ListSecrets(ctx context.Context) ([]FunctionSecret, error) {
+	list, err := k.clientset.CoreV1().Secrets(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{secretLabel: "true"}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	functions, err := k.ListFunctions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]FunctionSecret, 0, len(list.Items))
+	for i := range list.Items {
+		secrets = append(secrets, newFunctionSecret(&list.Items[i], functions))
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets, nil
+}
+
+func (k *KubernetesClient) getManagedSecret(ctx context.Context, name string) (*corev1.Secret, error) {
+	secret, err := k.clientset.CoreV1().Secrets(k.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && secret.Labels[secretLabel] != "true") {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("secret %s not found", name))
+	}
+	return secret, err
+}
+
+// GetSecret returns a Secret managed through the API, without its values.
+func (k *KubernetesClient) GetSecret(ctx context.Context, name string) (*FunctionSecret, error) {
+	secret, err := k.getManagedSecret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return k.functionSecret(ctx, secret)
+}
+
+// DeleteSecret deletes a Secret managed through the API, unless a function
+// still uses it.
+func (k *KubernetesClient) DeleteSecret(ctx context.Context, name string) error {
+	secret, err := k.getManagedSecret(ctx, name)
+	if err != nil {
+		return err
+	}
+	fs, err := k.functionSecret(ctx, secret)
+	if err != nil {
+		return err
+	}
+	if len(fs.UsedBy) > 0 {
+		return NewAPIError(http.StatusConflict, fmt.Sprintf("secret %s is used by functions %s", name, strings.Join(fs.UsedBy, ", ")))
+	}
+	return k.clientset.CoreV1().Secrets(k.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckSecretReferences(t *testing.T) {
+	managed := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "orders-db",
+			Namespace: testNamespace,
+			Labels:    map[string]string{secretLabel: "true"},
+		},
+		Data: map[string][]byte{"password": []byte("s3cret")},
+	}
+	token := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-serverless-controller-token", Namespace: testNamespace},
+		Type:       corev1.SecretTypeServiceAccountToken,
+		Data:       map[string][]byte{"token": []byte("eyJhbGciOi")},
+	}
+
+	settings := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: testNamespace},
+		Data:       map[string]string{"color": "blue"},
+	}
+	platform := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: platformConfigName, Namespace: testNamespace},
+		Data:       map[string]string{"scaleToZeroTimeout": "300"},
+	}
+	code := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "billing-code",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "kube-serverless"},
+		},
+		Data: map[string]string{"code": "def handler(event): pass"},
+	}
+	deadLetter := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "billing-dl-1",
+			Namespace: testNamespace,
+			Labels:    map[string]string{deadLetterLabel: "true"},
+		},
+		Data: map[string]string{"request": "{}"},
+	}
+
+	tests := []struct {
+		name    string
+		envFrom []EnvVarSource
+		mounts  []SecretMount
+		field   string
+	}{
+		{
+			name:    "managed secret",
+			envFrom: []EnvVarSource{{Name: "DB_PASSWORD", SecretRef: &KeyRef{Name: "orders-db", Key: "password"}}},
+			mounts:  []SecretMount{{Secret: "orders-db", MountPath: "/etc/orders-db"}},
+		},
+		{
+			name:    "missing key",
+			envFrom: []EnvVarSource{{Name: "DB_USER", SecretRef: &KeyRef{Name: "orders-db", Key: "user"}}},
+			field:   "spec.envFrom[0].secretRef.key",
+		},
+		{
+			name:    "unmanaged secret in envFrom",
+			envFrom: []EnvVarSource{{Name: "TOKEN", SecretRef: &KeyRef{Name: token.Name, Key: "token"}}},
+			field:   "spec.envFrom[0].secretRef.name",
+		},
+		{
+			name:   "unmanaged secret mounted",
+			mounts: []SecretMount{{Secret: token.Name, MountPath: "/var/run/token"}},
+			field:  "spec.secretMounts[0].secret",
+		},
+		{
+			name:    "configmap",
+			envFrom: []EnvVarSource{{Name: "COLOR", ConfigMapRef: &KeyRef{Name: "settings", Key: "color"}}},
+		},
+		{
+			name:    "platform config",
+			envFrom: []EnvVarSource{{Name: "IDLE", ConfigMapRef: &KeyRef{Name: platformConfigName, Key: "scaleToZeroTimeout"}}},
+			field:   "spec.envFrom[0].configMapRef.name",
+		},
+		{
+			name:    "code of another function",
+			envFrom: []EnvVarSource{{Name: "CODE", ConfigMapRef: &KeyRef{Name: "billing-code", Key: "code"}}},
+			field:   "spec.envFrom[0].configMapRef.name",
+		},
+		{
+			name:    "dead letter",
+			envFrom: []EnvVarSource{{Name: "REQUEST", ConfigMapRef: &KeyRef{Name: "billing-dl-1", Key: "request"}}},
+			field:   "spec.envFrom[0].configMapRef.name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, _, _ := newFakeClient(managed, token, settings, platform, code, deadLetter)
+			fn := testFunction()
+			fn.EnvFrom = tt.envFrom
+			fn.SecretMounts = tt.mounts
+
+			err := k.checkSecretReferences(context.Background(), fn)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("checkSecretReferences: %v", err)
+				}
+				return
+			}
+			var errs ValidationErrors
+			if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != tt.field {
+				t.Fatalf("error = %v, want one error on %s", err, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EventSource turns events from outside the platform into invocations of
+// the functions whose triggers have its type. Sources register themselves
+// with RegisterEventSource from an init function; the TriggerManager starts
+// them and keeps them in step with the Functions in the cluster.
+type EventSource interface {
+	// Type is the trigger type the source serves, such as cron.
+	Type() string
+	// LeaderOnly reports whether the source runs only on the API server
+	// replica holding the controller lease, rather than on every replica.
+	LeaderOnly() bool
+	// Validate checks the config of one trigger. field is the path of the
+	// trigger's config, e.g. spec.triggers[0].config.
+	Validate(errs *ValidationErrors, field string, config map[string]string)
+	// Start starts the source, which delivers events through delivery
+	// until Stop is called or ctx is cancelled. A source can be started
+	// again after it was stopped.
+	Start(ctx context.Context, delivery *Delivery) error
+	Stop()
+	// Sync updates the source with the triggers of its type in fn. It is
+	// called for every change to a valid Function while the source runs.
+	Sync(fn *Function)
+	// Remove drops every trigger of a function.
+	Remove(function string)
+}
+
+var (
+	eventSourcesMu sync.Mutex
+	eventSources   = make(map[string]EventSource)
+)
+
+// RegisterEventSource makes a trigger type available. It panics if the
+// type is already registered.
+func RegisterEventSource(source EventSource) {
+	eventSourcesMu.Lock()
+	defer eventSourcesMu.Unlock()
+
+	if _, ok := eventSources[source.Type()]; ok {
+		panic(fmt.Sprintf("event source %q registered twice", source.Type()))
+	}
+	eventSources[source.Type()] = source
+}
+
+func eventSource(typ string) (EventSource, bool) {
+	eventSourcesMu.Lock()
+	defer eventSourcesMu.Unlock()
+
+	source, ok := eventSources[typ]
+	return source, ok
+}
+
+// registeredEventSources returns the registered sources sorted by type.
+func registeredEventSources() []EventSource {
+	eventSourcesMu.Lock()
+	defer eventSourcesMu.Unlock()
+
+	sources := make([]EventSource, 0, len(eventSources))
+	for _, source := range eventSources {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Type() < sources[j].Type()
+	})
+	return sources
+}
+
+// triggerTypes returns the registered trigger types, sorted.
+func triggerTypes() []string {
+	var types []string
+	for _, source := range registeredEventSources() {
+		types = append(types, source.Type())
+	}
+	return types
+}
+
+// namedTrigger is a trigger with its default name resolved.
+type namedTrigger struct {
+	name   string
+	config map[string]string
+}
+
+// triggersOfType returns the triggers of fn with the given type.
+func triggersOfType(fn *Function, typ string) []namedTrigger {
+	var triggers []namedTrigger
+	for i, trigger := range fn.Triggers {
+		if trigger.Type == typ {
+			triggers = append(triggers, namedTrigger{name: triggerName(i, trigger), config: trigger.Config})
+		}
+	}
+	return triggers
+}
+
+// Delivery is how event sources hand events to the invocation path. Every
+// invocation is routed by the function's traffic split.
+type Delivery struct {
+	server    *Server
+	k8sClient *KubernetesClient
+	config    *ConfigStore
+}
+
+func NewDelivery(server *Server) *Delivery {
+	return &Delivery{
+		server:    server,
+		k8sClient: server.k8sClient,
+		config:    server.config,
+	}
+}
+
+// Invoke runs an invocation and waits for the function's response.
+func (d *Delivery) Invoke(ctx context.Context, fn *Function, inv *InvocationRequest) (*InvocationResponse, error) {
+	resp, _, err := d.server.execute(ctx, fn.Name, routeInvocation(fn), invocationLimitsOf(fn), inv)
+	return resp, err
+}
+
+// Enqueue queues an asynchronous invocation, retried and dead-lettered
+// according to the function's retry policy. done, if set, is called with
+// the final record of the invocation.
+func (d *Delivery) Enqueue(fn *Function, source string, inv *InvocationRequest, done func(Invocation)) (*Invocation, error) {
+	return d.server.async.enqueue(fn, source, routeInvocation(fn), inv, done)
+}
+
+// Cancel stops a queued or running asynchronous invocation.
+func (d *Delivery) Cancel(id string) {
+	d.server.async.Cancel(id)
+}
+
+// Serve invokes fn with an HTTP request and writes the function's response,
+// as the invoke endpoint does.
+func (d *Delivery) Serve(w http.ResponseWriter, r *http.Request, fn *Function) {
+	d.server.invoke(w, r, fn, routeInvocation(fn))
+}
+
+// TriggerManager runs the registered event sources. Every replica watches
+// Functions and syncs the sources that run everywhere; the controller makes
+// it start the leader-only sources while this replica leads.
+type TriggerManager struct {
+	delivery *Delivery
+	sources  []EventSource
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+
+	mu      sync.Mutex
+	leading bool
+}
+
+func NewTriggerManager(delivery *Delivery) *TriggerManager {
+	k := delivery.k8sClient
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(k.dynamic, controllerResync, k.namespace, nil)
+
+	m := &TriggerManager{
+		delivery: delivery,
+		sources:  registeredEventSources(),
+		factory:  factory,
+		informer: factory.ForResource(functionGVR).Informer(),
+	}
+	m.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.sync,
+		UpdateFunc: func(_, obj interface{}) { m.sync(obj) },
+		DeleteFunc: m.remove,
+	})
+	return m
+}
+
+// Run starts the sources that run on every replica and watches Functions
+// until ctx is cancelled.
+func (m *TriggerManager) Run(ctx context.Context) {
+	for _, source := range m.sources {
+		if source.LeaderOnly() {
+			continue
+		}
+		if err := source.Start(ctx, m.delivery); err != nil {
+			log.Printf("Triggers: failed to start %s source: %v", source.Type(), err)
+			continue
+		}
+		defer source.Stop()
+	}
+
+	m.factory.Start(ctx.Done())
+	<-ctx.Done()
+}
+
+// StartLeading starts the leader-only sources and syncs them with every
+// known Function.
+func (m *TriggerManager) StartLeading(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.leading = true
+	for _, source := range m.sources {
+		if !source.LeaderOnly() {
+			continue
+		}
+		if err := source.Start(ctx, m.delivery); err != nil {
+			log.Printf("Triggers: failed to start %s source: %v", source.Type(), err)
+		}
+	}
+
+	for _, obj := range m.informer.GetStore().List() {
+		m.syncLocked(obj, true)
+	}
+}
+
+// StopLeading stops the leader-only sources.
+func (m *TriggerManager) StopLeading() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.leading = false
+	for _, source := range m.sources {
+		if source.LeaderOnly() {
+			source.Stop()
+		}
+	}
+}
+
+func (m *TriggerManager) sync(obj interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncLocked(obj, false)
+}
+
+// syncLocked syncs the running sources with a Function, or only the
+// leader-only ones. Functions that are being deleted or fail validation
+// have their triggers removed.
+func (m *TriggerManager) syncLocked(obj interface{}, leaderOnly bool) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	res, err := functionResourceFromUnstructured(u)
+	if err != nil {
+		log.Printf("Triggers: skipping function %s: %v", u.GetName(), err)
+		return
+	}
+
+	fn := res.Function()
+	m.delivery.k8sClient.applyDefaults(fn)
+	valid := res.DeletionTimestamp == nil && ValidateFunction(fn) == nil
+
+	for _, source := range m.sources {
+		if (leaderOnly && !source.LeaderOnly()) || (source.LeaderOnly() && !m.leading) {
+			continue
+		}
+		if valid {
+			source.Sync(fn)
+		} else {
+			source.Remove(fn.Name)
+		}
+	}
+}
+
+func (m *TriggerManager) remove(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, source := range m.sources {
+		if source.LeaderOnly() && !m.leading {
+			continue
+		}
+		source.Remove(u.GetName())
+	}
+}
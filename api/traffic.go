@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// TrafficTarget sends a share of a function's invocations to one revision.
+// A target either pins a revision by number, which then runs in its own
+// Deployment, or follows the latest revision, which runs in the function's
+// main Deployment.
+type TrafficTarget struct {
+	Revision       int64 `json:"revision,omitempty"`
+	LatestRevision bool  `json:"latestRevision,omitempty"`
+	Percent        int32 `json:"percent"`
+}
+
+// workload identifies the Deployment, Service and HPA that run one revision
+// of a function. Its name is shared by the three objects and used as the
+// pods' "function" label.
+type workload struct {
+	name          string
+	codeConfigMap string
+	// revision is the pinned revision the workload runs, or 0 for the
+	// function's main workload, which follows the spec.
+	revision int64
+}
+
+func mainWorkload(fn *Function) workload {
+	return workload{name: fn.Name, codeConfigMap: fn.Name + "-code"}
+}
+
+// revisionWorkload runs a revision pinned by the traffic split or an alias
+// from its immutable ConfigMap.
+func revisionWorkload(function string, revision int64) workload {
+	name := revisionConfigMapName(function, revision)
+	return workload{name: name, codeConfigMap: name, revision: revision}
+}
+
+func (w workload) labels(fn *Function) map[string]string {
+	labels := map[string]string{
+		"app.kubernetes.io/name":       fn.Name,
+		"app.kubernetes.io/managed-by": "kube-serverless",
+		"function":                     w.name,
+	}
+	if w.revision > 0 {
+		labels[functionLabel] = fn.Name
+		labels[revisionLabel] = strconv.FormatInt(w.revision, 10)
+	}
+	return labels
+}
+
+// pinnedRevisions returns the revisions the function's traffic split or
+// aliases refer to by number, in ascending order.
+func pinnedRevisions(fn *Function) []int64 {
+	seen := map[int64]bool{}
+	for _, target := range fn.Traffic {
+		if !target.LatestRevision && target.Revision > 0 {
+			seen[target.Revision] = true
+		}
+	}
+	for _, revision := range fn.Aliases {
+		if revision > 0 {
+			seen[revision] = true
+		}
+	}
+
+	revisions := make([]int64, 0, len(seen))
+	for revision := range seen {
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+	return revisions
+}
+
+// checkRevisionReferences verifies that every revision the traffic split
+// and aliases refer to exists, so a typo is rejected before the spec is
+// stored.
+func (k *KubernetesClient) checkRevisionReferences(ctx context.Context, fn *Function) error {
+	var errs ValidationErrors
+
+	check := func(field string, revision int64) error {
+		_, err := k.GetRevision(ctx, fn.Name, revision)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			errs.add(field, "function has no revision %d", revision)
+			return nil
+		}
+		return err
+	}
+
+	for i, target := range fn.Traffic {
+		if target.LatestRevision || target.Revision <= 0 {
+			continue
+		}
+		if err := check(fmt.Sprintf("spec.traffic[%d].revision", i), target.Revision); err != nil {
+			return err
+		}
+	}
+	for _, alias := range sortedAliases(fn.Aliases) {
+		if fn.Aliases[alias] <= 0 {
+			continue
+		}
+		if err := check(fmt.Sprintf("spec.aliases[%s]", alias), fn.Aliases[alias]); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// revisionFunction returns fn with the code, handler, runtime and
+// environment of a recorded revision, for building that revision's
+// workload.
+func (k *KubernetesClient) revisionFunction(ctx context.Context, fn *Function, revision int64) (*Function, error) {
+	rev, err := k.GetRevision(ctx, fn.Name, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	rfn := *fn
+	rfn.Runtime = rev.Runtime
+	rfn.Handler = rev.Handler
+	rfn.Code = rev.Code
+	rfn.Environment = rev.Environment
+	return &rfn, nil
+}
+
+// staleRevisionWorkloads returns the revision workloads of a function that
+// neither a traffic target nor an alias pins any more.
+func (k *KubernetesClient) staleRevisionWorkloads(ctx context.Context, fn *Function) ([]functionObject, error) {
+	pinned := map[string]bool{}
+	for _, revision := range pinnedRevisions(fn) {
+		pinned[revisionWorkload(fn.Name, revision).name] = true
+	}
+
+	opts := metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			"app.kubernetes.io/managed-by": "kube-serverless",
+			functionLabel:                  fn.Name,
+		}).String() + "," + revisionLabel,
+	}
+
+	var stale []functionObject
+
+	// Listed in creation order so that deleteFunctionObjects removes the
+	// HPA before the Deployment it scales.
+	deployments, err := k.clientset.AppsV1().Deployments(k.namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments.Items {
+		if !pinned[d.Name] {
+			stale = append(stale, functionObject{kind: "deployment", name: d.Name})
+		}
+	}
+
+	services, err := k.clientset.CoreV1().Services(k.namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range services.Items {
+		if !pinned[svc.Name] {
+			stale = append(stale, functionObject{kind: "service", name: svc.Name})
+		}
+	}
+
+	hpas, err := k.clientset.AutoscalingV2().HorizontalPodAutoscalers(k.namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, hpa := range hpas.Items {
+		if !pinned[hpa.Name] {
+			stale = append(stale, functionObject{kind: "hpa", name: hpa.Name})
+		}
+	}
+
+	return stale, nil
+}
+
+// invocationTarget is the workload chosen to serve an invocation.
+type invocationTarget struct {
+	// backend is the name of the workload's Deployment and Service.
+	backend string
+	// revision labels the invocation's metrics.
+	revision string
+}
+
+// routeInvocation picks the workload for an invocation according to the
+// function's traffic split.
+func routeInvocation(fn *Function) invocationTarget {
+	return selectTarget(fn, rand.Int31n(100))
+}
+
+// selectTarget returns the target whose cumulative percentage range holds
+// n, which must be in [0, 100).
+func selectTarget(fn *Function, n int32) invocationTarget {
+	latest := invocationTarget{backend: fn.Name, revision: "latest"}
+	if fn.Status.Revision > 0 {
+		latest.revision = strconv.FormatInt(fn.Status.Revision, 10)
+	}
+
+	var cumulative int32
+	for _, target := range fn.Traffic {
+		cumulative += target.Percent
+		if n >= cumulative {
+			continue
+		}
+		if target.LatestRevision {
+			return latest
+		}
+		return invocationTarget{
+			backend:  revisionWorkload(fn.Name, target.Revision).name,
+			revision: strconv.FormatInt(target.Revision, 10),
+		}
+	}
+
+	return latest
+}
+
+// aliasTarget returns the workload serving a function's alias.
+func aliasTarget(fn *Function, alias string) (invocationTarget, error) {
+	revision, ok := fn.Aliases[alias]
+	if !ok {
+		return invocationTarget{}, NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no alias %s", fn.Name, alias))
+	}
+	return invocationTarget{
+		backend:  revisionWorkload(fn.Name, revision).name,
+		revision: strconv.FormatInt(revision, 10),
+	}, nil
+}
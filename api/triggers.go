@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	triggerLabel = "serverless.kube.io/trigger"
+	// triggerHistorySize is the number of runs kept per trigger.
+	triggerHistorySize = 20
+)
+
+// TriggerRunSkipped is the state of a run that was not started, because of
+// the trigger's concurrency policy or because it could not be queued.
+// Other runs report the state of their invocation.
+const TriggerRunSkipped = "skipped"
+
+// TriggerRun is one firing of a trigger and the outcome of the invocation
+// it started.
+type TriggerRun struct {
+	InvocationID string     `json:"invocationId,omitempty"`
+	ScheduledAt  time.Time  `json:"scheduledAt"`
+	State        string     `json:"state"`
+	Attempts     int32      `json:"attempts,omitempty"`
+	StatusCode   int        `json:"statusCode,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	DeadLetter   string     `json:"deadLetter,omitempty"`
+	CompletedAt  *time.Time `json:"completedAt,omitempty"`
+}
+
+func triggerRunsConfigMapName(function, trigger string) string {
+	return fmt.Sprintf("%s-trigger-%s", function, trigger)
+}
+
+// isTriggerRuns reports whether cm holds the run history of a trigger. The
+// name of the history may be taken by another object, such as the code of
+// the function "a-trigger-x" for the trigger "x-code" of the function "a".
+func isTriggerRuns(cm *corev1.ConfigMap, function, trigger string) bool {
+	return cm.Labels[functionLabel] == function && cm.Labels[triggerLabel] == trigger
+}
+
+// RecordTriggerRun adds a run to a trigger's history, or updates the run of
+// the same invocation. The history is a ConfigMap owned by the Function
+// holding its most recent runs, newest first.
+func (k *KubernetesClient) RecordTriggerRun(ctx context.Context, function, trigger string, run TriggerRun) error {
+	name := triggerRunsConfigMapName(function, trigger)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			res, err := k.getFunctionResource(ctx, function)
+			if err != nil {
+				return err
+			}
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: k.namespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/name":       function,
+						"app.kubernetes.io/managed-by": "kube-serverless",
+						functionLabel:                  function,
+						triggerLabel:                   trigger,
+					},
+				},
+			}
+			setOwner(&cm.ObjectMeta, res.ownerReference())
+		} else if err != nil {
+			return err
+		} else if !isTriggerRuns(cm, function, trigger) {
+			return NewAPIError(http.StatusConflict, fmt.Sprintf(
+				"configmap %s holding the runs of trigger %s of function %s already exists for another object", name, trigger, function))
+		}
+
+		runs, err := triggerRunsFromConfigMap(cm)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(addTriggerRun(runs, run))
+		if err != nil {
+			return err
+		}
+		cm.Data = map[string]string{"runs": string(data)}
+
+		if cm.ResourceVersion == "" {
+			_, err = k.clientset.CoreV1().ConfigMaps(k.namespace).Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			_, err = k.clientset.CoreV1().ConfigMaps(k.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
+
+// addTriggerRun merges run into a history. A run that already finished is
+// never overwritten, since the outcome of a fast invocation may be
+// recorded before its start.
+func addTriggerRun(runs []TriggerRun, run TriggerRun) []TriggerRun {
+	if run.InvocationID != "" {
+		for i := range runs {
+			if runs[i].InvocationID != run.InvocationID {
+				continue
+			}
+			if runs[i].CompletedAt == nil {
+				runs[i] = run
+			}
+			return runs
+		}
+	}
+
+	runs = append([]TriggerRun{run}, runs...)
+	if len(runs) > triggerHistorySize {
+		runs = runs[:triggerHistorySize]
+	}
+	return runs
+}
+
+func triggerRunsFromConfigMap(cm *corev1.ConfigMap) ([]TriggerRun, error) {
+	var runs []TriggerRun
+	if data, ok := cm.Data["runs"]; ok {
+		if err := json.Unmarshal([]byte(data), &runs); err != nil {
+			return nil, fmt.Errorf("configmap %s has an invalid run history: %w", cm.Name, err)
+		}
+	}
+	return runs, nil
+}
+
+// ListTriggerRuns returns the recent runs of a trigger, newest first.
+func (k *KubernetesClient) ListTriggerRuns(ctx context.Context, name, trigger string) ([]TriggerRun, error) {
+	fn, err := k.GetFunction(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for i, t := range fn.Triggers {
+		if triggerName(i, t) == trigger {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Sprintf("function %s has no trigger %s", name, trigger))
+	}
+
+	cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, triggerRunsConfigMapName(name, trigger), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && !isTriggerRuns(cm, name, trigger)) {
+		return []TriggerRun{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := triggerRunsFromConfigMap(cm)
+	if err != nil {
+		return nil, err
+	}
+	if runs == nil {
+		runs = []TriggerRun{}
+	}
+	return runs, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecordTriggerRunLeavesOtherObjects(t *testing.T) {
+	// The code of the function "hello-trigger-x" has the name of the run
+	// history of the trigger "x-code" of the function "hello".
+	code := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "hello-trigger-x-code",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "kube-serverless"},
+		},
+		Data: map[string]string{"code": "def handler(event): pass"},
+	}
+	k, clientset, _ := newFakeClient(code)
+	ctx := context.Background()
+	if _, _, err := k.createOrAdoptFunctionResource(ctx, testFunction()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := k.RecordTriggerRun(ctx, "hello", "x-code", TriggerRun{ScheduledAt: time.Now(), State: TriggerRunSkipped})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusConflict {
+		t.Fatalf("error = %v, want a conflict", err)
+	}
+
+	got, err := clientset.CoreV1().ConfigMaps(testNamespace).Get(ctx, code.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Data["code"] != code.Data["code"] || got.Data["runs"] != "" {
+		t.Errorf("data = %v, want the code unchanged", got.Data)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// reservedEnvVars are set by the platform and cannot be overridden.
+var reservedEnvVars = map[string]bool{
+	"FUNCTION_NAME":    true,
+	"FUNCTION_HANDLER": true,
+	"RUNTIME":          true,
+	"FUNCTION_TIMEOUT": true,
+}
+
+// revisionWorkloadSuffix ends the names of the workloads of pinned
+// revisions, which a function name must not mimic.
+var revisionWorkloadSuffix = regexp.MustCompile(`-rev-[0-9]+$`)
+
+// ValidationErrors lists every invalid field of a function spec.
+type ValidationErrors []FieldDetail
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldDetail{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateFunction checks a function before anything is sent to the
+// cluster and returns ValidationErrors listing every invalid field. Defaults
+// are expected to have been applied already.
+func ValidateFunction(fn *Function) error {
+	var errs ValidationErrors
+
+	if fn.Name == "" {
+		errs.add("metadata.name", "required")
+	} else {
+		// The name is used for the function's Service, which must be a
+		// DNS-1035 label.
+		for _, msg := range validation.IsDNS1035Label(fn.Name) {
+			errs.add("metadata.name", "%s", msg)
+		}
+		if revisionWorkloadSuffix.MatchString(fn.Name) {
+			errs.add("metadata.name", "must not end in -rev-<number>, which names revision workloads")
+		}
+	}
+
+	if fn.Runtime == "" {
+		errs.add("spec.runtime", "required")
+	} else if _, ok := runtimeImages[fn.Runtime]; !ok {
+		errs.add("spec.runtime", "unsupported runtime %q, must be one of %s", fn.Runtime, strings.Join(supportedRuntimes(), ", "))
+	}
+
+	if fn.Handler == "" {
+		errs.add("spec.handler", "required")
+	}
+	if fn.Code == "" {
+		errs.add("spec.code", "required")
+	}
+
+	if fn.MinReplicas < 0 {
+		errs.add("spec.minReplicas", "must be greater than or equal to 0")
+	}
+	if fn.MaxReplicas < 1 {
+		errs.add("spec.maxReplicas", "must be greater than or equal to 1")
+	}
+	if fn.MinReplicas > fn.MaxReplicas {
+		errs.add("spec.minReplicas", "must not be greater than maxReplicas (%d)", fn.MaxReplicas)
+	}
+
+	for _, name := range sortedKeys(fn.Environment) {
+		field := fmt.Sprintf("spec.environment[%s]", name)
+		if reservedEnvVars[name] {
+			errs.add(field, "reserved by the platform")
+			continue
+		}
+		for _, msg := range validation.IsEnvVarName(name) {
+			errs.add(field, "%s", msg)
+		}
+	}
+
+	validateEnvFrom(&errs, fn)
+	validateSecretMounts(&errs, fn)
+
+	triggerNames := make(map[string]bool, len(fn.Triggers))
+	for i, trigger := range fn.Triggers {
+		field := fmt.Sprintf("spec.triggers[%d]", i)
+		validateTrigger(&errs, field, trigger)
+
+		// Trigger names are used in the names of the objects that record
+		// trigger runs.
+		name := triggerName(i, trigger)
+		for _, msg := range validation.IsDNS1123Label(name) {
+			errs.add(field+".name", "%s", msg)
+		}
+		if triggerNames[name] {
+			errs.add(field+".name", "duplicate trigger name %q", name)
+		}
+		triggerNames[name] = true
+	}
+
+	routes := httpRoutes(fn)
+	for i := range routes {
+		for j := 0; j < i; j++ {
+			if routes[i].overlaps(routes[j]) {
+				errs.add("spec.triggers", "http trigger %s routes the same requests as %s", routes[i].trigger, routes[j].trigger)
+			}
+		}
+	}
+
+	validateTraffic(&errs, fn)
+
+	if fn.RetryPolicy != nil {
+		validateRetryPolicy(&errs, fn.RetryPolicy)
+	}
+
+	validateResources(&errs, fn.Resources)
+
+	if fn.Scaling != nil {
+		validateScaling(&errs, fn.Scaling)
+	}
+
+	if fn.TimeoutSeconds < 0 || fn.TimeoutSeconds > maxTimeoutSeconds {
+		errs.add("spec.timeoutSeconds", "must be 0 (default) or between 1 and %d", maxTimeoutSeconds)
+	}
+
+	if fn.MaxConcurrency < 0 {
+		errs.add("spec.maxConcurrency", "must be greater than or equal to 0")
+	}
+	if fn.MaxQueueDepth < 0 {
+		errs.add("spec.maxQueueDepth", "must be greater than or equal to 0")
+	} else if fn.MaxQueueDepth > 0 && fn.MaxConcurrency == 0 {
+		errs.add("spec.maxQueueDepth", "requires maxConcurrency")
+	}
+
+	for _, alias := range sortedAliases(fn.Aliases) {
+		field := fmt.Sprintf("spec.aliases[%s]", alias)
+		for _, msg := range validation.IsDNS1123Label(alias) {
+			errs.add(field, "%s", msg)
+		}
+		revision := fn.Aliases[alias]
+		if revision < 1 {
+			errs.add(field, "must be greater than or equal to 1")
+			continue
+		}
+		validateRevisionWorkloadName(&errs, field, fn.Name, revision)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateTrigger checks a trigger's type against the registered event
+// sources and has the source check its config.
+func validateTrigger(errs *ValidationErrors, field string, trigger Trigger) {
+	if trigger.Type == "" {
+		errs.add(field+".type", "required")
+		return
+	}
+	source, ok := eventSource(trigger.Type)
+	if !ok {
+		errs.add(field+".type", "unsupported trigger type %q, must be one of %s", trigger.Type, strings.Join(triggerTypes(), ", "))
+		return
+	}
+	source.Validate(errs, field+".config", trigger.Config)
+}
+
+// validateTraffic checks the traffic split. Whether pinned revisions exist
+// is checked against the cluster by checkRevisionReferences.
+func validateTraffic(errs *ValidationErrors, fn *Function) {
+	if len(fn.Traffic) == 0 {
+		return
+	}
+
+	var total int32
+	seen := map[string]bool{}
+	for i, target := range fn.Traffic {
+		field := fmt.Sprintf("spec.traffic[%d]", i)
+
+		if target.Percent < 0 || target.Percent > 100 {
+			errs.add(field+".percent", "must be between 0 and 100")
+		}
+		total += target.Percent
+
+		key := "latest"
+		switch {
+		case target.LatestRevision && target.Revision != 0:
+			errs.add(field, "revision and latestRevision are mutually exclusive")
+			continue
+		case target.LatestRevision:
+		case target.Revision < 1:
+			errs.add(field+".revision", "must be greater than or equal to 1 unless latestRevision is set")
+			continue
+		default:
+			key = strconv.FormatInt(target.Revision, 10)
+			validateRevisionWorkloadName(errs, field+".revision", fn.Name, target.Revision)
+		}
+
+		if seen[key] {
+			errs.add(field, "duplicate traffic target")
+		}
+		seen[key] = true
+	}
+
+	if total != 100 {
+		errs.add("spec.traffic", "percentages must add up to 100, got %d", total)
+	}
+}
+
+// validateRevisionWorkloadName checks that a pinned revision can run as its
+// own Service, whose name must be a DNS-1035 label.
+func validateRevisionWorkloadName(errs *ValidationErrors, field, function string, revision int64) {
+	if function == "" {
+		return
+	}
+	for _, msg := range validation.IsDNS1035Label(revisionWorkload(function, revision).name) {
+		errs.add(field, "function name too long to run revision %d separately: %s", revision, msg)
+	}
+}
+
+func supportedRuntimes() []string {
+	return sortedKeys(runtimeImages)
+}
+
+func sortedAliases(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func validateRetryPolicy(errs *ValidationErrors, p *RetryPolicy) {
+	if p.MaxAttempts < 0 {
+		errs.add("spec.retryPolicy.maxAttempts", "must be 0 (default) or greater than or equal to 1")
+	}
+	if p.InitialBackoffSeconds < 0 {
+		errs.add("spec.retryPolicy.initialBackoffSeconds", "must be greater than or equal to 0")
+	}
+	if p.MaxBackoffSeconds < 0 {
+		errs.add("spec.retryPolicy.maxBackoffSeconds", "must be greater than or equal to 0")
+	}
+	if p.InitialBackoffSeconds > 0 && p.MaxBackoffSeconds > 0 && p.InitialBackoffSeconds > p.MaxBackoffSeconds {
+		errs.add("spec.retryPolicy.initialBackoffSeconds", "must not be greater than maxBackoffSeconds (%d)", p.MaxBackoffSeconds)
+	}
+	for i, code := range p.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			errs.add(fmt.Sprintf("spec.retryPolicy.retryableStatusCodes[%d]", i), "must be an HTTP status code between 100 and 599")
+		}
+	}
+}
+
+func validateScaling(errs *ValidationErrors, p *ScalingPolicy) {
+	switch p.Metric {
+	case "", ScalingMetricCPU:
+	case ScalingMetricConcurrency, ScalingMetricRPS:
+		if p.Target == 0 {
+			errs.add("spec.scaling.target", "required for the %s metric", p.Metric)
+		}
+	default:
+		errs.add("spec.scaling.metric", "unsupported metric %q, must be one of %s, %s, %s",
+			p.Metric, ScalingMetricConcurrency, ScalingMetricCPU, ScalingMetricRPS)
+	}
+	if p.Target < 0 {
+		errs.add("spec.scaling.target", "must be 0 (default) or greater than or equal to 1")
+	}
+	windows := []struct {
+		field   string
+		seconds *int32
+	}{
+		{"spec.scaling.scaleUpStabilizationSeconds", p.ScaleUpStabilizationSeconds},
+		{"spec.scaling.scaleDownStabilizationSeconds", p.ScaleDownStabilizationSeconds},
+	}
+	for _, w := range windows {
+		if w.seconds != nil && (*w.seconds < 0 || *w.seconds > maxStabilizationSeconds) {
+			errs.add(w.field, "must be between 0 and %d", maxStabilizationSeconds)
+		}
+	}
+}
+
+// validateEnvFrom checks the env sources. Whether the Secrets and
+// ConfigMaps exist is checked against the cluster by checkSecretReferences.
+func validateEnvFrom(errs *ValidationErrors, fn *Function) {
+	names := make(map[string]bool, len(fn.EnvFrom))
+	for i, source := range fn.EnvFrom {
+		field := fmt.Sprintf("spec.envFrom[%d]", i)
+
+		switch {
+		case source.Name == "":
+			errs.add(field+".name", "required")
+		case reservedEnvVars[source.Name]:
+			errs.add(field+".name", "reserved by the platform")
+		case names[source.Name]:
+			errs.add(field+".name", "duplicate variable %q", source.Name)
+		default:
+			if _, ok := fn.Environment[source.Name]; ok {
+				errs.add(field+".name", "%q is also set in spec.environment", source.Name)
+			}
+			for _, msg := range validation.IsEnvVarName(source.Name) {
+				errs.add(field+".name", "%s", msg)
+			}
+		}
+		names[source.Name] = true
+
+		ref, refField := source.SecretRef, field+".secretRef"
+		if source.ConfigMapRef != nil {
+			ref, refField = source.ConfigMapRef, field+".configMapRef"
+		}
+		if (source.SecretRef == nil) == (source.ConfigMapRef == nil) {
+			errs.add(field, "must set exactly one of secretRef and configMapRef")
+			continue
+		}
+		if ref.Name == "" {
+			errs.add(refField+".name", "required")
+		} else {
+			for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+				errs.add(refField+".name", "%s", msg)
+			}
+		}
+		if ref.Key == "" {
+			errs.add(refField+".key", "required")
+		} else {
+			for _, msg := range validation.IsConfigMapKey(ref.Key) {
+				errs.add(refField+".key", "%s", msg)
+			}
+		}
+	}
+}
+
+// validateSecretMounts checks that secret mounts name a Secret and get a
+// directory of their own outside the function code.
+func validateSecretMounts(errs *ValidationErrors, fn *Function) {
+	paths := make(map[string]bool, len(fn.SecretMounts))
+	for i, mount := range fn.SecretMounts {
+		field := fmt.Sprintf("spec.secretMounts[%d]", i)
+
+		if mount.Secret == "" {
+			errs.add(field+".secret", "required")
+		} else {
+			for _, msg := range validation.IsDNS1123Subdomain(mount.Secret) {
+				errs.add(field+".secret", "%s", msg)
+			}
+		}
+
+		p := path.Clean(mount.MountPath)
+		switch {
+		case mount.MountPath == "":
+			errs.add(field+".mountPath", "required")
+		case !path.IsAbs(mount.MountPath):
+			errs.add(field+".mountPath", "must be an absolute path")
+		case p == "/" || p == "/function" || strings.HasPrefix(p, "/function/"):
+			errs.add(field+".mountPath", "must not be / or inside /function")
+		case paths[p]:
+			errs.add(field+".mountPath", "duplicate mount path %q", p)
+		}
+		paths[p] = true
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
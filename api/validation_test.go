@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidateFunction(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(fn *Function)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(fn *Function) {},
+		},
+		{
+			name:   "empty name",
+			modify: func(fn *Function) { fn.Name = "" },
+			fields: []string{"metadata.name"},
+		},
+		{
+			name:   "uppercase name",
+			modify: func(fn *Function) { fn.Name = "Hello" },
+			fields: []string{"metadata.name"},
+		},
+		{
+			name:   "name of a revision workload",
+			modify: func(fn *Function) { fn.Name = "hello-rev-2" },
+			fields: []string{"metadata.name"},
+		},
+		{
+			name:   "unknown runtime",
+			modify: func(fn *Function) { fn.Runtime = "cobol85" },
+			fields: []string{"spec.runtime"},
+		},
+		{
+			name:   "missing handler and code",
+			modify: func(fn *Function) { fn.Handler, fn.Code = "", "" },
+			fields: []string{"spec.handler", "spec.code"},
+		},
+		{
+			name:   "min replicas above max",
+			modify: func(fn *Function) { fn.MinReplicas, fn.MaxReplicas = 5, 2 },
+			fields: []string{"spec.minReplicas"},
+		},
+		{
+			name: "bad environment names",
+			modify: func(fn *Function) {
+				fn.Environment = map[string]string{"1LOG": "debug", "RUNTIME": "go", "OK": "yes"}
+			},
+			fields: []string{"spec.environment[1LOG]", "spec.environment[RUNTIME]"},
+		},
+		{
+			name: "unknown trigger type",
+			modify: func(fn *Function) {
+				fn.Triggers = []Trigger{{Type: "carrier-pigeon"}}
+			},
+			fields: []string{"spec.triggers[0].type"},
+		},
+		{
+			name: "invalid cron schedule",
+			modify: func(fn *Function) {
+				fn.Triggers = []Trigger{
+					{Type: "http", Config: map[string]string{"path": "/hello"}},
+					{Type: "cron", Config: map[string]string{"schedule": "every minute"}},
+				}
+			},
+			fields: []string{"spec.triggers[1].config.schedule"},
+		},
+		{
+			name: "duplicate trigger names",
+			modify: func(fn *Function) {
+				fn.Triggers = []Trigger{
+					{Name: "nightly", Type: "cron", Config: map[string]string{"schedule": "0 2 * * *"}},
+					{Name: "nightly", Type: "cron", Config: map[string]string{"schedule": "0 3 * * *"}},
+				}
+			},
+			fields: []string{"spec.triggers[1].name"},
+		},
+		{
+			name:   "timeout too long",
+			modify: func(fn *Function) { fn.TimeoutSeconds = 901 },
+			fields: []string{"spec.timeoutSeconds"},
+		},
+		{
+			name:   "negative max attempts",
+			modify: func(fn *Function) { fn.RetryPolicy = &RetryPolicy{MaxAttempts: -1} },
+			fields: []string{"spec.retryPolicy.maxAttempts"},
+		},
+		{
+			name: "traffic not adding up to 100",
+			modify: func(fn *Function) {
+				fn.Traffic = []TrafficTarget{{Revision: 1, Percent: 50}, {LatestRevision: true, Percent: 40}}
+			},
+			fields: []string{"spec.traffic"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := testFunction()
+			fn.MaxReplicas = 10
+			tt.modify(fn)
+
+			err := ValidateFunction(fn)
+			var fields []string
+			var errs ValidationErrors
+			if errors.As(err, &errs) {
+				for _, e := range errs {
+					fields = append(fields, e.Field)
+				}
+			} else if err != nil {
+				t.Fatalf("ValidateFunction: %v", err)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("invalid fields = %q, want %q (errors: %v)", fields, tt.fields, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+type Alias struct {
+	Name     string `json:"name"`
+	Revision int64  `json:"revision"`
+}
+
+func newAliasCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Manage function aliases",
+	}
+
+	cmd.AddCommand(newAliasSetCommand())
+	cmd.AddCommand(newAliasListCommand())
+	cmd.AddCommand(newAliasDeleteCommand())
+
+	return cmd
+}
+
+func newAliasSetCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set [function-name] [alias] [revision]",
+		Short: "Point an alias at a revision",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, alias := args[0], args[1]
+			revision, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid revision %q", args[2])
+			}
+
+			jsonData, err := json.Marshal(map[string]int64{"revision": revision})
+			if err != nil {
+				return fmt.Errorf("failed to marshal alias: %w", err)
+			}
+
+			url := fmt.Sprintf("%s/api/v1/functions/%s/aliases/%s", apiURL, name, alias)
+			req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
+			if err != nil {
+				return fmt.Errorf("failed to create request: %w", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("failed to set alias: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to set alias: %w", readAPIError(resp))
+			}
+
+			fmt.Printf("Alias '%s:%s' now points at revision %d\n", name, alias, revision)
+			return nil
+		},
+	}
+}
+
+func newAliasListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list [function-name]",
+		Short: "List the aliases of a function",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			url := fmt.Sprintf("%s/api/v1/functions/%s/aliases", apiURL, name)
+
+			resp, err := http.Get(url)
+			if err != nil {
+				return fmt.Errorf("failed to list aliases: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to list aliases: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+
+			var aliases []Alias
+			if err := json.Unmarshal(body, &aliases); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "ALIAS\tREVISION")
+			for _, alias := range aliases {
+				fmt.Fprintf(w, "%s\t%d\n", alias.Name, alias.Revision)
+			}
+			w.Flush()
+
+			return nil
+		},
+	}
+}
+
+func newAliasDeleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete [function-name] [alias]",
+		Short: "Delete an alias",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, alias := args[0], args[1]
+			url := fmt.Sprintf("%s/api/v1/functions/%s/aliases/%s", apiURL, name, alias)
+
+			req, err := http.NewRequest("DELETE", url, nil)
+			if err != nil {
+				return fmt.Errorf("failed to create request: %w", err)
+			}
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("failed to delete alias: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNoContent {
+				return fmt.Errorf("failed to delete alias: %w", readAPIError(resp))
+			}
+
+			fmt.Printf("Alias '%s:%s' deleted successfully\n", name, alias)
+			return nil
+		},
+	}
+}
+
+// functionPath returns the API path of a function, or of one of its aliases
+// when name has the form function:alias.
+func functionPath(name string) string {
+	if function, alias, ok := strings.Cut(name, ":"); ok {
+		return fmt.Sprintf("%s/api/v1/functions/%s/aliases/%s", apiURL, function, alias)
+	}
+	return fmt.Sprintf("%s/api/v1/functions/%s", apiURL, name)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// APIError is the error envelope returned by the API server.
+type APIError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+type fieldDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (HTTP %d)", e.Message, e.Code)
+
+	if len(e.Details) == 0 {
+		return b.String()
+	}
+
+	var fields []fieldDetail
+	if err := json.Unmarshal(e.Details, &fields); err == nil {
+		for _, f := range fields {
+			if f.Field != "" {
+				fmt.Fprintf(&b, "\n  - %s: %s", f.Field, f.Message)
+			} else {
+				fmt.Fprintf(&b, "\n  - %s", f.Message)
+			}
+		}
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "\n  %s", string(e.Details))
+	return b.String()
+}
+
+// readAPIError reads an unsuccessful response into an error, using the
+// API's JSON error envelope when the body carries one.
+func readAPIError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("HTTP %d: failed to read response: %w", resp.StatusCode, err)
+	}
+
+	var apiErr APIError
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Message != "" {
+		if apiErr.Code == 0 {
+			apiErr.Code = resp.StatusCode
+		}
+		return &apiErr
+	}
+
+	text := strings.TrimSpace(string(body))
+	if text == "" {
+		text = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("%s (HTTP %d)", text, resp.StatusCode)
+}
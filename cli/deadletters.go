@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type DeadLetter struct {
+	ID           string    `json:"id"`
+	Function     string    `json:"function"`
+	Source       string    `json:"source"`
+	InvocationID string    `json:"invocationId"`
+	Attempts     int32     `json:"attempts"`
+	StatusCode   int       `json:"statusCode"`
+	Error        string    `json:"error"`
+	FailedAt     time.Time `json:"failedAt"`
+}
+
+func newDeadLettersCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deadletters",
+		Short: "Manage invocations that failed after their last retry",
+	}
+
+	cmd.AddCommand(newDeadLettersListCommand())
+	cmd.AddCommand(newDeadLettersRedriveCommand())
+	cmd.AddCommand(newDeadLettersDeleteCommand())
+
+	return cmd
+}
+
+func newDeadLettersListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list [function-name]",
+		Short: "List the dead letters of a function",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/functions/%s/deadletters", apiURL, args[0])
+
+			resp, err := http.Get(url)
+			if err != nil {
+				return fmt.Errorf("failed to list dead letters: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to list dead letters: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+
+			var deadLetters []DeadLetter
+			if err := json.Unmarshal(body, &deadLetters); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "ID\tSOURCE\tATTEMPTS\tSTATUS\tFAILED\tERROR")
+			for _, dl := range deadLetters {
+				status := "-"
+				if dl.StatusCode != 0 {
+					status = fmt.Sprintf("%d", dl.StatusCode)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+					dl.ID,
+					dl.Source,
+					dl.Attempts,
+					status,
+					dl.FailedAt.Local().Format(time.RFC3339),
+					dl.Error,
+				)
+			}
+			w.Flush()
+
+			return nil
+		},
+	}
+}
+
+func newDeadLettersRedriveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "redrive [function-name] [dead-letter-id]",
+		Short: "Queue the request of a dead letter again",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/functions/%s/deadletters/%s/redrive", apiURL, args[0], args[1])
+
+			resp, err := http.Post(url, "application/json", nil)
+			if err != nil {
+				return fmt.Errorf("failed to re-drive dead letter: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusAccepted {
+				return fmt.Errorf("failed to re-drive dead letter: %w", readAPIError(resp))
+			}
+
+			var inv Invocation
+			if err := json.NewDecoder(resp.Body).Decode(&inv); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			fmt.Printf("Dead letter '%s' re-driven as invocation %s\n", args[1], inv.ID)
+			fmt.Printf("Check it with: ksls invocation get %s\n", inv.ID)
+			return nil
+		},
+	}
+}
+
+func newDeadLettersDeleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete [function-name] [dead-letter-id]",
+		Short: "Discard a dead letter",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/functions/%s/deadletters/%s", apiURL, args[0], args[1])
+
+			req, err := http.NewRequest("DELETE", url, nil)
+			if err != nil {
+				return fmt.Errorf("failed to create request: %w", err)
+			}
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("failed to delete dead letter: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNoContent {
+				return fmt.Errorf("failed to delete dead letter: %w", readAPIError(resp))
+			}
+
+			fmt.Printf("Dead letter '%s' deleted successfully\n", args[1])
+			return nil
+		},
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/spf13/cobra"
@@ -30,8 +29,7 @@ func newDeleteCommand() *cobra.Command {
 			defer resp.Body.Close()
 
 			if resp.StatusCode != http.StatusNoContent {
-				body, _ := ioutil.ReadAll(resp.Body)
-				return fmt.Errorf("failed to delete function: %s", string(body))
+				return fmt.Errorf("failed to delete function: %w", readAPIError(resp))
 			}
 
 			fmt.Printf("Function '%s' deleted successfully\n", name)
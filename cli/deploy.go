@@ -6,29 +6,86 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 )
 
 type FunctionSpec struct {
-	Name        string            `yaml:"name" json:"name"`
-	Runtime     string            `yaml:"runtime" json:"runtime"`
-	Handler     string            `yaml:"handler" json:"handler"`
-	Code        string            `yaml:"code" json:"code"`
-	CodeFile    string            `yaml:"codeFile,omitempty" json:"-"`
-	Environment map[string]string `yaml:"environment,omitempty" json:"environment,omitempty"`
-	MinReplicas int32             `yaml:"minReplicas,omitempty" json:"minReplicas,omitempty"`
-	MaxReplicas int32             `yaml:"maxReplicas,omitempty" json:"maxReplicas,omitempty"`
-	Triggers    []Trigger         `yaml:"triggers,omitempty" json:"triggers,omitempty"`
+	Name           string            `yaml:"name" json:"name"`
+	Runtime        string            `yaml:"runtime" json:"runtime"`
+	Handler        string            `yaml:"handler" json:"handler"`
+	Code           string            `yaml:"code" json:"code"`
+	CodeFile       string            `yaml:"codeFile,omitempty" json:"-"`
+	Environment    map[string]string `yaml:"environment,omitempty" json:"environment,omitempty"`
+	EnvFrom        []EnvVarSource    `yaml:"envFrom,omitempty" json:"envFrom,omitempty"`
+	SecretMounts   []SecretMount     `yaml:"secretMounts,omitempty" json:"secretMounts,omitempty"`
+	MinReplicas    int32             `yaml:"minReplicas,omitempty" json:"minReplicas,omitempty"`
+	MaxReplicas    int32             `yaml:"maxReplicas,omitempty" json:"maxReplicas,omitempty"`
+	Triggers       []Trigger         `yaml:"triggers,omitempty" json:"triggers,omitempty"`
+	Traffic        []TrafficTarget   `yaml:"traffic,omitempty" json:"traffic,omitempty"`
+	Aliases        map[string]int64  `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	RetryPolicy    *RetryPolicy      `yaml:"retryPolicy,omitempty" json:"retryPolicy,omitempty"`
+	Resources      *Resources        `yaml:"resources,omitempty" json:"resources,omitempty"`
+	Scaling        *ScalingPolicy    `yaml:"scaling,omitempty" json:"scaling,omitempty"`
+	MaxConcurrency int32             `yaml:"maxConcurrency,omitempty" json:"maxConcurrency,omitempty"`
+	MaxQueueDepth  int32             `yaml:"maxQueueDepth,omitempty" json:"maxQueueDepth,omitempty"`
+	TimeoutSeconds int32             `yaml:"timeoutSeconds,omitempty" json:"timeoutSeconds,omitempty"`
+}
+
+type EnvVarSource struct {
+	Name         string  `yaml:"name" json:"name"`
+	SecretRef    *KeyRef `yaml:"secretRef,omitempty" json:"secretRef,omitempty"`
+	ConfigMapRef *KeyRef `yaml:"configMapRef,omitempty" json:"configMapRef,omitempty"`
+}
+
+type KeyRef struct {
+	Name string `yaml:"name" json:"name"`
+	Key  string `yaml:"key" json:"key"`
+}
+
+type SecretMount struct {
+	Secret    string `yaml:"secret" json:"secret"`
+	MountPath string `yaml:"mountPath" json:"mountPath"`
+}
+
+type Resources struct {
+	Requests ResourceValues `yaml:"requests,omitempty" json:"requests,omitempty"`
+	Limits   ResourceValues `yaml:"limits,omitempty" json:"limits,omitempty"`
+}
+
+type ResourceValues struct {
+	CPU              string `yaml:"cpu,omitempty" json:"cpu,omitempty"`
+	Memory           string `yaml:"memory,omitempty" json:"memory,omitempty"`
+	EphemeralStorage string `yaml:"ephemeralStorage,omitempty" json:"ephemeralStorage,omitempty"`
+}
+
+type ScalingPolicy struct {
+	Metric                        string `yaml:"metric,omitempty" json:"metric,omitempty"`
+	Target                        int32  `yaml:"target,omitempty" json:"target,omitempty"`
+	ScaleUpStabilizationSeconds   *int32 `yaml:"scaleUpStabilizationSeconds,omitempty" json:"scaleUpStabilizationSeconds,omitempty"`
+	ScaleDownStabilizationSeconds *int32 `yaml:"scaleDownStabilizationSeconds,omitempty" json:"scaleDownStabilizationSeconds,omitempty"`
 }
 
 type Trigger struct {
+	Name   string            `yaml:"name,omitempty" json:"name,omitempty"`
 	Type   string            `yaml:"type" json:"type"`
 	Config map[string]string `yaml:"config" json:"config"`
 }
 
+type RetryPolicy struct {
+	MaxAttempts           int32 `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"`
+	InitialBackoffSeconds int32 `yaml:"initialBackoffSeconds,omitempty" json:"initialBackoffSeconds,omitempty"`
+	MaxBackoffSeconds     int32 `yaml:"maxBackoffSeconds,omitempty" json:"maxBackoffSeconds,omitempty"`
+	RetryableStatusCodes  []int `yaml:"retryableStatusCodes,omitempty" json:"retryableStatusCodes,omitempty"`
+}
+
+type TrafficTarget struct {
+	Revision       int64 `yaml:"revision,omitempty" json:"revision,omitempty"`
+	LatestRevision bool  `yaml:"latestRevision,omitempty" json:"latestRevision,omitempty"`
+	Percent        int32 `yaml:"percent" json:"percent"`
+}
+
 func newDeployCommand() *cobra.Command {
 	var (
 		functionFile string
@@ -114,8 +171,7 @@ func deployFunction(spec *FunctionSpec) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("failed to deploy function: %s", string(body))
+		return fmt.Errorf("failed to deploy function: %w", readAPIError(resp))
 	}
 
 	fmt.Printf("Function '%s' deployed successfully\n", spec.Name)
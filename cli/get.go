@@ -25,8 +25,7 @@ func newGetCommand() *cobra.Command {
 			defer resp.Body.Close()
 
 			if resp.StatusCode != http.StatusOK {
-				body, _ := ioutil.ReadAll(resp.Body)
-				return fmt.Errorf("failed to get function: %s", string(body))
+				return fmt.Errorf("failed to get function: %w", readAPIError(resp))
 			}
 
 			body, err := ioutil.ReadAll(resp.Body)
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type Invocation struct {
+	ID          string     `json:"id"`
+	Function    string     `json:"function"`
+	Revision    string     `json:"revision"`
+	Source      string     `json:"source"`
+	State       string     `json:"state"`
+	Attempts    int32      `json:"attempts"`
+	StatusCode  int        `json:"statusCode"`
+	Result      string     `json:"result"`
+	Error       string     `json:"error"`
+	DeadLetter  string     `json:"deadLetter"`
+	EnqueuedAt  time.Time  `json:"enqueuedAt"`
+	StartedAt   *time.Time `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+	Duration    float64    `json:"duration"`
+}
+
+func newInvocationCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "invocation",
+		Short: "Inspect asynchronous invocations",
+	}
+
+	cmd.AddCommand(newInvocationGetCommand())
+
+	return cmd
+}
+
+func newInvocationGetCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get [invocation-id]",
+		Short: "Get the status and result of an asynchronous invocation",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/invocations/%s", apiURL, args[0])
+
+			resp, err := http.Get(url)
+			if err != nil {
+				return fmt.Errorf("failed to get invocation: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to get invocation: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+
+			var inv Invocation
+			if err := json.Unmarshal(body, &inv); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintf(w, "ID\t%s\n", inv.ID)
+			fmt.Fprintf(w, "Function\t%s\n", inv.Function)
+			fmt.Fprintf(w, "Revision\t%s\n", inv.Revision)
+			fmt.Fprintf(w, "Source\t%s\n", inv.Source)
+			fmt.Fprintf(w, "State\t%s\n", inv.State)
+			fmt.Fprintf(w, "Attempts\t%d\n", inv.Attempts)
+			fmt.Fprintf(w, "Enqueued\t%s\n", inv.EnqueuedAt.Local().Format(time.RFC3339))
+			if inv.StartedAt != nil {
+				fmt.Fprintf(w, "Started\t%s\n", inv.StartedAt.Local().Format(time.RFC3339))
+			}
+			if inv.CompletedAt != nil {
+				fmt.Fprintf(w, "Completed\t%s\n", inv.CompletedAt.Local().Format(time.RFC3339))
+				fmt.Fprintf(w, "Duration\t%.3fs\n", inv.Duration)
+			}
+			if inv.StatusCode != 0 {
+				fmt.Fprintf(w, "Status Code\t%d\n", inv.StatusCode)
+			}
+			if inv.Error != "" {
+				fmt.Fprintf(w, "Error\t%s\n", inv.Error)
+			}
+			if inv.DeadLetter != "" {
+				fmt.Fprintf(w, "Dead Letter\t%s\n", inv.DeadLetter)
+			}
+			w.Flush()
+
+			if inv.Result != "" {
+				fmt.Println()
+				fmt.Println(inv.Result)
+			}
+			return nil
+		},
+	}
+}
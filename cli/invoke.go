@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,15 +11,20 @@ import (
 )
 
 func newInvokeCommand() *cobra.Command {
-	var payload string
+	var (
+		payload string
+		async   bool
+	)
 
 	cmd := &cobra.Command{
-		Use:   "invoke [function-name]",
+		Use:   "invoke [function-name[:alias]]",
 		Short: "Invoke a function",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			name := args[0]
-			url := fmt.Sprintf("%s/api/v1/functions/%s/invoke", apiURL, name)
+			url := functionPath(args[0]) + "/invoke"
+			if async {
+				url += "?mode=async"
+			}
 
 			resp, err := http.Post(url, "application/json", bytes.NewBufferString(payload))
 			if err != nil {
@@ -26,13 +32,28 @@ func newInvokeCommand() *cobra.Command {
 			}
 			defer resp.Body.Close()
 
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return fmt.Errorf("failed to read response: %w", err)
+			if async {
+				if resp.StatusCode != http.StatusAccepted {
+					return fmt.Errorf("failed to invoke function: %w", readAPIError(resp))
+				}
+
+				var invocation Invocation
+				if err := json.NewDecoder(resp.Body).Decode(&invocation); err != nil {
+					return fmt.Errorf("failed to parse response: %w", err)
+				}
+
+				fmt.Printf("Invocation '%s' queued\n", invocation.ID)
+				fmt.Printf("Check it with: ksls invocation get %s\n", invocation.ID)
+				return nil
 			}
 
 			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("failed to invoke function: %s", string(body))
+				return fmt.Errorf("failed to invoke function: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
 			}
 
 			fmt.Println(string(body))
@@ -41,6 +62,7 @@ func newInvokeCommand() *cobra.Command {
 	}
 
 	cmd.Flags().StringVarP(&payload, "payload", "p", "{}", "Function payload (JSON)")
+	cmd.Flags().BoolVar(&async, "async", false, "Queue the invocation and print its ID instead of waiting")
 
 	return cmd
 }
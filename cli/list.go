@@ -30,6 +30,10 @@ func newListCommand() *cobra.Command {
 			}
 			defer resp.Body.Close()
 
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to list functions: %w", readAPIError(resp))
+			}
+
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				return fmt.Errorf("failed to read response: %w", err)
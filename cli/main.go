@@ -29,6 +29,13 @@ on the Kube-Serverless platform.`,
 	rootCmd.AddCommand(newInvokeCommand())
 	rootCmd.AddCommand(newLogsCommand())
 	rootCmd.AddCommand(newMetricsCommand())
+	rootCmd.AddCommand(newRevisionsCommand())
+	rootCmd.AddCommand(newRollbackCommand())
+	rootCmd.AddCommand(newAliasCommand())
+	rootCmd.AddCommand(newInvocationCommand())
+	rootCmd.AddCommand(newDeadLettersCommand())
+	rootCmd.AddCommand(newTriggersCommand())
+	rootCmd.AddCommand(newSecretCommand())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
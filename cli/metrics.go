@@ -34,15 +34,15 @@ func newMetricsCommand() *cobra.Command {
 			}
 			defer resp.Body.Close()
 
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to get metrics: %w", readAPIError(resp))
+			}
+
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				return fmt.Errorf("failed to read response: %w", err)
 			}
 
-			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("failed to get metrics: %s", string(body))
-			}
-
 			var metrics FunctionMetrics
 			if err := json.Unmarshal(body, &metrics); err != nil {
 				return fmt.Errorf("failed to parse response: %w", err)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type Revision struct {
+	Number    int64     `json:"revision"`
+	Runtime   string    `json:"runtime"`
+	Handler   string    `json:"handler"`
+	CreatedAt time.Time `json:"createdAt"`
+	Current   bool      `json:"current"`
+}
+
+func newRevisionsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revisions [function-name]",
+		Short: "List the revisions of a function",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			url := fmt.Sprintf("%s/api/v1/functions/%s/revisions", apiURL, name)
+
+			resp, err := http.Get(url)
+			if err != nil {
+				return fmt.Errorf("failed to list revisions: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to list revisions: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+
+			var revisions []Revision
+			if err := json.Unmarshal(body, &revisions); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "REVISION\tRUNTIME\tHANDLER\tCREATED\tCURRENT")
+			for _, rev := range revisions {
+				current := ""
+				if rev.Current {
+					current = "*"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", rev.Number, rev.Runtime, rev.Handler, rev.CreatedAt.Local().Format(time.RFC3339), current)
+			}
+			w.Flush()
+
+			return nil
+		},
+	}
+}
+
+func newRollbackCommand() *cobra.Command {
+	var to int64
+
+	cmd := &cobra.Command{
+		Use:   "rollback [function-name]",
+		Short: "Roll a function back to an earlier revision",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			endpoint := fmt.Sprintf("%s/api/v1/functions/%s/rollback", apiURL, name)
+			if to > 0 {
+				endpoint += "?" + url.Values{"to": {strconv.FormatInt(to, 10)}}.Encode()
+			}
+
+			resp, err := http.Post(endpoint, "application/json", nil)
+			if err != nil {
+				return fmt.Errorf("failed to roll back function: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to roll back function: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+
+			var function map[string]interface{}
+			if err := json.Unmarshal(body, &function); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			fmt.Printf("Function '%s' rolled back to revision %d\n", name, getInt32Value(function, "status", "revision"))
+			return nil
+		},
+	}
+
+	cmd.Flags().Int64Var(&to, "to", 0, "Revision to roll back to (defaults to the previous revision)")
+
+	return cmd
+}
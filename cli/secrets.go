@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type Secret struct {
+	Name      string    `json:"name"`
+	Keys      []string  `json:"keys"`
+	UsedBy    []string  `json:"usedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newSecretCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "secret",
+		Short: "Manage secrets functions can use",
+	}
+
+	cmd.AddCommand(newSecretCreateCommand())
+	cmd.AddCommand(newSecretListCommand())
+	cmd.AddCommand(newSecretDeleteCommand())
+
+	return cmd
+}
+
+func newSecretCreateCommand() *cobra.Command {
+	var (
+		literals []string
+		files    []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "create [secret-name]",
+		Short: "Create a secret",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data := make(map[string]string)
+			for _, literal := range literals {
+				key, value, ok := strings.Cut(literal, "=")
+				if !ok {
+					return fmt.Errorf("invalid --from-literal %q, must be key=value", literal)
+				}
+				data[key] = value
+			}
+			for _, file := range files {
+				key, path, ok := strings.Cut(file, "=")
+				if !ok {
+					return fmt.Errorf("invalid --from-file %q, must be key=path", file)
+				}
+				content, err := ioutil.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				data[key] = string(content)
+			}
+			if len(data) == 0 {
+				return fmt.Errorf("at least one --from-literal or --from-file is required")
+			}
+
+			body, err := json.Marshal(map[string]interface{}{"name": args[0], "data": data})
+			if err != nil {
+				return fmt.Errorf("failed to encode request: %w", err)
+			}
+
+			url := fmt.Sprintf("%s/api/v1/secrets", apiURL)
+			resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return fmt.Errorf("failed to create secret: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusCreated {
+				return fmt.Errorf("failed to create secret: %w", readAPIError(resp))
+			}
+
+			var secret Secret
+			if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			fmt.Printf("Secret '%s' created with keys %s\n", secret.Name, strings.Join(secret.Keys, ", "))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&literals, "from-literal", nil, "Key and value to store, as key=value (repeatable)")
+	cmd.Flags().StringArrayVar(&files, "from-file", nil, "Key and file whose content to store, as key=path (repeatable)")
+
+	return cmd
+}
+
+func newSecretListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List secrets, without their values",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/secrets", apiURL)
+
+			resp, err := http.Get(url)
+			if err != nil {
+				return fmt.Errorf("failed to list secrets: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to list secrets: %w", readAPIError(resp))
+			}
+
+			var secrets []Secret
+			if err := json.NewDecoder(resp.Body).Decode(&secrets); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "NAME\tKEYS\tUSED BY\tCREATED")
+			for _, secret := range secrets {
+				usedBy := "-"
+				if len(secret.UsedBy) > 0 {
+					usedBy = strings.Join(secret.UsedBy, ",")
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+					secret.Name,
+					strings.Join(secret.Keys, ","),
+					usedBy,
+					secret.CreatedAt.Local().Format(time.RFC3339),
+				)
+			}
+			w.Flush()
+
+			return nil
+		},
+	}
+}
+
+func newSecretDeleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete [secret-name]",
+		Short: "Delete a secret no function uses",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/secrets/%s", apiURL, args[0])
+
+			req, err := http.NewRequest("DELETE", url, nil)
+			if err != nil {
+				return fmt.Errorf("failed to create request: %w", err)
+			}
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("failed to delete secret: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNoContent {
+				return fmt.Errorf("failed to delete secret: %w", readAPIError(resp))
+			}
+
+			fmt.Printf("Secret '%s' deleted successfully\n", args[0])
+			return nil
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type TriggerRun struct {
+	InvocationID string     `json:"invocationId"`
+	ScheduledAt  time.Time  `json:"scheduledAt"`
+	State        string     `json:"state"`
+	Attempts     int32      `json:"attempts"`
+	StatusCode   int        `json:"statusCode"`
+	Error        string     `json:"error"`
+	DeadLetter   string     `json:"deadLetter"`
+	CompletedAt  *time.Time `json:"completedAt"`
+}
+
+func newTriggersCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "triggers",
+		Short: "Inspect function triggers",
+	}
+
+	cmd.AddCommand(newTriggersRunsCommand())
+
+	return cmd
+}
+
+func newTriggersRunsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "runs [function-name] [trigger-name]",
+		Short: "List the recent runs of a trigger",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			url := fmt.Sprintf("%s/api/v1/functions/%s/triggers/%s/runs", apiURL, args[0], args[1])
+
+			resp, err := http.Get(url)
+			if err != nil {
+				return fmt.Errorf("failed to list trigger runs: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to list trigger runs: %w", readAPIError(resp))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+
+			var runs []TriggerRun
+			if err := json.Unmarshal(body, &runs); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "SCHEDULED\tSTATE\tATTEMPTS\tSTATUS\tINVOCATION\tERROR")
+			for _, run := range runs {
+				status, invocation := "-", "-"
+				if run.StatusCode != 0 {
+					status = fmt.Sprintf("%d", run.StatusCode)
+				}
+				if run.InvocationID != "" {
+					invocation = run.InvocationID
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+					run.ScheduledAt.Local().Format(time.RFC3339),
+					run.State,
+					run.Attempts,
+					status,
+					invocation,
+					run.Error,
+				)
+			}
+			w.Flush()
+
+			return nil
+		},
+	}
+}
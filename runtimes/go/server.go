@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"plugin"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,9 +17,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Handler is the signature of functions that take a context, which is
+// cancelled when the invocation times out. Functions without a context are
+// also supported, but keep running after a timeout.
+type Handler func(ctx context.Context, event map[string]interface{}) (interface{}, error)
+
 var (
 	coldStart = true
-	handler   func(map[string]interface{}) (interface{}, error)
+	handler   Handler
+	// functionTimeout is how long an invocation may run, set from
+	// FUNCTION_TIMEOUT in seconds.
+	functionTimeout = 60 * time.Second
 
 	invocations = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "function_invocations_total",
@@ -31,12 +41,17 @@ var (
 		Name: "function_cold_starts_total",
 		Help: "Total cold starts",
 	})
+	timeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "function_timeouts_total",
+		Help: "Total invocations that exceeded the function timeout",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(invocations)
 	prometheus.MustRegister(duration)
 	prometheus.MustRegister(coldStarts)
+	prometheus.MustRegister(timeouts)
 }
 
 type Event struct {
@@ -44,6 +59,7 @@ type Event struct {
 	Headers map[string]string `json:"headers"`
 	Method  string            `json:"method"`
 	Path    string            `json:"path"`
+	Params  map[string]string `json:"params"`
 	Query   map[string]string `json:"query"`
 }
 
@@ -65,16 +81,25 @@ func loadFunction() {
 		if err == nil {
 			sym, err := p.Lookup(handlerName)
 			if err == nil {
-				handler = sym.(func(map[string]interface{}) (interface{}, error))
-				log.Println("Function loaded successfully")
-				coldStart = false
-				return
+				switch h := sym.(type) {
+				case func(context.Context, map[string]interface{}) (interface{}, error):
+					handler = h
+				case func(map[string]interface{}) (interface{}, error):
+					handler = func(_ context.Context, event map[string]interface{}) (interface{}, error) {
+						return h(event)
+					}
+				}
+				if handler != nil {
+					log.Println("Function loaded successfully")
+					coldStart = false
+					return
+				}
 			}
 		}
 	}
 
 	log.Println("No function code found or failed to load, using echo handler")
-	handler = func(event map[string]interface{}) (interface{}, error) {
+	handler = func(_ context.Context, event map[string]interface{}) (interface{}, error) {
 		return map[string]interface{}{
 			"statusCode": 200,
 			"body":       event,
@@ -129,15 +154,51 @@ func invokeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Requests routed by the gateway carry the path below the trigger's
+	// path and the path params in headers.
+	path := r.URL.Path
+	if p := r.Header.Get("X-Function-Path"); p != "" {
+		path = p
+	}
+	params := make(map[string]string)
+	if p := r.Header.Get("X-Function-Params"); p != "" {
+		json.Unmarshal([]byte(p), &params)
+	}
+
 	event := map[string]interface{}{
 		"body":    bodyJSON,
 		"headers": headers,
 		"method":  r.Method,
-		"path":    r.URL.Path,
+		"path":    path,
+		"params":  params,
 		"query":   query,
 	}
 
-	result, err := handler(event)
+	ctx, cancel := context.WithTimeout(r.Context(), functionTimeout)
+	defer cancel()
+
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := handler(ctx, event)
+		done <- outcome{result, err}
+	}()
+
+	var result interface{}
+	select {
+	case o := <-done:
+		result, err = o.result, o.err
+	case <-ctx.Done():
+		// A caller giving up at the deadline cancels the request first.
+		if deadline, _ := ctx.Deadline(); ctx.Err() == context.DeadlineExceeded || !time.Now().Before(deadline) {
+			timeouts.Inc()
+			http.Error(w, fmt.Sprintf("function timed out after %s", functionTimeout), http.StatusGatewayTimeout)
+		}
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -164,13 +225,21 @@ func invokeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if v := os.Getenv("FUNCTION_TIMEOUT"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 1 {
+			log.Fatalf("Invalid FUNCTION_TIMEOUT %q", v)
+		}
+		functionTimeout = time.Duration(seconds) * time.Second
+	}
+
 	loadFunction()
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/health", healthHandler).Methods("GET")
 	r.HandleFunc("/ready", readyHandler).Methods("GET")
-	r.HandleFunc("/", invokeHandler).Methods("POST")
+	r.HandleFunc("/", invokeHandler)
 	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	port := os.Getenv("PORT")
@@ -184,8 +253,18 @@ func main() {
 	log.Printf("Go runtime server listening on port %s", port)
 	log.Printf("Function: %s", functionName)
 	log.Printf("Handler: %s", handlerName)
+	log.Printf("Timeout: %s", functionTimeout)
 
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+	// The write timeout leaves the handler its full timeout to answer.
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		WriteTimeout:      functionTimeout + 10*time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -68,8 +68,18 @@ app.get('/ready', (req, res) => {
   res.json({ status: 'ready', coldStart });
 });
 
-// Function invocation
-app.post('/', async (req, res) => {
+// Parses the path params the gateway passes for http triggers
+const pathParams = (req) => {
+  try {
+    return JSON.parse(req.get('X-Function-Params') || '{}');
+  } catch (error) {
+    return {};
+  }
+};
+
+// Function invocation. Requests routed by the gateway keep their method,
+// and carry the path below the trigger's path in X-Function-Path.
+app.all('/', async (req, res) => {
   const startTime = Date.now();
   const wasColdStart = coldStart;
 
@@ -82,7 +92,8 @@ app.post('/', async (req, res) => {
       body: req.body,
       headers: req.headers,
       method: req.method,
-      path: req.path,
+      path: req.get('X-Function-Path') || req.path,
+      params: pathParams(req),
       query: req.query
     };
 
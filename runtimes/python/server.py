@@ -62,7 +62,16 @@ def health():
 def ready():
     return jsonify({'status': 'ready', 'coldStart': cold_start})
 
-@app.route('/', methods=['POST'])
+def path_params():
+    """Parse the path params the gateway passes for http triggers"""
+    try:
+        return json.loads(request.headers.get('X-Function-Params', '{}'))
+    except ValueError:
+        return {}
+
+# Requests routed by the gateway keep their method, and carry the path below
+# the trigger's path in X-Function-Path.
+@app.route('/', methods=['GET', 'HEAD', 'POST', 'PUT', 'PATCH', 'DELETE', 'OPTIONS'])
 def invoke():
     global cold_start
 
@@ -80,7 +89,8 @@ def invoke():
             'body': request.get_json(silent=True) or {},
             'headers': dict(request.headers),
             'method': request.method,
-            'path': request.path,
+            'path': request.headers.get('X-Function-Path', request.path),
+            'params': path_params(),
             'query': dict(request.args)
         }
 
@@ -31,7 +31,7 @@ function DeployFunction() {
       navigate('/functions');
     } catch (error) {
       console.error('Error deploying function:', error);
-      alert('Failed to deploy function: ' + (error.response?.data || error.message));
+      alert('Failed to deploy function: ' + (error.response?.data?.message || error.message));
     }
   };
 